@@ -0,0 +1,291 @@
+package dns
+
+import (
+	"container/list"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fake ip 回应的 TTL
+// 映射可能被淘汰，客户端不应长时间缓存
+const FakeIPTTL = 1
+
+// fake ip
+// 为每个查询的域名从保留地址段中分配一个地址并记录映射，
+// 之后代理收到发往该地址的请求时可以换回域名，使按域名的规则对不使用代理 dns 的程序也生效。
+// 地址用尽或超过 maxSize 时淘汰最久未使用的映射。
+type FakeIP struct {
+	prefix  *net.IPNet
+	prefix6 *net.IPNet
+	// 可分配的地址数量，地址序号为 1 到 size
+	size uint32
+
+	m sync.Mutex
+	// 最近使用的在前
+	lru      *list.List
+	byDomain map[string]*list.Element
+	byIndex  map[uint32]*list.Element
+	// 下一个未使用过的序号
+	next uint32
+}
+
+type fakeIPEntry struct {
+	Domain string
+	Index  uint32
+}
+
+// prefix 为 ipv4 地址段，例如 198.18.0.0/15
+// prefix6 为 ipv6 地址段，为空时 AAAA 查询回应空结果
+// maxSize 为最多记录的映射数量，为 0 时只受地址段大小限制
+func NewFakeIP(prefix, prefix6 string, maxSize int) (*FakeIP, error) {
+	f := &FakeIP{
+		lru:      list.New(),
+		byDomain: make(map[string]*list.Element),
+		byIndex:  make(map[uint32]*list.Element),
+		next:     1,
+	}
+
+	_, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("net.ParseCIDR, %v", err)
+	}
+	ones, bits := ipNet.Mask.Size()
+	if bits != 8*net.IPv4len || bits-ones < 2 {
+		return nil, fmt.Errorf("%v is not ipv4 prefix or too small", prefix)
+	}
+	f.prefix = ipNet
+	// 不使用网络地址及广播地址
+	f.size = uint32(1<<uint(bits-ones)) - 2
+
+	if len(prefix6) != 0 {
+		_, ipNet, err := net.ParseCIDR(prefix6)
+		if err != nil {
+			return nil, fmt.Errorf("net.ParseCIDR, %v", err)
+		}
+		ones, bits := ipNet.Mask.Size()
+		if bits != 8*net.IPv6len || bits-ones < 2 {
+			return nil, fmt.Errorf("%v is not ipv6 prefix or too small", prefix6)
+		}
+		f.prefix6 = ipNet
+
+		// 只使用最后 32 位
+		if bits-ones < 32 {
+			if size6 := uint32(1<<uint(bits-ones)) - 1; size6 < f.size {
+				f.size = size6
+			}
+		}
+	}
+
+	if maxSize > 0 && uint32(maxSize) < f.size {
+		f.size = uint32(maxSize)
+	}
+
+	return f, nil
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+// 取得 domain 的 fake ip，没有时分配
+func (f *FakeIP) Alloc(domain string) (ipv4, ipv6 net.IP) {
+	domain = normalizeDomain(domain)
+
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	e := f.byDomain[domain]
+	if e != nil {
+		f.lru.MoveToFront(e)
+	} else {
+		e = f.allocLocked(domain)
+	}
+
+	return f.ips(e.Value.(*fakeIPEntry).Index)
+}
+
+func (f *FakeIP) allocLocked(domain string) *list.Element {
+	index := f.next
+	if index <= f.size {
+		f.next++
+	} else {
+		// 淘汰最久未使用的映射
+		back := f.lru.Back()
+		old := back.Value.(*fakeIPEntry)
+		f.lru.Remove(back)
+		delete(f.byDomain, old.Domain)
+		delete(f.byIndex, old.Index)
+		index = old.Index
+	}
+
+	return f.addLocked(domain, index)
+}
+
+func (f *FakeIP) addLocked(domain string, index uint32) *list.Element {
+	e := f.lru.PushFront(&fakeIPEntry{Domain: domain, Index: index})
+	f.byDomain[domain] = e
+	f.byIndex[index] = e
+	return e
+}
+
+func (f *FakeIP) ips(index uint32) (ipv4, ipv6 net.IP) {
+	ipv4 = make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ipv4, binary.BigEndian.Uint32(f.prefix.IP.To4())+index)
+
+	if f.prefix6 != nil {
+		ipv6 = make(net.IP, net.IPv6len)
+		copy(ipv6, f.prefix6.IP)
+		binary.BigEndian.PutUint32(ipv6[12:], binary.BigEndian.Uint32(ipv6[12:])+index)
+	}
+
+	return
+}
+
+// 取得 fake ip 对应的域名
+// ip 不是 fake ip 或映射已被淘汰时返回 false
+func (f *FakeIP) Lookup(ip net.IP) (string, bool) {
+	index, ok := f.index(ip)
+	if ok == false {
+		return "", false
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	e := f.byIndex[index]
+	if e == nil {
+		return "", false
+	}
+	f.lru.MoveToFront(e)
+
+	return e.Value.(*fakeIPEntry).Domain, true
+}
+
+// ip 是否在 fake ip 地址段内
+func (f *FakeIP) Contains(ip net.IP) bool {
+	return f.prefix.Contains(ip) || (f.prefix6 != nil && f.prefix6.Contains(ip))
+}
+
+func (f *FakeIP) index(ip net.IP) (uint32, bool) {
+	var index uint32
+
+	if ipv4 := ip.To4(); ipv4 != nil {
+		if f.prefix.Contains(ipv4) == false {
+			return 0, false
+		}
+		index = binary.BigEndian.Uint32(ipv4) - binary.BigEndian.Uint32(f.prefix.IP.To4())
+	} else {
+		if f.prefix6 == nil || len(ip) != net.IPv6len || f.prefix6.Contains(ip) == false {
+			return 0, false
+		}
+		base := f.prefix6.IP
+		for i := 0; i < 12; i++ {
+			if ip[i] != base[i] {
+				return 0, false
+			}
+		}
+		index = binary.BigEndian.Uint32(ip[12:]) - binary.BigEndian.Uint32(base[12:])
+	}
+
+	if index == 0 || index > f.size {
+		return 0, false
+	}
+	return index, true
+}
+
+// 记录的映射数量
+func (f *FakeIP) Len() int {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	return f.lru.Len()
+}
+
+// 回应 A、AAAA 查询，其他查询不处理
+func (f *FakeIP) Handler() Handler {
+	return func(ctx context.Context, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+		q, ok := question(query)
+		if ok == false {
+			return nil, nil
+		}
+
+		ipv4, ipv6 := f.Alloc(q.Name.String())
+
+		ips := []net.IP{ipv4}
+		if q.Type == dnsmessage.TypeAAAA {
+			ips = nil
+			if ipv6 != nil {
+				ips = []net.IP{ipv6}
+			}
+		}
+
+		return NewIPResponse(query, ips, FakeIPTTL), nil
+	}
+}
+
+// 保存映射，重启后通过 LoadFile 恢复，使客户端缓存的 fake ip 仍然有效
+func (f *FakeIP) SaveFile(file string) error {
+	f.m.Lock()
+	entries := make([]*fakeIPEntry, 0, f.lru.Len())
+	// 最久未使用的在前，加载时依次放到最前面即可恢复顺序
+	for e := f.lru.Back(); e != nil; e = e.Prev() {
+		entries = append(entries, e.Value.(*fakeIPEntry))
+	}
+	f.m.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("json.Marshal, %v", err)
+	}
+
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+// 加载 SaveFile 保存的映射
+// 超出当前地址段大小的映射会被忽略
+func (f *FakeIP) LoadFile(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var entries []*fakeIPEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return fmt.Errorf("json.Unmarshal, %v", err)
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	for _, v := range entries {
+		domain := normalizeDomain(v.Domain)
+		if v.Index == 0 || v.Index > f.size || len(domain) == 0 {
+			continue
+		}
+
+		if e := f.byDomain[domain]; e != nil {
+			f.lru.Remove(e)
+			delete(f.byIndex, e.Value.(*fakeIPEntry).Index)
+		}
+		if e := f.byIndex[v.Index]; e != nil {
+			f.lru.Remove(e)
+			delete(f.byDomain, e.Value.(*fakeIPEntry).Domain)
+		}
+
+		f.addLocked(domain, v.Index)
+		if v.Index >= f.next {
+			f.next = v.Index + 1
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package dns
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestFakeIP(t *testing.T) {
+	f, err := NewFakeIP("198.18.0.0/15", "fc00::/64", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a4, a6 := f.Alloc("A.example.com.")
+	if a4.String() != "198.18.0.1" || a6.String() != "fc00::1" {
+		t.Fatalf("a4 = %v, a6 = %v", a4, a6)
+	}
+	b4, _ := f.Alloc("b.example.com")
+	if b4.String() != "198.18.0.2" {
+		t.Fatalf("b4 = %v", b4)
+	}
+
+	if domain, ok := f.Lookup(a6); ok == false || domain != "a.example.com" {
+		t.Fatalf("domain = %v, ok = %v", domain, ok)
+	}
+
+	// 超过 maxSize 时淘汰最久未使用的 b.example.com
+	c4, _ := f.Alloc("c.example.com")
+	if c4.String() != "198.18.0.2" {
+		t.Fatalf("c4 = %v", c4)
+	}
+	if domain, _ := f.Lookup(c4); domain != "c.example.com" {
+		t.Fatalf("domain = %v", domain)
+	}
+	if domain, ok := f.Lookup(a4); ok == false || domain != "a.example.com" {
+		t.Fatalf("domain = %v, ok = %v", domain, ok)
+	}
+
+	if f.Contains(net.IPv4(198, 19, 0, 1)) == false || f.Contains(net.IPv4(1, 2, 3, 4)) {
+		t.Fatal("Contains")
+	}
+	if _, ok := f.Lookup(net.IPv4(198, 18, 0, 3)); ok {
+		t.Fatal("unexpected mapping")
+	}
+
+	dir, err := ioutil.TempDir("", "fakeip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "fakeip.json")
+
+	err = f.SaveFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f2, _ := NewFakeIP("198.18.0.0/15", "", 2)
+	err = f2.LoadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f2.Len() != 2 {
+		t.Fatalf("Len = %v", f2.Len())
+	}
+	if domain, _ := f2.Lookup(c4); domain != "c.example.com" {
+		t.Fatalf("domain = %v", domain)
+	}
+
+	// 加载后继续分配不能与已有映射冲突
+	d4, _ := f2.Alloc("d.example.com")
+	if d4.String() != "198.18.0.1" {
+		t.Fatalf("d4 = %v", d4)
+	}
+}
+
+func TestFakeIP_Handler(t *testing.T) {
+	f, _ := NewFakeIP("198.18.0.0/15", "", 0)
+	h := f.Handler()
+
+	resp, err := h(context.Background(), newQuery("www.example.com.", dnsmessage.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answers) != 1 || resp.Answers[0].Header.TTL != FakeIPTTL {
+		t.Fatalf("resp = %#v", resp)
+	}
+	ip := net.IP(resp.Answers[0].Body.(*dnsmessage.AResource).A[:])
+	if domain, _ := f.Lookup(ip); domain != "www.example.com" {
+		t.Fatalf("domain = %v", domain)
+	}
+
+	// 未配置 ipv6 地址段时 AAAA 回应空结果
+	resp, _ = h(context.Background(), newQuery("www.example.com.", dnsmessage.TypeAAAA))
+	if resp.Header.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 0 {
+		t.Fatalf("resp = %#v", resp)
+	}
+}
@@ -0,0 +1,365 @@
+package dns
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type ForwarderConfig struct {
+	// 上游 dns 服务器地址，例如 8.8.8.8:53
+	Upstream string
+
+	// 通过 udp 向上游发出查询并返回回应，为空时只使用 tcp
+	UdpExchange func(ctx context.Context, upstream string, query []byte) ([]byte, error)
+	// udp 查询超时时间，超时后改用 tcp
+	UdpTimeout time.Duration
+	// udp 连续失败这么多次后认为 udp 被阻断，之后 UdpRetryInterval 内直接使用 tcp
+	UdpFailThreshold int
+	UdpRetryInterval time.Duration
+
+	// 建立到上游的 tcp 连接，udp 失败或回应被截断时使用，为空时不使用 tcp
+	TcpDialContext func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// 最多缓存的回应数量，为 0 时不缓存，超出时淘汰最久未使用的回应
+	CacheSize int
+	// 缓存时间取回应中最小的 TTL，并限制在这个范围内
+	CacheMinTTL time.Duration
+	CacheMaxTTL time.Duration
+}
+
+func (c *ForwarderConfig) Default() {
+	dial := net.Dialer{}
+
+	*c = ForwarderConfig{
+		Upstream: "8.8.8.8:53",
+		UdpExchange: func(ctx context.Context, upstream string, query []byte) ([]byte, error) {
+			conn, err := dial.DialContext(ctx, "udp", upstream)
+			if err != nil {
+				return nil, err
+			}
+			defer conn.Close()
+
+			if deadline, ok := ctx.Deadline(); ok {
+				_ = conn.SetDeadline(deadline)
+			}
+
+			_, err = conn.Write(query)
+			if err != nil {
+				return nil, err
+			}
+
+			return ReadUdpResponse(conn, query)
+		},
+		UdpTimeout:       2 * time.Second,
+		UdpFailThreshold: 3,
+		UdpRetryInterval: 60 * time.Second,
+		TcpDialContext:   dial.DialContext,
+		CacheSize:        4096,
+		CacheMinTTL:      10 * time.Second,
+		CacheMaxTTL:      60 * 60 * time.Second,
+	}
+}
+
+// 从 r 读取 query 的回应，忽略 ID 不匹配的包
+func ReadUdpResponse(r interface {
+	Read(b []byte) (int, error)
+}, query []byte) ([]byte, error) {
+	if len(query) < 2 {
+		return nil, fmt.Errorf("query is too short")
+	}
+
+	buf := make([]byte, maxUdpMessageSize)
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		if n >= 2 && buf[0] == query[0] && buf[1] == query[1] {
+			return append([]byte(nil), buf[:n]...), nil
+		}
+	}
+}
+
+// dns 转发
+// 将查询转发给上游服务器并缓存回应，udp 不可用时改用 tcp。
+// Exchange 方法可以直接作为 Handler 使用，例如配合 ServeAddr 在本机提供 dns 服务。
+type Forwarder struct {
+	conf *ForwarderConfig
+
+	m sync.Mutex
+	// udp 连续失败次数
+	udpFails int
+	// 这个时间之前不使用 udp
+	udpDisabledUntil time.Time
+	// 缓存的回应，最近使用的在前
+	cacheLru *list.List
+	cache    map[forwarderCacheKey]*list.Element
+}
+
+type forwarderCacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+// 缓存打包后的回应，每次命中时重新解析，调用方修改回应不会影响缓存
+type forwarderCacheItem struct {
+	key     forwarderCacheKey
+	resp    []byte
+	created time.Time
+	expire  time.Time
+}
+
+func NewForwarder(conf *ForwarderConfig) (*Forwarder, error) {
+	if len(conf.Upstream) == 0 {
+		return nil, fmt.Errorf("upstream cannot be empty")
+	}
+	if conf.UdpExchange == nil && conf.TcpDialContext == nil {
+		return nil, fmt.Errorf("UdpExchange and TcpDialContext cannot both be empty")
+	}
+
+	return &Forwarder{
+		conf:     conf,
+		cacheLru: list.New(),
+		cache:    make(map[forwarderCacheKey]*list.Element),
+	}, nil
+}
+
+// 转发 query，返回上游的回应
+func (f *Forwarder) Exchange(ctx context.Context, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+	key, cacheable := f.cacheKey(query)
+	if cacheable {
+		if resp := f.getCache(key, query.Header.ID); resp != nil {
+			return resp, nil
+		}
+	}
+
+	data, err := query.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("query.Pack, %v", err)
+	}
+
+	respData, err := f.exchange(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &dnsmessage.Message{}
+	err = resp.Unpack(respData)
+	if err != nil {
+		return nil, fmt.Errorf("resp.Unpack, %v", err)
+	}
+
+	if cacheable {
+		f.setCache(key, resp, respData)
+	}
+
+	return resp, nil
+}
+
+func (f *Forwarder) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	conf := f.conf
+	var udpErr error
+
+	if conf.UdpExchange != nil && f.udpEnabled() {
+		udpCtx, cancel := context.WithTimeout(ctx, conf.UdpTimeout)
+		resp, err := conf.UdpExchange(udpCtx, conf.Upstream, query)
+		cancel()
+
+		f.udpResult(err)
+
+		// 回应被截断时需要使用 tcp 重新查询
+		if err == nil && (len(resp) < 3 || resp[2]&0x02 == 0 || conf.TcpDialContext == nil) {
+			return resp, nil
+		}
+		if err != nil {
+			udpErr = fmt.Errorf("UdpExchange, %v", err)
+		}
+	}
+
+	if conf.TcpDialContext == nil {
+		if udpErr == nil {
+			udpErr = fmt.Errorf("udp is disabled")
+		}
+		return nil, udpErr
+	}
+
+	resp, err := f.tcpExchange(ctx, query)
+	if err != nil {
+		if udpErr != nil {
+			return nil, fmt.Errorf("%v, tcpExchange, %v", udpErr, err)
+		}
+		return nil, fmt.Errorf("tcpExchange, %v", err)
+	}
+
+	return resp, nil
+}
+
+func (f *Forwarder) tcpExchange(ctx context.Context, query []byte) ([]byte, error) {
+	c, err := f.conf.TcpDialContext(ctx, "tcp", f.conf.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(deadline)
+	}
+
+	err = WriteTcpMessage(c, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return ReadTcpMessage(c)
+}
+
+func (f *Forwarder) udpEnabled() bool {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	return time.Now().After(f.udpDisabledUntil)
+}
+
+func (f *Forwarder) udpResult(err error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if err == nil {
+		f.udpFails = 0
+		return
+	}
+
+	f.udpFails++
+	if f.conf.UdpFailThreshold > 0 && f.udpFails >= f.conf.UdpFailThreshold && f.conf.TcpDialContext != nil {
+		f.udpFails = 0
+		f.udpDisabledUntil = time.Now().Add(f.conf.UdpRetryInterval)
+	}
+}
+
+func (f *Forwarder) cacheKey(query *dnsmessage.Message) (forwarderCacheKey, bool) {
+	if f.conf.CacheSize <= 0 || query.Header.Response || query.Header.OpCode != 0 || len(query.Questions) != 1 {
+		return forwarderCacheKey{}, false
+	}
+
+	q := query.Questions[0]
+	return forwarderCacheKey{
+		name:  strings.ToLower(q.Name.String()),
+		qtype: q.Type,
+		class: q.Class,
+	}, true
+}
+
+// 取得缓存的回应，TTL 减去已缓存的时间
+func (f *Forwarder) getCache(key forwarderCacheKey, id uint16) *dnsmessage.Message {
+	now := time.Now()
+
+	f.m.Lock()
+	var item *forwarderCacheItem
+	if e := f.cache[key]; e != nil {
+		item = e.Value.(*forwarderCacheItem)
+		if now.After(item.expire) {
+			f.cacheLru.Remove(e)
+			delete(f.cache, key)
+			item = nil
+		} else {
+			f.cacheLru.MoveToFront(e)
+		}
+	}
+	f.m.Unlock()
+
+	if item == nil {
+		return nil
+	}
+
+	resp := &dnsmessage.Message{}
+	err := resp.Unpack(item.resp)
+	if err != nil {
+		return nil
+	}
+
+	elapsed := uint32(now.Sub(item.created) / time.Second)
+
+	resp.Header.ID = id
+	resp.Answers = adjustTTL(resp.Answers, elapsed)
+	resp.Authorities = adjustTTL(resp.Authorities, elapsed)
+	resp.Additionals = adjustTTL(resp.Additionals, elapsed)
+
+	return resp
+}
+
+func adjustTTL(rs []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	if len(rs) == 0 {
+		return rs
+	}
+
+	n := make([]dnsmessage.Resource, len(rs))
+	copy(n, rs)
+	for i := range n {
+		// OPT 记录的 TTL 字段不是时间
+		if n[i].Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		if n[i].Header.TTL > elapsed {
+			n[i].Header.TTL -= elapsed
+		} else {
+			n[i].Header.TTL = 0
+		}
+	}
+	return n
+}
+
+// 缓存成功及域名不存在的回应
+// data 是 resp 打包后的数据，会被复制
+func (f *Forwarder) setCache(key forwarderCacheKey, resp *dnsmessage.Message, data []byte) {
+	if resp.Header.Truncated ||
+		(resp.Header.RCode != dnsmessage.RCodeSuccess && resp.Header.RCode != dnsmessage.RCodeNameError) {
+		return
+	}
+
+	ttl := f.conf.CacheMaxTTL
+	for _, rs := range [][]dnsmessage.Resource{resp.Answers, resp.Authorities} {
+		for _, r := range rs {
+			if d := time.Duration(r.Header.TTL) * time.Second; d < ttl {
+				ttl = d
+			}
+		}
+	}
+	if ttl < f.conf.CacheMinTTL {
+		ttl = f.conf.CacheMinTTL
+	}
+
+	now := time.Now()
+	item := &forwarderCacheItem{
+		key:     key,
+		resp:    append([]byte(nil), data...),
+		created: now,
+		expire:  now.Add(ttl),
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if e := f.cache[key]; e != nil {
+		e.Value = item
+		f.cacheLru.MoveToFront(e)
+		return
+	}
+
+	// 淘汰最久未使用的回应
+	for f.cacheLru.Len() >= f.conf.CacheSize {
+		e := f.cacheLru.Back()
+		f.cacheLru.Remove(e)
+		delete(f.cache, e.Value.(*forwarderCacheItem).key)
+	}
+
+	f.cache[key] = f.cacheLru.PushFront(item)
+}
@@ -0,0 +1,125 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestForwarder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var queries int32
+	serverConf := ServerConfig{}
+	serverConf.Default()
+	serverConf.Handler = func(ctx context.Context, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+		atomic.AddInt32(&queries, 1)
+		return NewIPResponse(query, []net.IP{net.IPv4(1, 2, 3, 4)}, 300), nil
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = ServerListen(ctx, ln, &serverConf)
+	}()
+
+	var udpCalls int32
+	conf := ForwarderConfig{}
+	conf.Default()
+	conf.Upstream = ln.Addr().String()
+	conf.UdpFailThreshold = 1
+	// 模拟 udp 被阻断
+	conf.UdpExchange = func(ctx context.Context, upstream string, query []byte) ([]byte, error) {
+		atomic.AddInt32(&udpCalls, 1)
+		return nil, fmt.Errorf("blocked")
+	}
+
+	f, err := NewForwarder(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, name := range []string{"www.example.com.", "WWW.example.com.", "example.org."} {
+		query := newQuery(name, dnsmessage.TypeA)
+		query.Header.ID = uint16(i)
+
+		resp, err := f.Exchange(ctx, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Header.ID != uint16(i) || len(resp.Answers) != 1 {
+			t.Fatalf("resp = %#v", resp)
+		}
+	}
+
+	// 第二个查询命中缓存，udp 失败一次后不再尝试
+	if queries != 2 || udpCalls != 1 {
+		t.Fatalf("queries = %v, udpCalls = %v", queries, udpCalls)
+	}
+}
+
+func TestForwarder_Cache(t *testing.T) {
+	var calls int32
+	conf := ForwarderConfig{}
+	conf.Default()
+	conf.Upstream = "127.0.0.1:53"
+	conf.TcpDialContext = nil
+	conf.CacheSize = 2
+	conf.UdpExchange = func(ctx context.Context, upstream string, query []byte) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+
+		q := dnsmessage.Message{}
+		err := q.Unpack(query)
+		if err != nil {
+			return nil, err
+		}
+		return NewIPResponse(&q, []net.IP{net.IPv4(1, 2, 3, 4)}, 300).Pack()
+	}
+
+	f, err := NewForwarder(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exchange := func(name string) *dnsmessage.Message {
+		resp, err := f.Exchange(context.Background(), newQuery(name, dnsmessage.TypeA))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answers) != 1 || resp.Answers[0].Body.(*dnsmessage.AResource).A != [4]byte{1, 2, 3, 4} {
+			t.Fatalf("resp = %#v", resp)
+		}
+		return resp
+	}
+
+	// 修改返回的回应不能影响缓存
+	for i := 0; i < 2; i++ {
+		resp := exchange("a.com.")
+		resp.Answers[0].Body.(*dnsmessage.AResource).A = [4]byte{9, 9, 9, 9}
+		resp.Answers[0].Header.TTL = 0
+	}
+	if calls != 1 {
+		t.Fatalf("calls = %v", calls)
+	}
+
+	// 缓存满时淘汰最久未使用的 b.com，而不是清空
+	exchange("b.com.")
+	exchange("a.com.")
+	exchange("c.com.")
+	exchange("a.com.")
+	if calls != 3 {
+		t.Fatalf("calls = %v", calls)
+	}
+
+	exchange("b.com.")
+	if calls != 4 {
+		t.Fatalf("calls = %v", calls)
+	}
+}
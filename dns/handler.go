@@ -0,0 +1,169 @@
+// dns 查询处理
+// 用于在代理中拦截客户端发出的 dns 查询，由本机解析或按规则回应。
+package dns
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// 回应的默认 TTL，单位秒
+const DefaultTTL = 60
+
+// 处理一个 dns 查询
+// 返回 nil, nil 表示不处理，由调用方按原样转发查询。
+// 返回错误时调用方应回应 SERVFAIL。
+type Handler func(ctx context.Context, query *dnsmessage.Message) (*dnsmessage.Message, error)
+
+// 依次调用 hs，返回第一个非空的回应
+func Chain(hs ...Handler) Handler {
+	return func(ctx context.Context, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+		for _, h := range hs {
+			resp, err := h(ctx, query)
+			if err != nil || resp != nil {
+				return resp, err
+			}
+		}
+		return nil, nil
+	}
+}
+
+// 使用 r 解析 A、AAAA 查询，其他类型不处理
+// r 为空时使用 net.DefaultResolver
+func ResolverHandler(r *net.Resolver) Handler {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+
+	return func(ctx context.Context, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+		q, ok := question(query)
+		if ok == false {
+			return nil, nil
+		}
+
+		network := "ip4"
+		if q.Type == dnsmessage.TypeAAAA {
+			network = "ip6"
+		}
+
+		name := strings.TrimSuffix(q.Name.String(), ".")
+		ips, err := r.LookupIP(ctx, network, name)
+		if err != nil {
+			if e, _ := err.(*net.DNSError); e != nil && e.IsNotFound {
+				// 域名存在但没有这个类型的记录时也会是 IsNotFound，这里不做区分
+				return NewResponse(query, dnsmessage.RCodeNameError), nil
+			}
+			return nil, err
+		}
+
+		return NewIPResponse(query, ips, DefaultTTL), nil
+	}
+}
+
+// 按静态表回应 A、AAAA 查询
+// 键为域名，不区分大小写，"*.example.com" 匹配 example.com 的所有子域名。
+// 值为空时回应 NXDOMAIN，可以用来屏蔽域名。不在表中的域名不处理。
+func HostsHandler(hosts map[string][]net.IP) Handler {
+	m := make(map[string][]net.IP, len(hosts))
+	for k, v := range hosts {
+		m[strings.ToLower(strings.TrimSuffix(k, "."))] = v
+	}
+
+	return func(ctx context.Context, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+		q, ok := question(query)
+		if ok == false {
+			return nil, nil
+		}
+
+		ips, ok := lookupHosts(m, strings.ToLower(strings.TrimSuffix(q.Name.String(), ".")))
+		if ok == false {
+			return nil, nil
+		}
+
+		if len(ips) == 0 {
+			return NewResponse(query, dnsmessage.RCodeNameError), nil
+		}
+
+		return NewIPResponse(query, ips, DefaultTTL), nil
+	}
+}
+
+func lookupHosts(m map[string][]net.IP, name string) ([]net.IP, bool) {
+	if ips, ok := m[name]; ok {
+		return ips, true
+	}
+
+	for {
+		i := strings.IndexByte(name, '.')
+		if i == -1 {
+			return nil, false
+		}
+		name = name[i+1:]
+
+		if ips, ok := m["*."+name]; ok {
+			return ips, true
+		}
+	}
+}
+
+// 取得 A、AAAA 查询的问题，其他查询返回 false
+func question(query *dnsmessage.Message) (dnsmessage.Question, bool) {
+	if query.Header.Response || query.Header.OpCode != 0 || len(query.Questions) != 1 {
+		return dnsmessage.Question{}, false
+	}
+
+	q := query.Questions[0]
+	if q.Class != dnsmessage.ClassINET ||
+		(q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA) {
+		return dnsmessage.Question{}, false
+	}
+
+	return q, true
+}
+
+// 生成 query 的空回应
+func NewResponse(query *dnsmessage.Message, rcode dnsmessage.RCode) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.Header.ID,
+			Response:           true,
+			OpCode:             query.Header.OpCode,
+			RecursionDesired:   query.Header.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: query.Questions,
+	}
+}
+
+// 生成 A、AAAA 查询的回应，只包含与查询类型相同的地址
+func NewIPResponse(query *dnsmessage.Message, ips []net.IP, ttl uint32) *dnsmessage.Message {
+	resp := NewResponse(query, dnsmessage.RCodeSuccess)
+	if len(query.Questions) == 0 {
+		return resp
+	}
+
+	q := query.Questions[0]
+	h := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: ttl}
+
+	for _, ip := range ips {
+		ipv4 := ip.To4()
+
+		switch {
+		case q.Type == dnsmessage.TypeA && ipv4 != nil:
+			r := &dnsmessage.AResource{}
+			copy(r.A[:], ipv4)
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: h, Body: r})
+
+		case q.Type == dnsmessage.TypeAAAA && ipv4 == nil && len(ip) == net.IPv6len:
+			r := &dnsmessage.AAAAResource{}
+			copy(r.AAAA[:], ip)
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: h, Body: r})
+		}
+	}
+
+	return resp
+}
@@ -0,0 +1,64 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func newQuery(name string, qtype dnsmessage.Type) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 1234, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+}
+
+func TestHostsHandler(t *testing.T) {
+	h := Chain(HostsHandler(map[string][]net.IP{
+		"www.example.com":   {net.IPv4(1, 2, 3, 4), net.ParseIP("::1")},
+		"*.ads.example.com": nil,
+	}), func(ctx context.Context, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+		return nil, nil
+	})
+
+	resp, err := h(context.Background(), newQuery("WWW.example.com.", dnsmessage.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.ID != 1234 || resp.Header.Response == false || len(resp.Answers) != 1 ||
+		resp.Answers[0].Body.(*dnsmessage.AResource).A != [4]byte{1, 2, 3, 4} {
+		t.Fatalf("resp = %#v", resp)
+	}
+
+	// 回应需要能够打包发出
+	_, err = resp.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, _ = h(context.Background(), newQuery("www.example.com.", dnsmessage.TypeAAAA))
+	if len(resp.Answers) != 1 {
+		t.Fatalf("resp = %#v", resp)
+	}
+
+	resp, _ = h(context.Background(), newQuery("a.b.ads.example.com.", dnsmessage.TypeA))
+	if resp.Header.RCode != dnsmessage.RCodeNameError {
+		t.Fatalf("resp = %#v", resp)
+	}
+
+	// 不在表中及非 A、AAAA 查询不处理
+	resp, _ = h(context.Background(), newQuery("example.org.", dnsmessage.TypeA))
+	if resp != nil {
+		t.Fatalf("resp = %#v", resp)
+	}
+	resp, _ = h(context.Background(), newQuery("www.example.com.", dnsmessage.TypeMX))
+	if resp != nil {
+		t.Fatalf("resp = %#v", resp)
+	}
+}
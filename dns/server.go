@@ -0,0 +1,225 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/gamexg/proxylib/mempool"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// udp dns 消息最大长度
+const maxUdpMessageSize = 65535
+
+type ServerConfig struct {
+	// 处理查询，返回 nil, nil 时回应 REFUSED
+	Handler Handler
+	// 处理单个查询的超时时间
+	Timeout time.Duration
+	// tcp 连接空闲超时时间
+	TcpIdleTimeout time.Duration
+}
+
+func (c *ServerConfig) Default() {
+	*c = ServerConfig{
+		Handler:        nil,
+		Timeout:        5 * time.Second,
+		TcpIdleTimeout: 2 * 60 * time.Second,
+	}
+}
+
+// 处理一个查询，返回打包好的回应
+// query 无法解析时返回错误，调用方应丢弃
+func serveMessage(ctx context.Context, data []byte, conf *ServerConfig) ([]byte, error) {
+	query := dnsmessage.Message{}
+	err := query.Unpack(data)
+	if err != nil {
+		return nil, fmt.Errorf("query.Unpack, %v", err)
+	}
+	if query.Header.Response {
+		return nil, fmt.Errorf("unexpected response message")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, conf.Timeout)
+	defer cancel()
+
+	var resp *dnsmessage.Message
+	if conf.Handler != nil {
+		resp, err = conf.Handler(ctx, &query)
+	}
+	if err != nil {
+		resp = NewResponse(&query, dnsmessage.RCodeServerFailure)
+	} else if resp == nil {
+		resp = NewResponse(&query, dnsmessage.RCodeRefused)
+	}
+
+	return resp.Pack()
+}
+
+// 在 udp 连接上提供 dns 服务，每个查询使用一个线程处理
+func ServePacketConn(ctx context.Context, c net.PacketConn, conf *ServerConfig) error {
+	defer c.Close()
+
+	lCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		<-lCtx.Done()
+		_ = c.Close()
+	}()
+
+	buf := mempool.Get(maxUdpMessageSize)
+	defer mempool.Put(buf)
+
+	for {
+		n, addr, err := c.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-lCtx.Done():
+				return lCtx.Err()
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+
+		data := append([]byte(nil), buf[:n]...)
+		go func() {
+			resp, err := serveMessage(lCtx, data, conf)
+			if err != nil {
+				return
+			}
+			_, _ = c.WriteTo(resp, addr)
+		}()
+	}
+}
+
+// 在 tcp 连接上提供 dns 服务，消息带 2 字节长度前缀，rfc1035 4.2.2
+func ServeConn(ctx context.Context, c net.Conn, conf *ServerConfig) error {
+	defer c.Close()
+
+	for {
+		_ = c.SetReadDeadline(time.Now().Add(conf.TcpIdleTimeout))
+
+		data, err := ReadTcpMessage(c)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		resp, err := serveMessage(ctx, data, conf)
+		if err != nil {
+			return err
+		}
+
+		err = WriteTcpMessage(c, resp)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// 读取带 2 字节长度前缀的 dns 消息
+func ReadTcpMessage(r io.Reader) ([]byte, error) {
+	l := make([]byte, 2)
+	_, err := io.ReadFull(r, l)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, binary.BigEndian.Uint16(l))
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// 写入带 2 字节长度前缀的 dns 消息
+func WriteTcpMessage(w io.Writer, data []byte) error {
+	if len(data) > 0xFFFF {
+		return fmt.Errorf("message is too long")
+	}
+
+	b := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(b, uint16(len(data)))
+	copy(b[2:], data)
+
+	_, err := w.Write(b)
+	return err
+}
+
+func ServerListen(ctx context.Context, ln net.Listener, conf *ServerConfig) error {
+	defer ln.Close()
+
+	lCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		<-lCtx.Done()
+		_ = ln.Close()
+	}()
+
+	var tempDelay time.Duration
+	for {
+		c, e := ln.Accept()
+		if e != nil {
+			if ne, ok := e.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				time.Sleep(tempDelay)
+				continue
+			}
+			return e
+		}
+		tempDelay = 0
+
+		go func() {
+			_ = ServeConn(lCtx, c, conf)
+		}()
+	}
+}
+
+// 在 addr 上同时监听 udp 及 tcp
+func ServeAddr(ctx context.Context, addr string, conf *ServerConfig) error {
+	lCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("net.ListenPacket, %v", err)
+	}
+	defer pc.Close()
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("net.Listen, %v", err)
+	}
+	defer ln.Close()
+
+	errC := make(chan error, 2)
+	go func() {
+		errC <- ServePacketConn(lCtx, pc, conf)
+	}()
+	go func() {
+		errC <- ServerListen(lCtx, ln, conf)
+	}()
+
+	// 任意一个退出时关闭另一个
+	return <-errC
+}
@@ -0,0 +1,99 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestServe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conf := ServerConfig{}
+	conf.Default()
+	conf.Handler = HostsHandler(map[string][]net.IP{
+		"www.example.com": {net.IPv4(1, 2, 3, 4)},
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = ServePacketConn(ctx, pc, &conf)
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = ServerListen(ctx, ln, &conf)
+	}()
+
+	query, _ := newQuery("www.example.com.", dnsmessage.TypeA).Pack()
+	other, _ := newQuery("example.org.", dnsmessage.TypeA).Pack()
+
+	t.Run("udp", func(t *testing.T) {
+		c, err := net.Dial("udp", pc.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+		_, err = c.Write(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 512)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp := dnsmessage.Message{}
+		err = resp.Unpack(buf[:n])
+		if err != nil || len(resp.Answers) != 1 {
+			t.Fatalf("resp = %#v, err = %v", resp, err)
+		}
+	})
+
+	t.Run("tcp", func(t *testing.T) {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+		// 同一连接上的多个查询
+		for i, q := range [][]byte{query, other} {
+			err = WriteTcpMessage(c, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := ReadTcpMessage(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp := dnsmessage.Message{}
+			err = resp.Unpack(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// 未处理的查询回应 REFUSED
+			if (i == 0 && len(resp.Answers) != 1) || (i == 1 && resp.Header.RCode != dnsmessage.RCodeRefused) {
+				t.Fatalf("i = %v, resp = %#v", i, resp)
+			}
+		}
+	})
+}
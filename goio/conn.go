@@ -0,0 +1,125 @@
+package goio
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gamexg/proxylib/mempool"
+)
+
+// 预读连接
+// 读取时先返回 prefix 的内容，之后才从底层连接读取
+// 用于协议识别等预先读取了部分数据，之后又需要交由其他库处理的情况
+type PrefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func NewPrefixConn(c net.Conn, prefix []byte) *PrefixConn {
+	return &PrefixConn{
+		Conn:   c,
+		prefix: prefix,
+	}
+}
+
+func (c *PrefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) != 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+
+	return c.Conn.Read(b)
+}
+
+// Forward 的默认缓冲区尺寸
+const defaultForwardBufSize = 32 * 1024
+
+// 双向转发 c1、c2 的数据
+// 任意方向结束后中断另一方向，并返回第一个错误
+// 每次读取前将两个连接的超时设置为 timeout 之后，即空闲超时，timeout 为 0 表示不限制
+// bufSize <= 0 时使用默认值 32*1024
+func Forward(ctx context.Context, c1, c2 net.Conn, name1, name2 string, bufSize int, timeout time.Duration) error {
+	if bufSize <= 0 {
+		bufSize = defaultForwardBufSize
+	}
+
+	var forwardErr error
+	var forwardM sync.Mutex
+	setForwardErr := func(err error) {
+		forwardM.Lock()
+		defer forwardM.Unlock()
+
+		if forwardErr == nil {
+			forwardErr = err
+		}
+	}
+
+	forward := func(srcConn, dstConn net.Conn, srcName, dstName string) {
+		buf := mempool.Get(bufSize)
+		defer mempool.Put(buf)
+
+		for {
+			select {
+			case <-ctx.Done():
+				setForwardErr(ctx.Err())
+				return
+			default:
+				break
+			}
+
+			if timeout != 0 {
+				deadline := time.Now().Add(timeout)
+				_ = srcConn.SetDeadline(deadline)
+				_ = dstConn.SetDeadline(deadline)
+			}
+
+			n, err := srcConn.Read(buf)
+			if n > 0 {
+				_, werr := WriteAll(dstConn, buf[:n])
+				if werr != nil {
+					setForwardErr(fmt.Errorf("%v.Write, %v", dstName, werr))
+					return
+				}
+			}
+			if err != nil {
+				setForwardErr(fmt.Errorf("%v.Read, %v", srcName, err))
+				return
+			}
+		}
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		forward(c2, c1, name2, name1)
+		done <- struct{}{}
+	}()
+	go func() {
+		forward(c1, c2, name1, name2)
+		done <- struct{}{}
+	}()
+
+	finished := 0
+	select {
+	case <-done:
+		finished++
+	case <-ctx.Done():
+		setForwardErr(ctx.Err())
+	}
+
+	// 中断另一方向的读写
+	now := time.Now()
+	_ = c1.SetDeadline(now)
+	_ = c2.SetDeadline(now)
+
+	for ; finished < 2; finished++ {
+		<-done
+	}
+
+	forwardM.Lock()
+	defer forwardM.Unlock()
+	return forwardErr
+}
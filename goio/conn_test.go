@@ -0,0 +1,76 @@
+package goio
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPrefixConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go func() {
+		_, _ = c2.Write([]byte("world"))
+	}()
+
+	c := NewPrefixConn(c1, []byte("hello "))
+
+	buf := make([]byte, 11)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf) != "hello world" {
+		t.Fatalf("buf = %q", buf)
+	}
+}
+
+func TestForward(t *testing.T) {
+	t.Run("config", func(t *testing.T) {
+		testForward(t, 32*1024, time.Minute)
+	})
+	// 零值配置使用默认缓冲区尺寸，不设置超时
+	t.Run("zero", func(t *testing.T) {
+		testForward(t, 0, 0)
+	})
+}
+
+func testForward(t *testing.T, bufSize int, timeout time.Duration) {
+	client, clientServer := net.Pipe()
+	siteServer, site := net.Pipe()
+	defer client.Close()
+	defer site.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- Forward(context.Background(), clientServer, siteServer, "clientConn", "siteConn", bufSize, timeout)
+	}()
+
+	go func() {
+		_, _ = client.Write([]byte("ping"))
+	}()
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(site, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("buf = %q", buf)
+	}
+
+	// 一端关闭后，Forward 需要返回
+	_ = site.Close()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("err == nil")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
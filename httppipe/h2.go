@@ -0,0 +1,104 @@
+package httppipe
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/gamexg/proxylib/mempool"
+	"golang.org/x/net/http2"
+)
+
+// 在 c 上处理 http2 请求
+// c 通常是 ALPN 协商出 h2 的 tls 连接，每个流的请求交由 rt 处理。
+// 到网站使用的协议由 rt 决定，例如网站不支持 http2 时可以改用 http/1.1 转发。
+// 客户端关闭连接或 ctx 结束时返回
+func ServeConnH2(ctx context.Context, c net.Conn, rt http.RoundTripper, conf *ServeConfig) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		<-ctx.Done()
+		_ = c.Close()
+	}()
+
+	srv := http2.Server{
+		IdleTimeout: conf.IdleTimeout,
+	}
+
+	srv.ServeConn(c, &http2.ServeConnOpts{
+		Context: ctx,
+		Handler: &h2Handler{rt: rt, conf: conf},
+	})
+
+	return nil
+}
+
+type h2Handler struct {
+	rt   http.RoundTripper
+	conf *ServeConfig
+}
+
+func (h *h2Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// 不支持 RFC 8441 的 websocket，客户端会改用 http/1.1 连接
+	if r.Method == http.MethodConnect {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := prepareRequest(r.Context(), r.Clone(r.Context()), h.conf)
+	if req.ContentLength == 0 {
+		// 服务端的请求 body 总是非空，不清除的话 Transport 会认为长度未知
+		req.Body = nil
+	}
+
+	resp, err := h.rt.RoundTrip(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	header := w.Header()
+	for k, v := range resp.Header {
+		header[k] = v
+	}
+	// 逐跳头不能出现在 http2 响应中
+	removeHopHeaders(header)
+
+	w.WriteHeader(resp.StatusCode)
+
+	// 边读边发，保证 SSE、grpc 等流式响应及时到达客户端
+	flusher, _ := w.(http.Flusher)
+	buf := mempool.Get(32 * 1024)
+	defer mempool.Put(buf)
+	for {
+		n, rerr := resp.Body.Read(buf)
+		if n > 0 {
+			_, werr := w.Write(buf[:n])
+			if werr != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			// 中断流，让客户端知道响应不完整
+			panic(http.ErrAbortHandler)
+		}
+	}
+
+	for k, v := range resp.Trailer {
+		header[http.TrailerPrefix+k] = v
+	}
+}
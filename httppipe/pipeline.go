@@ -0,0 +1,33 @@
+package httppipe
+
+import (
+	"net/http"
+)
+
+// 管道中的一级
+// 可以在调用 next 前后检查、修改请求及响应，也可以不调用 next 直接返回合成的响应
+type Stage func(next http.RoundTripper) http.RoundTripper
+
+type RoundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// 将多级组合为一级
+// 请求按 stages 的顺序经过各级，响应按相反的顺序返回
+func Chain(stages ...Stage) Stage {
+	return func(next http.RoundTripper) http.RoundTripper {
+		for i := len(stages) - 1; i >= 0; i-- {
+			if stages[i] != nil {
+				next = stages[i](next)
+			}
+		}
+		return next
+	}
+}
+
+// 建立管道，final 是最后一级，负责将请求发往网站
+func New(final http.RoundTripper, stages ...Stage) http.RoundTripper {
+	return Chain(stages...)(final)
+}
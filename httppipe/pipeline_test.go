@@ -0,0 +1,231 @@
+package httppipe
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	order := make([]string, 0)
+
+	stage := func(name string) Stage {
+		return func(next http.RoundTripper) http.RoundTripper {
+			return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				order = append(order, "req "+name)
+				resp, err := next.RoundTrip(req)
+				order = append(order, "resp "+name)
+				return resp, err
+			})
+		}
+	}
+
+	final := RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		order = append(order, "final")
+		return NewResponse(req, 200, nil, ""), nil
+	})
+
+	rt := New(final, stage("a"), Chain(stage("b"), nil, stage("c")))
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	_, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := strings.Join(order, ","); s != "req a,req b,req c,final,resp c,resp b,resp a" {
+		t.Fatal(s)
+	}
+}
+
+func TestStages(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Site", "1")
+		w.Header().Set("X-Req", r.Header.Get("X-Req"))
+		_, _ = w.Write([]byte("hello " + r.URL.Path))
+	}))
+	defer site.Close()
+
+	siteUrl, _ := url.Parse(site.URL)
+
+	rt := New(NewTransport(nil, nil),
+		SetRequestHeader("X-Req", "abc"),
+		RewriteURL(func(u *url.URL) *url.URL {
+			if u.Host != "example.com" {
+				return nil
+			}
+			n := *u
+			n.Host = siteUrl.Host
+			return &n
+		}),
+		Respond(func(req *http.Request) *http.Response {
+			if req.URL.Path != "/blocked" {
+				return nil
+			}
+			return NewResponse(req, http.StatusForbidden, nil, "blocked")
+		}),
+		DelResponseHeader("X-Site"),
+		ReplaceResponseBody(func(resp *http.Response, body io.Reader) io.Reader {
+			// 流式替换
+			pr, pw := io.Pipe()
+			go func() {
+				b, err := ioutil.ReadAll(body)
+				if err != nil {
+					_ = pw.CloseWithError(err)
+					return
+				}
+				_, _ = pw.Write([]byte(strings.ToUpper(string(b))))
+				_ = pw.Close()
+			}()
+			return pr
+		}),
+	)
+
+	req, _ := http.NewRequest("GET", "http://example.com/path", nil)
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if string(body) != "HELLO /PATH" ||
+		resp.Header.Get("X-Site") != "" ||
+		resp.Header.Get("X-Req") != "abc" ||
+		resp.ContentLength != -1 {
+		t.Fatalf("resp = %#v, body = %q", resp, body)
+	}
+
+	req, _ = http.NewRequest("GET", "http://example.com/blocked", nil)
+	resp, err = rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	// Respond 之后的各级不会处理合成的响应
+	if resp.StatusCode != http.StatusForbidden || string(body) != "blocked" {
+		t.Fatalf("resp = %#v, body = %q", resp, body)
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	rt := RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		b, _ := ioutil.ReadAll(req.Body)
+		return NewResponse(req, 200, nil, req.URL.String()+" "+string(b)), nil
+	})
+
+	go func() {
+		_ = ServeConn(context.Background(), server, nil, nil, rt, &ServeConfig{
+			Scheme: "https",
+			Host:   "example.com:443",
+		})
+	}()
+
+	br := bufio.NewReader(client)
+	for _, body := range []string{"a", "bb"} {
+		req, _ := http.NewRequest("POST", "https://example.com/x", strings.NewReader(body))
+		go func() {
+			_ = req.Write(client)
+		}()
+
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		if string(b) != "https://example.com/x "+body {
+			t.Fatalf("body = %q", b)
+		}
+	}
+}
+
+func TestPrepareRequest(t *testing.T) {
+	conf := &ServeConfig{Scheme: "http"}
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Connection", "keep-alive, X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Te", "trailers, deflate")
+	req.Header.Set("Upgrade", "h2c")
+	req.Header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz")
+	req.Header.Set("X-Keep", "1")
+
+	req = prepareRequest(context.Background(), req, conf)
+	if len(req.Header) != 2 || req.Header.Get("X-Keep") != "1" || req.Header.Get("Te") != "trailers" {
+		t.Fatalf("header = %v", req.Header)
+	}
+
+	// websocket 握手保留升级相关的头
+	req, _ = http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+	req = prepareRequest(context.Background(), req, conf)
+	if req.Header.Get("Connection") != "Upgrade" || req.Header.Get("Upgrade") != "websocket" ||
+		req.Header.Get("Sec-WebSocket-Key") != "dGhlIHNhbXBsZSBub25jZQ==" {
+		t.Fatalf("header = %v", req.Header)
+	}
+}
+
+// 网站使用 http/2 时，返回给客户端的仍然是 http/1.1 响应
+func TestServeConn_H2Upstream(t *testing.T) {
+	site := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Proto)
+	}))
+	site.EnableHTTP2 = true
+	site.StartTLS()
+	defer site.Close()
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	siteUrl, _ := url.Parse(site.URL)
+	go func() {
+		_ = ServeConn(context.Background(), server, nil, nil, site.Client().Transport, &ServeConfig{
+			Scheme: "https",
+			Host:   siteUrl.Host,
+		})
+	}()
+
+	req, _ := http.NewRequest("GET", site.URL+"/", nil)
+	go func() {
+		_ = req.Write(client)
+	}()
+
+	br := bufio.NewReader(client)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasPrefix(line, "HTTP/1.1 200 ") == false {
+		t.Fatalf("status line = %q", line)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(io.MultiReader(strings.NewReader(line), br)), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	// 确认到网站确实使用了 http/2
+	if string(b) != "HTTP/2.0" {
+		t.Fatalf("body = %q", b)
+	}
+}
@@ -0,0 +1,264 @@
+package httppipe
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// 写回响应后最多丢弃的请求 body 尺寸，超出时关闭连接
+const maxDiscardBodySize = 256 * 1024
+
+type ServeConfig struct {
+	// 用于补全非代理格式(path 格式)请求的 url
+	// 例如剥离 tls 后的请求 Scheme 为 https，Host 为隧道的目标地址
+	Scheme string
+	Host   string
+
+	// 等待客户端下一个请求的超时时间
+	IdleTimeout time.Duration
+
+	// websocket 帧检查，握手成功后转发的每个帧都会回调，为空则不解析帧
+	// fromClient 表示帧的方向，回调不能阻塞，也不能保留 frame.Payload 之外的引用
+	WebSocketFrameHook func(req *http.Request, fromClient bool, frame *WebSocketFrame)
+	// 帧检查时每个帧最多保留的 payload 尺寸，0 表示 64K
+	WebSocketMaxPayload int
+}
+
+// 逐跳(hop-by-hop)头，只对客户端与代理之间的连接有效，不能转发
+// 同 net/http/httputil.ReverseProxy
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// 删除逐跳头，包括 Connection 中列出的头
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, k := range strings.Split(v, ",") {
+			if k = textproto.TrimString(k); len(k) != 0 {
+				h.Del(k)
+			}
+		}
+	}
+
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+// 在 c 上处理 http/1 请求
+// 每个请求交由 rt 处理，并将响应写回 c。
+// br 为空时新建，req 是已经从 br 读取的第一个请求，为空时从 br 读取。
+// 请求可以是代理格式(GET http://host/ HTTP/1.1)，也可以是普通格式。
+// websocket 握手请求同样经过 rt，网站返回 101 后改为双向转发，ServeConn 在转发结束后返回。
+func ServeConn(ctx context.Context, c net.Conn, br *bufio.Reader, req *http.Request, rt http.RoundTripper, conf *ServeConfig) error {
+	if br == nil {
+		br = bufio.NewReader(c)
+	}
+	bw := bufio.NewWriter(c)
+
+	for {
+		if req == nil {
+			if conf.IdleTimeout != 0 {
+				_ = c.SetReadDeadline(time.Now().Add(conf.IdleTimeout))
+			}
+
+			var err error
+			req, err = http.ReadRequest(br)
+			if err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return fmt.Errorf("http.ReadRequest, %v", err)
+			}
+
+			_ = c.SetReadDeadline(time.Time{})
+		}
+
+		keepAlive, err := serveRequest(ctx, c, br, bw, req, rt, conf)
+		if err != nil || keepAlive == false {
+			return err
+		}
+
+		req = nil
+	}
+}
+
+// 处理一个请求，返回是否可以继续处理下一个请求
+func serveRequest(ctx context.Context, c net.Conn, br *bufio.Reader, bw *bufio.Writer, req *http.Request, rt http.RoundTripper, conf *ServeConfig) (bool, error) {
+	if req.Method == http.MethodConnect {
+		_ = writeErrorResponse(bw, req, http.StatusMethodNotAllowed)
+		return false, fmt.Errorf("unexpected method %v", req.Method)
+	}
+
+	req = prepareRequest(ctx, req, conf)
+
+	// RoundTripper 可能不读取或未读完请求 body 就关闭，
+	// 这里阻止关闭，写回响应后读完剩余部分，保证下一个请求能够被正确读取
+	reqBody := req.Body
+	if reqBody != nil && reqBody != http.NoBody {
+		req.Body = ioutil.NopCloser(reqBody)
+	}
+
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		_ = writeErrorResponse(bw, req, http.StatusBadGateway)
+		return false, fmt.Errorf("RoundTrip %v, %v", req.URL, err)
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return false, serveUpgrade(ctx, c, br, bw, req, resp, conf)
+	}
+
+	err = writeResponse(bw, req, resp)
+	if err != nil {
+		return false, fmt.Errorf("writeResponse, %v", err)
+	}
+
+	if req.Close || resp.Close {
+		return false, nil
+	}
+
+	if reqBody != nil && reqBody != http.NoBody {
+		n, err := io.Copy(ioutil.Discard, io.LimitReader(reqBody, maxDiscardBodySize+1))
+		if err != nil || n > maxDiscardBodySize {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// 将客户端发来的请求转换为发往网站的请求
+func prepareRequest(ctx context.Context, req *http.Request, conf *ServeConfig) *http.Request {
+	if req.URL.IsAbs() == false {
+		req.URL.Scheme = conf.Scheme
+		req.URL.Host = req.Host
+		if len(req.URL.Host) == 0 {
+			req.URL.Host = conf.Host
+		}
+	}
+	if len(req.URL.Scheme) == 0 {
+		req.URL.Scheme = "http"
+	}
+
+	req.RequestURI = ""
+
+	upgrade := ""
+	if isWebSocketUpgrade(req.Header) {
+		upgrade = req.Header.Get("Upgrade")
+	}
+	trailers := headerContainsToken(req.Header, "Te", "trailers")
+
+	removeHopHeaders(req.Header)
+
+	// websocket 握手需要保留升级相关的头
+	if len(upgrade) != 0 {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", upgrade)
+	}
+	if trailers {
+		req.Header.Set("Te", "trailers")
+	}
+
+	return req.WithContext(ctx)
+}
+
+// 处理协议升级
+// 目前只支持 websocket，Transport 在 101 响应时返回可写的 body，即到网站的连接
+func serveUpgrade(ctx context.Context, c net.Conn, br *bufio.Reader, bw *bufio.Writer, req *http.Request, resp *http.Response, conf *ServeConfig) error {
+	siteConn, ok := resp.Body.(io.ReadWriteCloser)
+	if ok == false || isWebSocketUpgrade(req.Header) == false || isWebSocketUpgrade(resp.Header) == false {
+		_ = resp.Body.Close()
+		_ = writeErrorResponse(bw, req, http.StatusBadGateway)
+		return fmt.Errorf("unsupported upgrade %v", resp.Header.Get("Upgrade"))
+	}
+
+	err := writeSwitchingProtocols(bw, resp)
+	if err != nil {
+		_ = siteConn.Close()
+		return fmt.Errorf("writeSwitchingProtocols, %v", err)
+	}
+
+	return relayWebSocket(ctx, c, br, siteConn, req, conf)
+}
+
+func writeResponse(bw *bufio.Writer, req *http.Request, resp *http.Response) error {
+	defer resp.Body.Close()
+
+	// Transport 会解开 chunked 编码，长度未知时重新使用 chunked 编码，
+	// 否则 resp.Write 会改为 Connection: close
+	if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 &&
+		req.ProtoAtLeast(1, 1) && bodyAllowed(req, resp) {
+		resp.TransferEncoding = []string{"chunked"}
+	}
+
+	if req.ProtoAtLeast(1, 1) == false {
+		resp.Close = true
+	}
+
+	removeHopHeaders(resp.Header)
+
+	// 网站可能使用 http/2，resp.Write 会按 resp.Proto 输出状态行，这里总是 http/1.1
+	resp.Proto = "HTTP/1.1"
+	resp.ProtoMajor = 1
+	resp.ProtoMinor = 1
+
+	err := resp.Write(bw)
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+func bodyAllowed(req *http.Request, resp *http.Response) bool {
+	if req.Method == http.MethodHead {
+		return false
+	}
+
+	switch {
+	case resp.StatusCode >= 100 && resp.StatusCode <= 199:
+		return false
+	case resp.StatusCode == http.StatusNoContent:
+		return false
+	case resp.StatusCode == http.StatusNotModified:
+		return false
+	}
+
+	return true
+}
+
+func writeErrorResponse(bw *bufio.Writer, req *http.Request, code int) error {
+	resp := http.Response{
+		StatusCode:    code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        make(http.Header),
+		Close:         true,
+		ContentLength: 0,
+	}
+
+	err := resp.Write(bw)
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,192 @@
+package httppipe
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// 检查、修改请求
+// f 返回错误时请求不会被发出
+func OnRequest(f func(req *http.Request) (*http.Request, error)) Stage {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req, err := f(req)
+			if err != nil {
+				closeRequestBody(req)
+				return nil, err
+			}
+
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// 检查、修改响应
+func OnResponse(f func(resp *http.Response) (*http.Response, error)) Stage {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			resp, err := next.RoundTrip(req)
+			if err != nil {
+				return nil, err
+			}
+
+			newResp, err := f(resp)
+			if err != nil {
+				_ = resp.Body.Close()
+				return nil, err
+			}
+
+			return newResp, nil
+		})
+	}
+}
+
+func SetRequestHeader(key, value string) Stage {
+	return OnRequest(func(req *http.Request) (*http.Request, error) {
+		req.Header.Set(key, value)
+		return req, nil
+	})
+}
+
+func DelRequestHeader(key string) Stage {
+	return OnRequest(func(req *http.Request) (*http.Request, error) {
+		req.Header.Del(key)
+		return req, nil
+	})
+}
+
+func SetResponseHeader(key, value string) Stage {
+	return OnResponse(func(resp *http.Response) (*http.Response, error) {
+		resp.Header.Set(key, value)
+		return resp, nil
+	})
+}
+
+func DelResponseHeader(key string) Stage {
+	return OnResponse(func(resp *http.Response) (*http.Response, error) {
+		resp.Header.Del(key)
+		return resp, nil
+	})
+}
+
+// 改写请求的 url，请求会被发往新的 url，客户端不会察觉
+// f 返回 nil 表示不修改
+func RewriteURL(f func(u *url.URL) *url.URL) Stage {
+	return OnRequest(func(req *http.Request) (*http.Request, error) {
+		u := f(req.URL)
+		if u == nil {
+			return req, nil
+		}
+
+		if u.Host != req.URL.Host {
+			req.Host = u.Host
+		}
+		req.URL = u
+
+		return req, nil
+	})
+}
+
+// 直接返回合成的响应，不再将请求发往网站
+// f 返回 nil 表示不处理，请求继续交由下一级
+func Respond(f func(req *http.Request) *http.Response) Stage {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			resp := f(req)
+			if resp == nil {
+				return next.RoundTrip(req)
+			}
+
+			closeRequestBody(req)
+			return resp, nil
+		})
+	}
+}
+
+// 替换请求 body
+// f 返回新的 body，会以流的方式发出，f 可以包装原 body 实现边读边改
+func ReplaceRequestBody(f func(req *http.Request, body io.Reader) io.Reader) Stage {
+	return OnRequest(func(req *http.Request) (*http.Request, error) {
+		body := req.Body
+		if body == nil {
+			body = http.NoBody
+		}
+
+		req.Body = &replacedBody{
+			Reader: f(req, body),
+			closer: body,
+		}
+		req.ContentLength = -1
+		req.Header.Del("Content-Length")
+
+		return req, nil
+	})
+}
+
+// 替换响应 body
+// f 返回新的 body，会以流的方式返回给客户端，f 可以包装原 body 实现边读边改。
+// 注意 body 可能是压缩过的，需要检查 Content-Encoding。
+// 101 响应的 body 是升级后的连接，不会被替换
+func ReplaceResponseBody(f func(resp *http.Response, body io.Reader) io.Reader) Stage {
+	return OnResponse(func(resp *http.Response) (*http.Response, error) {
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, nil
+		}
+
+		resp.Body = &replacedBody{
+			Reader: f(resp, resp.Body),
+			closer: resp.Body,
+		}
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+
+		return resp, nil
+	})
+}
+
+type replacedBody struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (b *replacedBody) Close() error {
+	var err error
+	if c, ok := b.Reader.(io.Closer); ok {
+		err = c.Close()
+	}
+
+	if cerr := b.closer.Close(); cerr != nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// 生成合成的响应
+func NewResponse(req *http.Request, code int, header http.Header, body string) *http.Response {
+	if header == nil {
+		header = make(http.Header)
+	}
+
+	return &http.Response{
+		Status:        strconv.Itoa(code) + " " + http.StatusText(code),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+func closeRequestBody(req *http.Request) {
+	if req != nil && req.Body != nil {
+		_ = req.Body.Close()
+	}
+}
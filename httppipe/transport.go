@@ -0,0 +1,33 @@
+package httppipe
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+)
+
+// 管道的最后一级，将请求发往网站
+// dial 是建立到网站 tcp 连接使用的函数，例如 httpproxy.Dialer.DialContext 或 socks5.ServerConfig.SiteTcpDialContext，
+// 为空则使用 net.Dialer。https 请求会在 dial 建立的连接上完成 tls 握手并验证证书。
+// tlsConf 为空则使用默认配置
+func NewTransport(dial func(ctx context.Context, network, address string) (net.Conn, error), tlsConf *tls.Config) *http.Transport {
+	if dial == nil {
+		d := net.Dialer{}
+		dial = d.DialContext
+	}
+
+	return &http.Transport{
+		// 代理不再使用环境变量中的代理
+		Proxy:                 nil,
+		DialContext:           dial,
+		TLSClientConfig:       tlsConf,
+		TLSHandshakeTimeout:   10 * time.Second,
+		MaxIdleConnsPerHost:   4,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		// 客户端请求的压缩格式原样转发，不由 Transport 自动解压
+		DisableCompression: true,
+	}
+}
@@ -0,0 +1,289 @@
+package httppipe
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 帧检查时默认保留的最大 payload 尺寸
+const defaultWebSocketMaxPayload = 64 * 1024
+
+const (
+	WebSocketOpContinuation = 0x0
+	WebSocketOpText         = 0x1
+	WebSocketOpBinary       = 0x2
+	WebSocketOpClose        = 0x8
+	WebSocketOpPing         = 0x9
+	WebSocketOpPong         = 0xA
+)
+
+// websocket 帧，仅用于检查，修改不会影响转发的数据
+type WebSocketFrame struct {
+	Fin    bool
+	Rsv    byte
+	Opcode byte
+	Masked bool
+
+	// payload 的实际长度
+	PayloadLen int64
+	// 已经去掉掩码的 payload，超过 WebSocketMaxPayload 的部分被丢弃
+	// 启用了 permessage-deflate 扩展时(Rsv&4!=0)是压缩后的数据
+	Payload []byte
+}
+
+// 是否是 websocket 握手请求
+func isWebSocketUpgrade(h http.Header) bool {
+	return headerContainsToken(h, "Connection", "upgrade") &&
+		headerContainsToken(h, "Upgrade", "websocket")
+}
+
+func headerContainsToken(h http.Header, key, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(key)] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 写回 101 响应
+// resp.Write 会尝试写 body，这里只写响应头
+func writeSwitchingProtocols(bw *bufio.Writer, resp *http.Response) error {
+	_, err := fmt.Fprintf(bw, "HTTP/1.1 %03d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	if err != nil {
+		return err
+	}
+
+	err = resp.Header.Write(bw)
+	if err != nil {
+		return err
+	}
+
+	_, err = bw.WriteString("\r\n")
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// websocket 握手成功后在客户端连接及网站连接间双向转发
+// br 中可能还有客户端已经发来的数据
+func relayWebSocket(ctx context.Context, c net.Conn, br *bufio.Reader, siteConn io.ReadWriteCloser, req *http.Request, conf *ServeConfig) error {
+	defer siteConn.Close()
+
+	_ = c.SetDeadline(time.Time{})
+
+	var clientReader io.Reader = br
+	var siteReader io.Reader = siteConn
+	if conf.WebSocketFrameHook != nil {
+		maxPayload := conf.WebSocketMaxPayload
+		if maxPayload <= 0 {
+			maxPayload = defaultWebSocketMaxPayload
+		}
+
+		clientReader = io.TeeReader(clientReader, newWebSocketFrameParser(maxPayload, func(frame *WebSocketFrame) {
+			conf.WebSocketFrameHook(req, true, frame)
+		}))
+		siteReader = io.TeeReader(siteReader, newWebSocketFrameParser(maxPayload, func(frame *WebSocketFrame) {
+			conf.WebSocketFrameHook(req, false, frame)
+		}))
+	}
+
+	errChan := make(chan error, 2)
+	var closeOnce sync.Once
+	closeAll := func() {
+		closeOnce.Do(func() {
+			_ = c.SetDeadline(time.Now())
+			_ = siteConn.Close()
+		})
+	}
+
+	go func() {
+		_, err := io.Copy(siteConn, clientReader)
+		if err != nil {
+			err = fmt.Errorf("clientConn -> siteConn, %v", err)
+		}
+		errChan <- err
+		closeAll()
+	}()
+
+	go func() {
+		_, err := io.Copy(c, siteReader)
+		if err != nil {
+			err = fmt.Errorf("siteConn -> clientConn, %v", err)
+		}
+		errChan <- err
+		closeAll()
+	}()
+
+	var err error
+	finished := 0
+	select {
+	case err = <-errChan:
+		finished++
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	closeAll()
+
+	// 等待另一个方向结束，其错误是被主动关闭引起的，忽略
+	for ; finished < 2; finished++ {
+		<-errChan
+	}
+
+	return err
+}
+
+// 被动的 websocket 帧解析器
+// 以 io.Writer 的方式接收转发的数据，解析出完整的帧后回调 onFrame。
+// 数据不符合 websocket 协议时停止解析，不影响转发。
+type webSocketFrameParser struct {
+	maxPayload int
+	onFrame    func(frame *WebSocketFrame)
+
+	// 未完成的帧头
+	header []byte
+	// 当前帧，nil 表示正在读取帧头
+	frame   *WebSocketFrame
+	maskKey [4]byte
+	// 当前帧已读取的 payload 尺寸
+	read   int64
+	broken bool
+}
+
+func newWebSocketFrameParser(maxPayload int, onFrame func(frame *WebSocketFrame)) *webSocketFrameParser {
+	return &webSocketFrameParser{
+		maxPayload: maxPayload,
+		onFrame:    onFrame,
+		header:     make([]byte, 0, 14),
+	}
+}
+
+func (p *webSocketFrameParser) Write(b []byte) (int, error) {
+	n := len(b)
+
+	for len(b) > 0 && p.broken == false {
+		if p.frame == nil {
+			b = p.readHeader(b)
+			continue
+		}
+
+		remain := p.frame.PayloadLen - p.read
+		chunk := b
+		if int64(len(chunk)) > remain {
+			chunk = chunk[:remain]
+		}
+		b = b[len(chunk):]
+
+		keep := int64(p.maxPayload) - int64(len(p.frame.Payload))
+		if keep > int64(len(chunk)) {
+			keep = int64(len(chunk))
+		}
+		for i := int64(0); i < keep; i++ {
+			v := chunk[i]
+			if p.frame.Masked {
+				v ^= p.maskKey[(p.read+i)%4]
+			}
+			p.frame.Payload = append(p.frame.Payload, v)
+		}
+		p.read += int64(len(chunk))
+
+		if p.read == p.frame.PayloadLen {
+			p.finishFrame()
+		}
+	}
+
+	// 总是返回成功，不影响转发
+	return n, nil
+}
+
+// 读取帧头，返回剩余的数据
+func (p *webSocketFrameParser) readHeader(b []byte) []byte {
+	for len(b) > 0 {
+		p.header = append(p.header, b[0])
+		b = b[1:]
+
+		if len(p.header) < 2 {
+			continue
+		}
+
+		need := 2
+		switch p.header[1] & 0x7F {
+		case 126:
+			need += 2
+		case 127:
+			need += 8
+		}
+		masked := p.header[1]&0x80 != 0
+		if masked {
+			need += 4
+		}
+
+		if len(p.header) < need {
+			continue
+		}
+
+		frame := &WebSocketFrame{
+			Fin:    p.header[0]&0x80 != 0,
+			Rsv:    (p.header[0] >> 4) & 0x7,
+			Opcode: p.header[0] & 0x0F,
+			Masked: masked,
+		}
+
+		pos := 2
+		switch p.header[1] & 0x7F {
+		case 126:
+			frame.PayloadLen = int64(binary.BigEndian.Uint16(p.header[2:4]))
+			pos += 2
+		case 127:
+			l := binary.BigEndian.Uint64(p.header[2:10])
+			if l > 1<<63-1 {
+				p.broken = true
+				return nil
+			}
+			frame.PayloadLen = int64(l)
+			pos += 8
+		default:
+			frame.PayloadLen = int64(p.header[1] & 0x7F)
+		}
+
+		if masked {
+			copy(p.maskKey[:], p.header[pos:pos+4])
+		}
+
+		payloadCap := frame.PayloadLen
+		if payloadCap > int64(p.maxPayload) {
+			payloadCap = int64(p.maxPayload)
+		}
+		frame.Payload = make([]byte, 0, payloadCap)
+
+		p.frame = frame
+		p.read = 0
+		p.header = p.header[:0]
+
+		if frame.PayloadLen == 0 {
+			p.finishFrame()
+		}
+
+		return b
+	}
+
+	return b
+}
+
+func (p *webSocketFrameParser) finishFrame() {
+	frame := p.frame
+	p.frame = nil
+	p.onFrame(frame)
+}
@@ -0,0 +1,176 @@
+package httppipe
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 生成 websocket 帧，key 不为空时添加掩码
+func testWebSocketFrame(opcode byte, payload []byte, key []byte) []byte {
+	buf := bytes.Buffer{}
+	buf.WriteByte(0x80 | opcode)
+
+	maskBit := byte(0)
+	if key != nil {
+		maskBit = 0x80
+	}
+
+	switch {
+	case len(payload) < 126:
+		buf.WriteByte(maskBit | byte(len(payload)))
+	case len(payload) < 65536:
+		buf.WriteByte(maskBit | 126)
+		buf.WriteByte(byte(len(payload) >> 8))
+		buf.WriteByte(byte(len(payload)))
+	default:
+		panic("payload too large")
+	}
+
+	if key == nil {
+		buf.Write(payload)
+		return buf.Bytes()
+	}
+
+	buf.Write(key)
+	for i, v := range payload {
+		buf.WriteByte(v ^ key[i%4])
+	}
+	return buf.Bytes()
+}
+
+func TestWebSocketFrameParser(t *testing.T) {
+	frames := make([]*WebSocketFrame, 0)
+	p := newWebSocketFrameParser(100, func(frame *WebSocketFrame) {
+		frames = append(frames, frame)
+	})
+
+	long := bytes.Repeat([]byte("a"), 300)
+	data := append(testWebSocketFrame(WebSocketOpBinary, long, nil),
+		testWebSocketFrame(WebSocketOpText, []byte("hello"), []byte{1, 2, 3, 4})...)
+	data = append(data, testWebSocketFrame(WebSocketOpPing, nil, nil)...)
+
+	// 逐字节写入，检查跨 Write 的帧头及 payload
+	for i := range data {
+		_, _ = p.Write(data[i : i+1])
+	}
+
+	if len(frames) != 3 {
+		t.Fatalf("len(frames) = %v", len(frames))
+	}
+
+	if frames[0].Opcode != WebSocketOpBinary || frames[0].PayloadLen != 300 || len(frames[0].Payload) != 100 {
+		t.Fatalf("frames[0] = %#v", frames[0])
+	}
+	if frames[1].Opcode != WebSocketOpText || frames[1].Masked == false || string(frames[1].Payload) != "hello" {
+		t.Fatalf("frames[1] = %#v", frames[1])
+	}
+	if frames[2].Opcode != WebSocketOpPing || frames[2].PayloadLen != 0 || frames[2].Fin == false {
+		t.Fatalf("frames[2] = %#v", frames[2])
+	}
+}
+
+func TestServeConn_WebSocket(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isWebSocketUpgrade(r.Header) == false {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		c, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+
+		_, _ = c.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n\r\n"))
+
+		// 原样回显
+		_, _ = io.Copy(c, brw)
+	}))
+	defer site.Close()
+
+	type hookFrame struct {
+		fromClient bool
+		frame      *WebSocketFrame
+	}
+	hookChan := make(chan hookFrame, 10)
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rt := New(NewTransport(nil, nil), SetResponseHeader("X-Pipe", "1"))
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- ServeConn(ctx, server, nil, nil, rt, &ServeConfig{
+			Scheme: "http",
+			WebSocketFrameHook: func(req *http.Request, fromClient bool, frame *WebSocketFrame) {
+				hookChan <- hookFrame{fromClient, frame}
+			},
+		})
+	}()
+
+	frame := testWebSocketFrame(WebSocketOpText, []byte("hello"), []byte{1, 2, 3, 4})
+
+	// 握手请求及第一个帧一起发出，检查已读入 bufio.Reader 的数据能被转发
+	go func() {
+		_, _ = client.Write(append([]byte("GET "+site.URL+"/ws HTTP/1.1\r\n"+
+			"Host: "+strings.TrimPrefix(site.URL, "http://")+"\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+			"Sec-WebSocket-Version: 13\r\n\r\n"), frame...))
+	}()
+
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(client)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("X-Pipe") != "1" {
+		t.Fatalf("resp = %#v", resp)
+	}
+
+	echo := make([]byte, len(frame))
+	_, err = io.ReadFull(br, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(echo, frame) == false {
+		t.Fatalf("echo = %v", echo)
+	}
+
+	for _, fromClient := range []bool{true, false} {
+		select {
+		case f := <-hookChan:
+			if f.fromClient != fromClient || string(f.frame.Payload) != "hello" {
+				t.Fatalf("hook frame = %#v", f)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("hook timeout")
+		}
+	}
+
+	_ = client.Close()
+	select {
+	case <-serveErr:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeConn not returned")
+	}
+}
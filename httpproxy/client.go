@@ -0,0 +1,277 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gamexg/proxylib/goio"
+)
+
+// 读取 CONNECT 回应头的最大尺寸
+const maxResponseHeadSize = 64 * 1024
+
+type ClientConfig struct {
+	// http 代理服务器地址，格式 host:port
+	ProxyAddr string
+
+	// 到代理服务器的连接是否使用 tls，即 https 代理
+	ProxyTls bool
+	// ProxyTls 为 true 时使用的 tls 配置
+	// 为空时使用默认配置，ServerName 为空时使用 ProxyAddr 的 host 部分
+	ProxyTlsConfig *tls.Config
+
+	// 代理服务器用户名、密码
+	// 都为空则表示不使用 Basic 鉴定
+	AuthUsername string
+	AuthPassword string
+
+	// CONNECT 请求附加的请求头
+	Header http.Header
+
+	// 向代理服务器建立 tcp 连接使用的函数
+	// 为空则使用 net.Dialer
+	ProxyTcpDialContext func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// 握手超时，包含 tls 握手及 CONNECT 请求
+	// 为 0 表示只使用 ctx 的超时
+	ShakeHandsTimeout time.Duration
+}
+
+// 使用到 http 代理服务器的连接建立隧道
+// 回应头使用 bufio 读取，可能多读取到隧道内的数据，
+// 返回成功后需要使用返回的连接，它会先返回多读取的数据，再从 proxyConn 读取。
+func ClientTcpConn(ctx context.Context, conf *ClientConfig,
+	proxyConn net.Conn, network string, addr string) (net.Conn, error) {
+
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unexpected network %v", network)
+	}
+
+	if len(addr) == 0 {
+		return nil, fmt.Errorf("addr cannot be empty")
+	}
+
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("addr is incorrect, %v", err)
+	}
+
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Host:       addr,
+		Header:     make(http.Header),
+	}
+	req = req.WithContext(ctx)
+
+	for k, v := range conf.Header {
+		req.Header[k] = append([]string(nil), v...)
+	}
+
+	if len(conf.AuthUsername) != 0 || len(conf.AuthPassword) != 0 {
+		auth := conf.AuthUsername + ":" + conf.AuthPassword
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+
+	err := writeConnectRequest(proxyConn, req)
+	if err != nil {
+		return nil, fmt.Errorf("writeConnectRequest, %v", err)
+	}
+
+	br := bufio.NewReader(proxyConn)
+	head, err := readResponseHead(br)
+	if err != nil {
+		return nil, fmt.Errorf("readResponseHead, %v", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), req)
+	if err != nil {
+		return nil, fmt.Errorf("http.ReadResponse, %v", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("the proxy failed to connect to %v, status = %v", addr, resp.Status)
+	}
+
+	// 交出 br 中多读取的隧道数据
+	if n := br.Buffered(); n != 0 {
+		prefix, _ := br.Peek(n)
+		return goio.NewPrefixConn(proxyConn, append([]byte(nil), prefix...)), nil
+	}
+
+	return proxyConn, nil
+}
+
+// 标准库 req.Write 对 CONNECT 请求会写出 Host 头及 User-Agent 等，
+// 这里手动生成，保证请求行为 authority 格式。
+func writeConnectRequest(w io.Writer, req *http.Request) error {
+	buf := bytes.Buffer{}
+
+	fmt.Fprintf(&buf, "CONNECT %v HTTP/1.1\r\n", req.Host)
+	fmt.Fprintf(&buf, "Host: %v\r\n", req.Host)
+
+	err := req.Header.Write(&buf)
+	if err != nil {
+		return err
+	}
+
+	buf.WriteString("\r\n")
+
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// 按行读取回应头，直到空行
+// 空行之后的数据留在 br 中
+func readResponseHead(br *bufio.Reader) ([]byte, error) {
+	head := make([]byte, 0, 512)
+	lineStart := true
+
+	for {
+		line, err := br.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+
+		head = append(head, line...)
+		if len(head) > maxResponseHeadSize {
+			return nil, fmt.Errorf("response head is too long")
+		}
+
+		if err == bufio.ErrBufferFull {
+			// 行过长，剩余部分在下次读取
+			lineStart = false
+			continue
+		}
+
+		if lineStart && (string(line) == "\r\n" || string(line) == "\n") {
+			return head, nil
+		}
+		lineStart = true
+	}
+}
+
+// http 代理 Dialer
+// 实现了和 socks5.ServerConfig.SiteTcpDialContext 相同的 DialContext 签名
+type Dialer struct {
+	conf *ClientConfig
+}
+
+func NewDialer(conf *ClientConfig) (*Dialer, error) {
+	if conf == nil {
+		return nil, fmt.Errorf("conf is nil")
+	}
+
+	if _, _, err := net.SplitHostPort(conf.ProxyAddr); err != nil {
+		return nil, fmt.Errorf("ProxyAddr is incorrect, %v", err)
+	}
+
+	return &Dialer{conf: conf}, nil
+}
+
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (c net.Conn, rErr error) {
+	conf := d.conf
+
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unexpected network %v", network)
+	}
+
+	if conf.ShakeHandsTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, conf.ShakeHandsTimeout)
+		defer cancel()
+	}
+
+	dial := conf.ProxyTcpDialContext
+	if dial == nil {
+		dialer := net.Dialer{}
+		dial = dialer.DialContext
+	}
+
+	conn, err := dial(ctx, "tcp", conf.ProxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("ProxyTcpDialContext, %v", err)
+	}
+	defer func() {
+		if rErr != nil {
+			_ = conn.Close()
+		}
+	}()
+
+	// ctx 取消时中断握手
+	rawConn := conn
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	stopWatch := func() {
+		select {
+		case <-done:
+		default:
+			close(done)
+		}
+		<-exited
+	}
+	defer stopWatch()
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			_ = rawConn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if conf.ProxyTls {
+		tlsConf := &tls.Config{}
+		if conf.ProxyTlsConfig != nil {
+			tlsConf = conf.ProxyTlsConfig.Clone()
+		}
+		if len(tlsConf.ServerName) == 0 {
+			host, _, _ := net.SplitHostPort(conf.ProxyAddr)
+			tlsConf.ServerName = host
+		}
+
+		tlsConn := tls.Client(conn, tlsConf)
+		err := tlsConn.Handshake()
+		if err != nil {
+			return nil, fmt.Errorf("tls handshake, %v", err)
+		}
+
+		conn = tlsConn
+	}
+
+	tunnelConn, err := ClientTcpConn(ctx, conf, conn, network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn = tunnelConn
+
+	stopWatch()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
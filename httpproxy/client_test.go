@@ -0,0 +1,214 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadResponseHead(t *testing.T) {
+	r := bufio.NewReaderSize(bytes.NewReader([]byte("HTTP/1.1 200 OK\r\nX-Long: "+strings.Repeat("a", 100)+"\r\n\r\ntunnel data")), 16)
+
+	head, err := readResponseHead(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(head) != "HTTP/1.1 200 OK\r\nX-Long: "+strings.Repeat("a", 100)+"\r\n\r\n" {
+		t.Fatalf("head = %q", head)
+	}
+
+	rest, _ := ioutil.ReadAll(r)
+	if string(rest) != "tunnel data" {
+		t.Fatalf("rest = %q", rest)
+	}
+}
+
+func TestClientTcpConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		br := bufio.NewReader(server)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))
+		if req.Method != http.MethodConnect || req.Host != "example.com:443" ||
+			req.Header.Get("Proxy-Authorization") != auth {
+			_, _ = server.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return
+		}
+
+		// 回应和隧道数据一起发出，客户端不能多读
+		_, _ = server.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nhello"))
+	}()
+
+	conf := ClientConfig{
+		AuthUsername: "user",
+		AuthPassword: "pass",
+	}
+
+	conn, err := ClientTcpConn(context.Background(), &conf, client, "tcp", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 和回应头一起读到的隧道数据由返回的连接交出
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("buf = %q", buf)
+	}
+}
+
+func TestClientTcpConn_Refused(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		_, _ = http.ReadRequest(bufio.NewReader(server))
+		_, _ = server.Write([]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"))
+	}()
+
+	_, err := ClientTcpConn(context.Background(), &ClientConfig{}, client, "tcp", "example.com:443")
+	if err == nil || strings.Contains(err.Error(), "403") == false {
+		t.Fatal(err)
+	}
+}
+
+// 测试用 http 代理，只支持 CONNECT
+func newTestProxy(t *testing.T) *httptest.Server {
+	return httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		siteConn, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer siteConn.Close()
+
+		c, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+
+		_, _ = c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+
+		go func() {
+			_, _ = io.Copy(siteConn, c)
+		}()
+		_, _ = io.Copy(c, siteConn)
+	}))
+}
+
+func testEchoServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+
+	return ln
+}
+
+func testDialEcho(t *testing.T, d *Dialer, addr string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err = c.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf) != "ping" {
+		t.Fatalf("buf = %q", buf)
+	}
+}
+
+func TestDialer(t *testing.T) {
+	echo := testEchoServer(t)
+	defer echo.Close()
+
+	proxy := newTestProxy(t)
+	proxy.Start()
+	defer proxy.Close()
+
+	d, err := NewDialer(&ClientConfig{
+		ProxyAddr:         proxy.Listener.Addr().String(),
+		ShakeHandsTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testDialEcho(t, d, echo.Addr().String())
+}
+
+func TestDialer_Tls(t *testing.T) {
+	echo := testEchoServer(t)
+	defer echo.Close()
+
+	proxy := newTestProxy(t)
+	proxy.StartTLS()
+	defer proxy.Close()
+
+	d, err := NewDialer(&ClientConfig{
+		ProxyAddr: proxy.Listener.Addr().String(),
+		ProxyTls:  true,
+		ProxyTlsConfig: &tls.Config{
+			RootCAs: proxy.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testDialEcho(t, d, echo.Addr().String())
+}
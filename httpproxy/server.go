@@ -0,0 +1,316 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gamexg/proxylib/goio"
+	"github.com/gamexg/proxylib/httppipe"
+	"github.com/gamexg/proxylib/tlsinfo"
+)
+
+type ServerConfig struct {
+	// 读取客户端请求头的超时时间
+	ShakeHandsTimeout time.Duration
+
+	ForwardTimeout time.Duration
+	// 默认值 32*1024
+	ForwardBufSize int
+
+	// 向 目标网站 建立 tcp 连接使用的函数
+	SiteTcpDialContext func(ctx context.Context, network, address string) (net.Conn, error)
+	// 连接超时
+	SiteTcpDialContextDialTimeout time.Duration
+
+	// 检查 Basic 鉴定的用户名、密码
+	// 为空则不要求鉴定
+	AuthCheckUserAndPassword func(user, password string) error
+
+	// http 请求处理管道，处理非 CONNECT 的代理请求
+	// 可以使用 httppipe.Chain 组合多级，为空则直接转发
+	HttpPipeline httppipe.Stage
+	// 管道的最后一级，将请求发往网站
+	// 为空则使用 httppipe.NewTransport 通过 SiteTcpDialContext 建立连接
+	HttpTransport http.RoundTripper
+	// 等待客户端下一个 http 请求的超时时间
+	HttpIdleTimeout time.Duration
+	// websocket 帧检查，见 httppipe.ServeConfig.WebSocketFrameHook
+	WebSocketFrameHook func(req *http.Request, fromClient bool, frame *httppipe.WebSocketFrame)
+
+	// tls 握手检查，只用于直接转发的 CONNECT 隧道，见 socks5.ServerConfig.SiteTlsVerify
+	SiteTlsVerify func(ctx context.Context, addr string, hello *tlsinfo.ClientHello, server *tlsinfo.ServerHandshake) error
+	// 最多尝试次数，包含第一次
+	SiteTlsVerifyAttempts int
+	// 读取 ClientHello 及网站回应的超时时间
+	SiteTlsVerifyTimeout time.Duration
+
+	// CONNECT 隧道处理函数
+	// 不为空时，回复 200 后由本函数接管 clientConn，例如交由 mitm.ServeConn 剥离 tls
+	// 为空则建立到 addr 的连接并直接转发
+	ConnectHandler func(ctx context.Context, clientConn net.Conn, addr string) error
+}
+
+func (c *ServerConfig) Default() {
+	dial := net.Dialer{}
+
+	*c = ServerConfig{
+		ShakeHandsTimeout:             10 * time.Second,
+		ForwardTimeout:                2 * 60 * time.Second,
+		ForwardBufSize:                32 * 1024,
+		SiteTcpDialContext:            dial.DialContext,
+		SiteTcpDialContextDialTimeout: 10 * time.Second,
+		AuthCheckUserAndPassword:      nil,
+		HttpPipeline:                  nil,
+		HttpTransport:                 nil,
+		HttpIdleTimeout:               2 * 60 * time.Second,
+		WebSocketFrameHook:            nil,
+		SiteTlsVerify:                 nil,
+		SiteTlsVerifyAttempts:         3,
+		SiteTlsVerifyTimeout:          10 * time.Second,
+		ConnectHandler:                nil,
+	}
+}
+
+// 本函数会负责关闭 c 和新建的连接
+func ServeConn(ctx context.Context, c net.Conn, conf *ServerConfig) error {
+	lCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer c.Close()
+
+	if conf.ShakeHandsTimeout != 0 {
+		_ = c.SetDeadline(time.Now().Add(conf.ShakeHandsTimeout))
+	}
+
+	br := bufio.NewReader(c)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return fmt.Errorf("http.ReadRequest, %v", err)
+	}
+
+	err = serverCheckAuth(req, conf)
+	if err != nil {
+		_ = writeStatus(c, http.StatusProxyAuthRequired, http.Header{
+			"Proxy-Authenticate": []string{`Basic realm="proxy"`},
+		})
+		return err
+	}
+
+	switch req.Method {
+	case http.MethodConnect:
+		// 客户端可能在收到回应前就发出了隧道内的数据
+		var clientConn net.Conn = c
+		if n := br.Buffered(); n != 0 {
+			prefix, _ := br.Peek(n)
+			clientConn = goio.NewPrefixConn(c, prefix)
+		}
+
+		return serverConnConnect(lCtx, clientConn, conf, req.Host)
+
+	default:
+		_ = c.SetDeadline(time.Time{})
+		return serverConnHttp(lCtx, c, br, req, conf)
+	}
+}
+
+// 处理普通 http 代理请求
+// 请求经过 HttpPipeline 后发往网站
+func serverConnHttp(ctx context.Context, c net.Conn, br *bufio.Reader, req *http.Request, conf *ServerConfig) error {
+	if req.URL.IsAbs() == false {
+		_ = writeStatus(c, http.StatusBadRequest, nil)
+		return fmt.Errorf("unexpected request uri %v", req.RequestURI)
+	}
+
+	transport := conf.HttpTransport
+	if transport == nil {
+		t := httppipe.NewTransport(func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialTimeout := conf.SiteTcpDialContextDialTimeout
+			if dialTimeout == 0 {
+				dialTimeout = 60 * time.Second
+			}
+			dialCtx, dialCtxCancel := context.WithTimeout(ctx, dialTimeout)
+			defer dialCtxCancel()
+
+			return conf.SiteTcpDialContext(dialCtx, network, address)
+		}, nil)
+		defer t.CloseIdleConnections()
+
+		transport = t
+	}
+
+	rt := transport
+	if conf.HttpPipeline != nil {
+		rt = conf.HttpPipeline(transport)
+	}
+
+	return httppipe.ServeConn(ctx, c, br, req, rt, &httppipe.ServeConfig{
+		Scheme:             "http",
+		IdleTimeout:        conf.HttpIdleTimeout,
+		WebSocketFrameHook: conf.WebSocketFrameHook,
+	})
+}
+
+func serverCheckAuth(req *http.Request, conf *ServerConfig) error {
+	if conf.AuthCheckUserAndPassword == nil {
+		return nil
+	}
+
+	auth := req.Header.Get("Proxy-Authorization")
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || strings.EqualFold(auth[:len(prefix)], prefix) == false {
+		return fmt.Errorf("proxy authorization required")
+	}
+
+	b, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return fmt.Errorf("base64.DecodeString, %v", err)
+	}
+
+	i := strings.IndexByte(string(b), ':')
+	if i < 0 {
+		return fmt.Errorf("proxy authorization is incorrect")
+	}
+	user, password := string(b[:i]), string(b[i+1:])
+
+	err = conf.AuthCheckUserAndPassword(user, password)
+	if err != nil {
+		return fmt.Errorf("AuthCheckUserAndPassword, %v", err)
+	}
+
+	return nil
+}
+
+func serverConnConnect(ctx context.Context, clientConn net.Conn, conf *ServerConfig, addr string) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		_ = writeStatus(clientConn, http.StatusBadRequest, nil)
+		return fmt.Errorf("addr %v is incorrect, %v", addr, err)
+	}
+
+	if conf.ConnectHandler != nil {
+		err := writeStatus(clientConn, http.StatusOK, nil)
+		if err != nil {
+			return fmt.Errorf("writeStatus, %v", err)
+		}
+		_ = clientConn.SetDeadline(time.Time{})
+
+		return conf.ConnectHandler(ctx, clientConn, addr)
+	}
+
+	dialTimeout := conf.SiteTcpDialContextDialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = 60 * time.Second
+	}
+	dialCtx, dialCtxCancel := context.WithTimeout(ctx, dialTimeout)
+	defer dialCtxCancel()
+
+	siteConn, err := conf.SiteTcpDialContext(dialCtx, "tcp", addr)
+	if err != nil {
+		_ = writeStatus(clientConn, http.StatusBadGateway, nil)
+		return fmt.Errorf("SiteTcpDialContext, %v", err)
+	}
+	defer func() {
+		if siteConn != nil {
+			_ = siteConn.Close()
+		}
+	}()
+
+	err = writeStatus(clientConn, http.StatusOK, nil)
+	if err != nil {
+		return fmt.Errorf("writeStatus, %v", err)
+	}
+	_ = clientConn.SetDeadline(time.Time{})
+
+	if conf.SiteTlsVerify != nil {
+		clientConn, siteConn, err = tlsinfo.RelayHandshake(ctx, clientConn, siteConn, &tlsinfo.RelayConfig{
+			Timeout: conf.SiteTlsVerifyTimeout,
+			Verify: func(hello *tlsinfo.ClientHello, server *tlsinfo.ServerHandshake) error {
+				return conf.SiteTlsVerify(ctx, addr, hello, server)
+			},
+			MaxAttempts: conf.SiteTlsVerifyAttempts,
+			Redial: func(ctx context.Context, attempt int, lastErr error) (net.Conn, error) {
+				dialCtx, dialCtxCancel := context.WithTimeout(tlsinfo.WithDialAttempt(ctx, attempt, lastErr), dialTimeout)
+				defer dialCtxCancel()
+
+				return conf.SiteTcpDialContext(dialCtx, "tcp", addr)
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("RelayHandshake, %v", err)
+		}
+	}
+
+	return goio.Forward(ctx, clientConn, siteConn, "clientConn", "siteConn", conf.ForwardBufSize, conf.ForwardTimeout)
+}
+
+func writeStatus(c net.Conn, code int, header http.Header) error {
+	buf := strings.Builder{}
+
+	fmt.Fprintf(&buf, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	if code != http.StatusOK {
+		buf.WriteString("Content-Length: 0\r\nConnection: close\r\n")
+	}
+	for k, vs := range header {
+		for _, v := range vs {
+			fmt.Fprintf(&buf, "%v: %v\r\n", k, v)
+		}
+	}
+	buf.WriteString("\r\n")
+
+	_, err := c.Write([]byte(buf.String()))
+	return err
+}
+
+func ServerListen(ctx context.Context, ln net.Listener, conf *ServerConfig) error {
+	defer ln.Close()
+
+	lCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		<-lCtx.Done()
+		_ = ln.Close()
+	}()
+
+	var tempDelay time.Duration
+	for {
+		c, e := ln.Accept()
+		if e != nil {
+			if ne, ok := e.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				time.Sleep(tempDelay)
+				continue
+			}
+			return e
+		}
+		tempDelay = 0
+
+		go func() {
+			_ = ServeConn(lCtx, c, conf)
+		}()
+	}
+}
+
+func ServeAddr(ctx context.Context, network, addr string, conf *ServerConfig) error {
+	lCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return fmt.Errorf("net.Listen, %v", err)
+	}
+	defer ln.Close()
+
+	return ServerListen(lCtx, ln, conf)
+}
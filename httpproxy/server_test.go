@@ -0,0 +1,109 @@
+package httpproxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gamexg/proxylib/httppipe"
+)
+
+func TestServeConn(t *testing.T) {
+	echo := testEchoServer(t)
+	defer echo.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conf := ServerConfig{}
+	conf.Default()
+	conf.AuthCheckUserAndPassword = func(user, password string) error {
+		if user != "user" || password != "pass" {
+			return fmt.Errorf("incorrect")
+		}
+		return nil
+	}
+
+	go func() {
+		_ = ServerListen(ctx, ln, &conf)
+	}()
+
+	d, err := NewDialer(&ClientConfig{
+		ProxyAddr:         ln.Addr().String(),
+		AuthUsername:      "user",
+		AuthPassword:      "pass",
+		ShakeHandsTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testDialEcho(t, d, echo.Addr().String())
+
+	// 密码错误
+	d, err = NewDialer(&ClientConfig{
+		ProxyAddr:    ln.Addr().String(),
+		AuthUsername: "user",
+		AuthPassword: "wrong",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = d.Dial("tcp", echo.Addr().String())
+	if err == nil {
+		t.Fatal("err == nil")
+	}
+}
+
+func TestServeConn_Http(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer site.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conf := ServerConfig{}
+	conf.Default()
+	conf.HttpPipeline = httppipe.SetResponseHeader("X-Proxy", "1")
+
+	go func() {
+		_ = ServerListen(ctx, ln, &conf)
+	}()
+
+	proxyUrl, _ := url.Parse("http://" + ln.Addr().String())
+	transport := &http.Transport{Proxy: http.ProxyURL(proxyUrl)}
+	defer transport.CloseIdleConnections()
+	client := http.Client{Transport: transport}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(site.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		if string(body) != "hello" || resp.Header.Get("X-Proxy") != "1" {
+			t.Fatalf("resp = %#v, body = %q", resp, body)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package mitm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// 本地 CA
+// 用来给剥离 tls 的网站签发证书，需要被浏览器信任
+type CA struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// 生成新的 CA
+func NewCA(commonName string, validity time.Duration) (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("ecdsa.GenerateKey, %v", err)
+	}
+
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	skid, err := subjectKeyId(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:   commonName,
+			Organization: []string{commonName},
+		},
+		NotBefore:             now.Add(-1 * time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		SubjectKeyId:          skid,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("x509.CreateCertificate, %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("x509.ParseCertificate, %v", err)
+	}
+
+	return &CA{
+		Cert: cert,
+		Key:  key,
+	}, nil
+}
+
+// 从 pem 格式加载 CA
+func LoadCA(certPEM, keyPEM []byte) (*CA, error) {
+	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("tls.X509KeyPair, %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("x509.ParseCertificate, %v", err)
+	}
+
+	if cert.IsCA == false {
+		return nil, fmt.Errorf("%v is not a CA certificate", cert.Subject)
+	}
+
+	key, _ := tlsCert.PrivateKey.(crypto.Signer)
+	if key == nil {
+		return nil, fmt.Errorf("非预期的私钥类型, %T", tlsCert.PrivateKey)
+	}
+
+	return &CA{
+		Cert: cert,
+		Key:  key,
+	}, nil
+}
+
+func LoadCAFile(certFile, keyFile string) (*CA, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return LoadCA(certPEM, keyPEM)
+}
+
+// 加载 CA，文件不存在时生成新的 CA 并保存
+func LoadOrCreateCAFile(certFile, keyFile, commonName string, validity time.Duration) (*CA, error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		ca, err := NewCA(commonName, validity)
+		if err != nil {
+			return nil, err
+		}
+
+		err = ca.SaveFile(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		return ca, nil
+	}
+
+	return LoadCAFile(certFile, keyFile)
+}
+
+func (ca *CA) CertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Cert.Raw})
+}
+
+func (ca *CA) KeyPEM() ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(ca.Key)
+	if err != nil {
+		return nil, fmt.Errorf("x509.MarshalPKCS8PrivateKey, %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func (ca *CA) SaveFile(certFile, keyFile string) error {
+	keyPEM, err := ca.KeyPEM()
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(certFile, ca.CertPEM(), 0644)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(keyFile, keyPEM, 0600)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// 签发 host 的证书
+// host 可以是域名或 ip，证书使用 key 作为私钥
+// 证书有效期不会超过 CA 的有效期
+func (ca *CA) Issue(host string, key crypto.Signer, validity time.Duration) (*tls.Certificate, error) {
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	// 过期的 CA 签发的证书也已经过期，客户端无法使用
+	if now.Before(ca.Cert.NotAfter) == false {
+		return nil, fmt.Errorf("ca certificate expired at %v", ca.Cert.NotAfter)
+	}
+
+	notAfter := now.Add(validity)
+	if notAfter.After(ca.Cert.NotAfter) {
+		notAfter = ca.Cert.NotAfter
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: host},
+		NotBefore:             now.Add(-1 * time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		AuthorityKeyId:        ca.Cert.SubjectKeyId,
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, ca.Cert, key.Public(), ca.Key)
+	if err != nil {
+		return nil, fmt.Errorf("x509.CreateCertificate, %v", err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("x509.ParseCertificate, %v", err)
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.Cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+func newSerialNumber() (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), 128)
+	n, err := rand.Int(rand.Reader, limit)
+	if err != nil {
+		return nil, fmt.Errorf("rand.Int, %v", err)
+	}
+	return n, nil
+}
+
+func subjectKeyId(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("x509.MarshalPKIXPublicKey, %v", err)
+	}
+
+	sum := sha1.Sum(der)
+	return sum[:], nil
+}
@@ -0,0 +1,125 @@
+package mitm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 证书缓存
+// 按 host 缓存签发的证书，证书快过期时重新签发
+type CertCache struct {
+	ca *CA
+
+	// 签发的证书有效期
+	validity time.Duration
+	// 最多缓存的证书数量，超出时清理过期证书，仍超出时删除最早过期的证书
+	maxSize int
+
+	// 所有签发的证书共用一个私钥，节省生成私钥的时间
+	key crypto.Signer
+
+	m     sync.Mutex
+	certs map[string]*certCacheItem
+}
+
+type certCacheItem struct {
+	cert *tls.Certificate
+	// 到达这个时间后需要重新签发
+	expire time.Time
+}
+
+func NewCertCache(ca *CA, validity time.Duration, maxSize int) (*CertCache, error) {
+	if ca == nil {
+		return nil, fmt.Errorf("ca is nil")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("ecdsa.GenerateKey, %v", err)
+	}
+
+	return &CertCache{
+		ca:       ca,
+		validity: validity,
+		maxSize:  maxSize,
+		key:      key,
+		certs:    make(map[string]*certCacheItem),
+	}, nil
+}
+
+// 获取 host 的证书，不存在或已过期时签发新的证书
+func (c *CertCache) Get(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if len(host) == 0 {
+		return nil, fmt.Errorf("host cannot be empty")
+	}
+
+	now := time.Now()
+
+	c.m.Lock()
+	item := c.certs[host]
+	c.m.Unlock()
+
+	if item != nil && now.Before(item.expire) {
+		return item.cert, nil
+	}
+
+	cert, err := c.ca.Issue(host, c.key, c.validity)
+	if err != nil {
+		return nil, fmt.Errorf("ca.Issue, %v", err)
+	}
+
+	// 提前 1/10 有效期重新签发，防止使用中过期
+	lifetime := cert.Leaf.NotAfter.Sub(now)
+	item = &certCacheItem{
+		cert:   cert,
+		expire: now.Add(lifetime - lifetime/10),
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.maxSize > 0 && len(c.certs) >= c.maxSize {
+		c.cleanLocked(now)
+	}
+
+	c.certs[host] = item
+
+	return cert, nil
+}
+
+func (c *CertCache) cleanLocked(now time.Time) {
+	for k, v := range c.certs {
+		if now.After(v.expire) {
+			delete(c.certs, k)
+		}
+	}
+
+	// 仍然超出时删除最早过期的证书
+	for len(c.certs) >= c.maxSize {
+		oldestHost := ""
+		var oldest *certCacheItem
+		for k, v := range c.certs {
+			if oldest == nil || v.expire.Before(oldest.expire) {
+				oldestHost = k
+				oldest = v
+			}
+		}
+		delete(c.certs, oldestHost)
+	}
+}
+
+// 缓存的证书数量
+func (c *CertCache) Len() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return len(c.certs)
+}
@@ -0,0 +1,346 @@
+package mitm
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gamexg/proxylib/httppipe"
+)
+
+func newTestCertCache(t *testing.T) (*CertCache, *x509.CertPool) {
+	ca, err := NewCA("proxylib test ca", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certs, err := NewCertCache(ca, time.Hour, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+
+	return certs, pool
+}
+
+func TestCertCache(t *testing.T) {
+	certs, pool := newTestCertCache(t)
+
+	for _, host := range []string{"www.example.com", "127.0.0.1"} {
+		cert, err := certs.Get(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = cert.Leaf.Verify(x509.VerifyOptions{
+			DNSName: host,
+			Roots:   pool,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cert2, err := certs.Get(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert != cert2 {
+			t.Fatal("cert is not cached")
+		}
+	}
+
+	if certs.Len() != 2 {
+		t.Fatalf("certs.Len() = %v", certs.Len())
+	}
+}
+
+func TestCertCache_Evict(t *testing.T) {
+	ca, err := NewCA("proxylib test ca", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certs, err := NewCertCache(ca, time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{"a.com", "b.com", "c.com"} {
+		_, err := certs.Get(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 只删除最早过期的证书，不清空缓存
+	if certs.Len() != 2 {
+		t.Fatalf("certs.Len() = %v", certs.Len())
+	}
+}
+
+func TestCertCache_ExpiredCA(t *testing.T) {
+	ca, err := NewCA("proxylib test ca", -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certs, err := NewCertCache(ca, time.Hour, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = certs.Get("www.example.com")
+	if err == nil || strings.Contains(err.Error(), "expired") == false {
+		t.Fatalf("err = %v", err)
+	}
+
+	if certs.Len() != 0 {
+		t.Fatalf("certs.Len() = %v", certs.Len())
+	}
+}
+
+func TestLoadOrCreateCAFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mitm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "ca.crt")
+	keyFile := filepath.Join(dir, "ca.key")
+
+	ca, err := LoadOrCreateCAFile(certFile, keyFile, "test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca2, err := LoadOrCreateCAFile(certFile, keyFile, "test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ca.Cert.Equal(ca2.Cert) == false {
+		t.Fatal("ca != ca2")
+	}
+}
+
+// 测试网站，证书由 httptest 签发
+func newTestSite(t *testing.T, h http.Handler) (*httptest.Server, *x509.CertPool) {
+	site := httptest.NewTLSServer(h)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(site.Certificate())
+
+	return site, pool
+}
+
+// 通过 mitm 发出请求，返回响应
+func testMitmRequest(t *testing.T, conf *Config, caPool *x509.CertPool, serverName string, req *http.Request) *http.Response {
+	client, server := net.Pipe()
+
+	go func() {
+		_ = ServeConn(context.Background(), server, net.JoinHostPort(serverName, "443"), conf)
+	}()
+
+	tlsConn := tls.Client(client, &tls.Config{
+		ServerName: serverName,
+		RootCAs:    caPool,
+	})
+	t.Cleanup(func() { _ = tlsConn.Close() })
+
+	err := req.Write(tlsConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
+
+func TestServeConn(t *testing.T) {
+	site, sitePool := newTestSite(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Path", r.URL.Path)
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer site.Close()
+
+	certs, caPool := newTestCertCache(t)
+
+	conf := Config{}
+	conf.Default()
+	conf.Certs = certs
+	conf.SiteRootCAs = sitePool
+	conf.SiteTcpDialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		d := net.Dialer{}
+		return d.DialContext(ctx, network, site.Listener.Addr().String())
+	}
+	conf.HttpPipeline = httppipe.SetResponseHeader("X-Mitm", "1")
+
+	req, _ := http.NewRequest("GET", "https://example.com/abc", nil)
+	resp := testMitmRequest(t, &conf, caPool, "example.com", req)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(body) != "hello" ||
+		resp.Header.Get("X-Path") != "/abc" ||
+		resp.Header.Get("X-Mitm") != "1" {
+		t.Fatalf("resp = %#v, body = %q", resp, body)
+	}
+}
+
+func TestServeConn_Http2(t *testing.T) {
+	site := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Site-Proto", r.Proto)
+		_, _ = w.Write([]byte("hello"))
+	}))
+	site.EnableHTTP2 = true
+	site.StartTLS()
+	defer site.Close()
+
+	sitePool := x509.NewCertPool()
+	sitePool.AddCert(site.Certificate())
+
+	certs, caPool := newTestCertCache(t)
+
+	conf := Config{}
+	conf.Default()
+	conf.Certs = certs
+	conf.SiteRootCAs = sitePool
+	conf.SiteTcpDialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		d := net.Dialer{}
+		return d.DialContext(ctx, network, site.Listener.Addr().String())
+	}
+	conf.HttpPipeline = httppipe.SetResponseHeader("X-Mitm", "1")
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				_ = ServeConn(context.Background(), server, addr, &conf)
+			}()
+			return client, nil
+		},
+		TLSClientConfig:   &tls.Config{RootCAs: caPool},
+		ForceAttemptHTTP2: true,
+	}
+	defer transport.CloseIdleConnections()
+	client := http.Client{Transport: transport}
+
+	// 多个请求复用同一个 http2 连接
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get("https://example.com/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		if string(body) != "hello" ||
+			resp.ProtoMajor != 2 ||
+			resp.Header.Get("X-Site-Proto") != "HTTP/2.0" ||
+			resp.Header.Get("X-Mitm") != "1" {
+			t.Fatalf("resp = %#v, body = %q", resp, body)
+		}
+	}
+}
+
+func TestServeConn_Passthrough(t *testing.T) {
+	site, sitePool := newTestSite(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer site.Close()
+
+	certs, caPool := newTestCertCache(t)
+
+	conf := Config{}
+	conf.Default()
+	conf.Certs = certs
+	// 不信任网站的证书，模拟网站证书错误
+	conf.SiteRootCAs = x509.NewCertPool()
+	conf.SiteTcpDialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		d := net.Dialer{}
+		return d.DialContext(ctx, network, site.Listener.Addr().String())
+	}
+
+	// 使用 mitm CA 的客户端需要看到证书错误
+	func() {
+		client, server := net.Pipe()
+		defer client.Close()
+
+		go func() {
+			_ = ServeConn(context.Background(), server, "example.com:443", &conf)
+		}()
+
+		tlsConn := tls.Client(client, &tls.Config{
+			ServerName: "example.com",
+			RootCAs:    caPool,
+		})
+		err := tlsConn.Handshake()
+		if err == nil || isCertificateError(err) == false {
+			t.Fatalf("err = %v", err)
+		}
+	}()
+
+	if conf.Passthrough.IsPinned("example.com") == false {
+		t.Fatal("example.com is not pinned")
+	}
+
+	// 信任网站证书的客户端能够直接和网站握手
+	req, _ := http.NewRequest("GET", "https://example.com/", nil)
+	resp := testMitmRequest(t, &conf, sitePool, "example.com", req)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(body) != "hello" {
+		t.Fatalf("body = %q", body)
+	}
+}
+
+func TestPassthroughPins(t *testing.T) {
+	pins := NewPassthroughPins(50 * time.Millisecond)
+
+	pins.Pin("Example.com.")
+	pins.PinForever("bank.com")
+
+	if pins.IsPinned("example.com") == false || pins.IsPinned("bank.com") == false {
+		t.Fatal("not pinned")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if pins.IsPinned("example.com") {
+		t.Fatal("example.com is not expired")
+	}
+	if pins.IsPinned("bank.com") == false {
+		t.Fatal("bank.com is expired")
+	}
+
+	pins.Unpin("bank.com")
+	if pins.IsPinned("bank.com") {
+		t.Fatal("bank.com is pinned")
+	}
+}
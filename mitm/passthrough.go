@@ -0,0 +1,127 @@
+package mitm
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gamexg/proxylib/goio"
+)
+
+// 直通记录
+// 记录不剥离 tls 的 host，之后到这些 host 的连接不再尝试剥离，直接 tcp 转发。
+// 防止网站证书错误时，剥离 tls 把真实的攻击变成了浏览器信任的页面。
+type PassthroughPins struct {
+	// 自动记录的有效期
+	ttl time.Duration
+
+	m sync.Mutex
+	// host -> 过期时间，零值表示永久有效
+	hosts map[string]time.Time
+}
+
+func NewPassthroughPins(ttl time.Duration) *PassthroughPins {
+	return &PassthroughPins{
+		ttl:   ttl,
+		hosts: make(map[string]time.Time),
+	}
+}
+
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// 记录 host，有效期为 ttl
+func (p *PassthroughPins) Pin(host string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	host = normalizeHost(host)
+
+	// 不覆盖永久记录
+	if expire, ok := p.hosts[host]; ok && expire.IsZero() {
+		return
+	}
+
+	p.hosts[host] = time.Now().Add(p.ttl)
+}
+
+// 永久记录 host，例如不允许剥离的银行网站
+func (p *PassthroughPins) PinForever(host string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.hosts[normalizeHost(host)] = time.Time{}
+}
+
+func (p *PassthroughPins) Unpin(host string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	delete(p.hosts, normalizeHost(host))
+}
+
+func (p *PassthroughPins) IsPinned(host string) bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	host = normalizeHost(host)
+
+	expire, ok := p.hosts[host]
+	if !ok {
+		return false
+	}
+
+	if expire.IsZero() == false && time.Now().After(expire) {
+		delete(p.hosts, host)
+		return false
+	}
+
+	return true
+}
+
+// 判断是否是网站证书验证错误
+func isCertificateError(err error) bool {
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certificateInvalidErr x509.CertificateInvalidError
+	var systemRootsErr x509.SystemRootsError
+	var constraintViolationErr x509.ConstraintViolationError
+
+	return errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &certificateInvalidErr) ||
+		errors.As(err, &systemRootsErr) ||
+		errors.As(err, &constraintViolationErr)
+}
+
+// 不剥离 tls，重放客户端的 ClientHello 后直接 tcp 转发
+// 使得浏览器能够看到网站真实的证书(及证书错误)
+func passthrough(ctx context.Context, conf *Config, clientConn net.Conn, addr string, helloRaw []byte) error {
+	dialTimeout := conf.SiteTcpDialContextDialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = 60 * time.Second
+	}
+	dialCtx, dialCtxCancel := context.WithTimeout(ctx, dialTimeout)
+	defer dialCtxCancel()
+
+	siteConn, err := conf.SiteTcpDialContext(dialCtx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("SiteTcpDialContext, %v", err)
+	}
+	defer siteConn.Close()
+
+	_, err = goio.WriteAll(siteConn, helloRaw)
+	if err != nil {
+		return fmt.Errorf("siteConn.Write, %v", err)
+	}
+
+	_ = clientConn.SetDeadline(time.Time{})
+
+	return goio.Forward(ctx, clientConn, siteConn, "clientConn", "siteConn", conf.ForwardBufSize, conf.ForwardTimeout)
+}
@@ -0,0 +1,317 @@
+package mitm
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gamexg/proxylib/goio"
+	"github.com/gamexg/proxylib/httppipe"
+)
+
+type Config struct {
+	// 签发证书使用的证书缓存
+	Certs *CertCache
+
+	// tls 握手超时，包含读取 ClientHello、到网站的 tls 握手及到客户端的 tls 握手
+	TlsShakeHandsTimeout time.Duration
+
+	// 向 目标网站 建立 tcp 连接使用的函数
+	SiteTcpDialContext func(ctx context.Context, network, address string) (net.Conn, error)
+	// 连接超时
+	SiteTcpDialContextDialTimeout time.Duration
+	// 验证网站证书使用的根证书
+	// 为空则使用系统根证书
+	SiteRootCAs *x509.CertPool
+
+	// 直通记录
+	// 网站证书验证失败的 host 会被记录，之后到这个 host 的连接不再尝试剥离 tls
+	// 为空则不记录，但证书验证失败时仍然会直通
+	Passthrough *PassthroughPins
+
+	// 直通时的转发超时
+	ForwardTimeout time.Duration
+	// 默认值 32*1024
+	ForwardBufSize int
+
+	// http 请求处理管道
+	// next 会将请求发往网站，可以在调用 next 前后检查、修改请求及响应。
+	// 可以使用 httppipe.Chain 组合多级，为空则直接转发
+	HttpPipeline httppipe.Stage
+	// 等待客户端下一个 http 请求的超时时间
+	HttpIdleTimeout time.Duration
+	// websocket 帧检查，见 httppipe.ServeConfig.WebSocketFrameHook
+	WebSocketFrameHook func(req *http.Request, fromClient bool, frame *httppipe.WebSocketFrame)
+
+	// 是否启用 http2
+	// 启用时客户端支持 h2 则向网站提供 h2，网站选择 h2 时同样与客户端使用 h2，
+	// 与客户端使用的协议跟随网站，保证经过代理测得的性能与直连一致
+	Http2 bool
+}
+
+func (c *Config) Default() {
+	dial := net.Dialer{}
+
+	*c = Config{
+		Certs:                         nil,
+		TlsShakeHandsTimeout:          10 * time.Second,
+		SiteTcpDialContext:            dial.DialContext,
+		SiteTcpDialContextDialTimeout: 10 * time.Second,
+		SiteRootCAs:                   nil,
+		Passthrough:                   NewPassthroughPins(10 * time.Minute),
+		ForwardTimeout:                2 * 60 * time.Second,
+		ForwardBufSize:                32 * 1024,
+		HttpPipeline:                  nil,
+		HttpIdleTimeout:               2 * 60 * time.Second,
+		WebSocketFrameHook:            nil,
+		Http2:                         true,
+	}
+}
+
+// 剥离 clientConn 上的 tls
+// clientConn 是到 addr 的隧道(例如 CONNECT、socks5 的客户端连接)，客户端会在上面发出 tls 握手。
+// 网站证书验证失败时不剥离 tls，改为重放 ClientHello 并直接 tcp 转发，由浏览器自己发现证书错误。
+// 本函数负责关闭 clientConn 及新建的连接
+func ServeConn(ctx context.Context, clientConn net.Conn, addr string, conf *Config) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer clientConn.Close()
+
+	if conf.Certs == nil {
+		return fmt.Errorf("conf.Certs is nil")
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("addr is incorrect, %v", err)
+	}
+
+	if conf.TlsShakeHandsTimeout != 0 {
+		_ = clientConn.SetDeadline(time.Now().Add(conf.TlsShakeHandsTimeout))
+	}
+
+	hello, helloRaw, err := readClientHello(clientConn)
+	if err != nil {
+		return fmt.Errorf("readClientHello, %v", err)
+	}
+
+	serverName := hello.ServerName
+	if len(serverName) == 0 {
+		serverName = host
+	}
+
+	pins := conf.Passthrough
+	if pins != nil && pins.IsPinned(serverName) {
+		return passthrough(ctx, conf, clientConn, addr, helloRaw)
+	}
+
+	nextProtos := siteNextProtos(conf, hello)
+
+	siteConn, err := dialSiteTls(ctx, conf, addr, serverName, nextProtos)
+	if err != nil {
+		if isCertificateError(err) {
+			if pins != nil {
+				pins.Pin(serverName)
+			}
+			return passthrough(ctx, conf, clientConn, addr, helloRaw)
+		}
+		return fmt.Errorf("dialSiteTls, %v", err)
+	}
+
+	transport := newSiteTransport(conf, addr, serverName, nextProtos, siteConn)
+	defer transport.Close()
+
+	cert, err := conf.Certs.Get(serverName)
+	if err != nil {
+		return fmt.Errorf("Certs.Get, %v", err)
+	}
+
+	clientNextProtos := []string{"http/1.1"}
+	if siteConn.ConnectionState().NegotiatedProtocol == "h2" {
+		clientNextProtos = []string{"h2", "http/1.1"}
+	}
+
+	tlsClientConn := tls.Server(goio.NewPrefixConn(clientConn, helloRaw), &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		NextProtos:   clientNextProtos,
+	})
+	defer tlsClientConn.Close()
+
+	err = tlsClientConn.Handshake()
+	if err != nil {
+		return fmt.Errorf("tlsClientConn.Handshake, %v", err)
+	}
+
+	_ = clientConn.SetDeadline(time.Time{})
+
+	var rt http.RoundTripper = transport
+	if conf.HttpPipeline != nil {
+		rt = conf.HttpPipeline(transport)
+	}
+
+	serveConf := httppipe.ServeConfig{
+		Scheme:             "https",
+		Host:               addr,
+		IdleTimeout:        conf.HttpIdleTimeout,
+		WebSocketFrameHook: conf.WebSocketFrameHook,
+	}
+
+	if tlsClientConn.ConnectionState().NegotiatedProtocol == "h2" {
+		return httppipe.ServeConnH2(ctx, tlsClientConn, rt, &serveConf)
+	}
+
+	return httppipe.ServeConn(ctx, tlsClientConn, nil, nil, rt, &serveConf)
+}
+
+var errClientHelloRead = errors.New("client hello read")
+
+// 只读连接，写入的数据会被丢弃
+// 用于借助 tls 库解析 ClientHello
+type recordConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *recordConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// 读取客户端的 ClientHello
+// 返回解析结果及读取到的原始数据，原始数据需要在之后的握手中重放
+func readClientHello(c net.Conn) (*tls.ClientHelloInfo, []byte, error) {
+	raw := bytes.Buffer{}
+
+	var hello *tls.ClientHelloInfo
+	tlsConn := tls.Server(&recordConn{Conn: c, r: io.TeeReader(c, &raw)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			h := *info
+			h.SupportedProtos = append([]string(nil), info.SupportedProtos...)
+			h.Conn = nil
+			hello = &h
+			return nil, errClientHelloRead
+		},
+	})
+
+	err := tlsConn.Handshake()
+	if hello == nil {
+		if err == nil {
+			err = fmt.Errorf("unexpected handshake success")
+		}
+		return nil, nil, err
+	}
+
+	return hello, raw.Bytes(), nil
+}
+
+// 向网站提供的 ALPN 协议
+// 只有客户端支持 h2 时才向网站提供 h2，否则网站选择 h2 后无法转发客户端的 websocket 等 http/1.1 请求
+func siteNextProtos(conf *Config, hello *tls.ClientHelloInfo) []string {
+	if conf.Http2 {
+		for _, p := range hello.SupportedProtos {
+			if p == "h2" {
+				return []string{"h2", "http/1.1"}
+			}
+		}
+	}
+
+	return []string{"http/1.1"}
+}
+
+// 建立到网站的 tls 连接，并完整验证网站证书
+func dialSiteTls(ctx context.Context, conf *Config, addr, serverName string, nextProtos []string) (*tls.Conn, error) {
+	dialTimeout := conf.SiteTcpDialContextDialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = 60 * time.Second
+	}
+	dialCtx, dialCtxCancel := context.WithTimeout(ctx, dialTimeout)
+	defer dialCtxCancel()
+
+	siteConn, err := conf.SiteTcpDialContext(dialCtx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("SiteTcpDialContext, %v", err)
+	}
+
+	if conf.TlsShakeHandsTimeout != 0 {
+		_ = siteConn.SetDeadline(time.Now().Add(conf.TlsShakeHandsTimeout))
+	}
+
+	tlsSiteConn := tls.Client(siteConn, &tls.Config{
+		ServerName: serverName,
+		RootCAs:    conf.SiteRootCAs,
+		NextProtos: nextProtos,
+	})
+
+	err = tlsSiteConn.Handshake()
+	if err != nil {
+		_ = siteConn.Close()
+		return nil, err
+	}
+
+	_ = siteConn.SetDeadline(time.Time{})
+
+	return tlsSiteConn, nil
+}
+
+// 到网站的 http 客户端
+// 第一个连接使用握手时已验证的连接，之后的连接重新建立并验证。
+// 网站在 ALPN 中选择 h2 时使用 http2
+type siteTransport struct {
+	*http.Transport
+
+	m         sync.Mutex
+	firstConn *tls.Conn
+}
+
+func newSiteTransport(conf *Config, addr, serverName string, nextProtos []string, firstConn *tls.Conn) *siteTransport {
+	t := &siteTransport{
+		firstConn: firstConn,
+	}
+
+	t.Transport = &http.Transport{
+		Proxy: nil,
+		DialTLSContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			if c := t.takeFirstConn(); c != nil {
+				return c, nil
+			}
+
+			return dialSiteTls(ctx, conf, addr, serverName, nextProtos)
+		},
+		ForceAttemptHTTP2:   conf.Http2,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     conf.HttpIdleTimeout,
+	}
+
+	return t
+}
+
+func (t *siteTransport) takeFirstConn() net.Conn {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	c := t.firstConn
+	t.firstConn = nil
+	if c == nil {
+		return nil
+	}
+	return c
+}
+
+func (t *siteTransport) Close() {
+	if c := t.takeFirstConn(); c != nil {
+		_ = c.Close()
+	}
+
+	t.CloseIdleConnections()
+}
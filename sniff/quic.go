@@ -0,0 +1,287 @@
+package sniff
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/gamexg/proxylib/tlsinfo"
+	"golang.org/x/crypto/hkdf"
+)
+
+// 不是 quic v1 的 Initial 包
+var ErrNotQuicInitial = errors.New("not quic v1 initial packet")
+
+// quic v1 Initial 包使用的盐，rfc9001 5.2
+var quicV1InitialSalt = []byte{
+	0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+	0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+}
+
+const (
+	quicVersion1 = 0x00000001
+	// 最多缓存的 CRYPTO 数据
+	maxQuicCryptoSize = 64 * 1024
+)
+
+// 从 quic Initial 包中取得 ClientHello
+// ClientHello 较大时(例如带有后量子密钥交换)会被拆分到多个 Initial 包，
+// 需要依次调用 Feed 直到返回结果。每个目标使用一个 QuicSniffer。
+type QuicSniffer struct {
+	dcid     []byte
+	segments []quicCryptoSegment
+	size     int
+}
+
+type quicCryptoSegment struct {
+	offset uint64
+	data   []byte
+}
+
+// 处理客户端发出的一个 udp 包
+// ClientHello 不完整时返回 ErrNeedMore，不是 quic v1 Initial 包时返回 ErrNotQuicInitial
+func (q *QuicSniffer) Feed(datagram []byte) (*tlsinfo.ClientHello, error) {
+	dcid, payload, err := decryptQuicInitial(datagram)
+	if err != nil {
+		return nil, err
+	}
+
+	// 收到网站回应前客户端的 Initial 包都使用同一个 dcid
+	if q.dcid == nil {
+		q.dcid = append([]byte(nil), dcid...)
+	} else if bytes.Equal(q.dcid, dcid) == false {
+		return nil, ErrNotQuicInitial
+	}
+
+	err = q.parseFrames(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	hello, err := tlsinfo.ParseClientHelloMessage(q.cryptoData())
+	if err == io.ErrUnexpectedEOF {
+		return nil, ErrNeedMore
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return hello, nil
+}
+
+// 从偏移 0 开始连续的 CRYPTO 数据
+func (q *QuicSniffer) cryptoData() []byte {
+	sort.Slice(q.segments, func(i, j int) bool {
+		return q.segments[i].offset < q.segments[j].offset
+	})
+
+	data := make([]byte, 0, q.size)
+	for _, seg := range q.segments {
+		if seg.offset > uint64(len(data)) {
+			break
+		}
+
+		end := seg.offset + uint64(len(seg.data))
+		if end > uint64(len(data)) {
+			data = append(data, seg.data[uint64(len(data))-seg.offset:]...)
+		}
+	}
+
+	return data
+}
+
+// 解析 Initial 包中的帧，保存 CRYPTO 帧的数据
+// Initial 包只允许 PADDING、PING、ACK、CRYPTO、CONNECTION_CLOSE 帧，rfc9000 17.2.2
+func (q *QuicSniffer) parseFrames(payload []byte) error {
+	p := quicParser{b: payload}
+
+	for len(p.b) > 0 && p.err == nil {
+		frameType := p.varint()
+
+		switch frameType {
+		case 0x00, 0x01:
+			// PADDING、PING
+		case 0x02, 0x03:
+			// ACK
+			p.varint()
+			p.varint()
+			rangeCount := p.varint()
+			p.varint()
+			for i := uint64(0); i < rangeCount && p.err == nil; i++ {
+				p.varint()
+				p.varint()
+			}
+			if frameType == 0x03 {
+				p.varint()
+				p.varint()
+				p.varint()
+			}
+		case 0x06:
+			// CRYPTO
+			offset := p.varint()
+			data := p.bytes(p.varint())
+			if p.err != nil {
+				break
+			}
+
+			q.size += len(data)
+			if q.size > maxQuicCryptoSize {
+				return fmt.Errorf("crypto data too large")
+			}
+			q.segments = append(q.segments, quicCryptoSegment{
+				offset: offset,
+				data:   append([]byte(nil), data...),
+			})
+		case 0x1c:
+			// CONNECTION_CLOSE
+			p.varint()
+			p.varint()
+			p.bytes(p.varint())
+		default:
+			return fmt.Errorf("unexpected frame type %v", frameType)
+		}
+	}
+
+	return p.err
+}
+
+// 解除 Initial 包的包头保护并解密，返回 dcid 及明文
+// 只处理 udp 包中的第一个 quic 包，rfc9001 5
+func decryptQuicInitial(packet []byte) ([]byte, []byte, error) {
+	p := quicParser{b: packet}
+
+	first := p.bytes(1)
+	version := p.bytes(4)
+	if p.err != nil ||
+		first[0]&0x80 == 0 || // 短包头
+		first[0]&0x30 != 0 || // 不是 Initial 包
+		binary.BigEndian.Uint32(version) != quicVersion1 {
+		return nil, nil, ErrNotQuicInitial
+	}
+
+	dcidLen := p.bytes(1)
+	if p.err != nil || dcidLen[0] > 20 {
+		return nil, nil, ErrNotQuicInitial
+	}
+	dcid := p.bytes(uint64(dcidLen[0]))
+	scidLen := p.bytes(1)
+	if p.err != nil || scidLen[0] > 20 {
+		return nil, nil, ErrNotQuicInitial
+	}
+	p.bytes(uint64(scidLen[0]))
+	p.bytes(p.varint())
+	length := p.varint()
+	if p.err != nil || length > uint64(len(p.b)) || length < 20 {
+		return nil, nil, ErrNotQuicInitial
+	}
+
+	pnOffset := len(packet) - len(p.b)
+	end := pnOffset + int(length)
+
+	key, iv, hp := quicInitialClientKeys(dcid)
+
+	// 包头保护使用 包号 之后第 4 字节开始的 16 字节作为采样
+	hpBlock, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, nil, err
+	}
+	mask := make([]byte, aes.BlockSize)
+	hpBlock.Encrypt(mask, packet[pnOffset+4:pnOffset+4+aes.BlockSize])
+
+	// 不修改调用方的数据
+	header := append([]byte(nil), packet[:pnOffset+4]...)
+	header[0] ^= mask[0] & 0x0f
+	pnLen := int(header[0]&0x03) + 1
+	pn := uint64(0)
+	for i := 0; i < pnLen; i++ {
+		header[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(header[pnOffset+i])
+	}
+	header = header[:pnOffset+pnLen]
+
+	nonce := append([]byte(nil), iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	payload, err := aead.Open(nil, nonce, packet[pnOffset+pnLen:end], header)
+	if err != nil {
+		return nil, nil, fmt.Errorf("aead.Open, %v", err)
+	}
+
+	return dcid, payload, nil
+}
+
+// 客户端 Initial 包使用的密钥，由客户端选择的 dcid 派生，rfc9001 5.2
+func quicInitialClientKeys(dcid []byte) (key, iv, hp []byte) {
+	initialSecret := hkdf.Extract(sha256.New, dcid, quicV1InitialSalt)
+	clientSecret := hkdfExpandLabel(initialSecret, "client in", sha256.Size)
+
+	key = hkdfExpandLabel(clientSecret, "quic key", 16)
+	iv = hkdfExpandLabel(clientSecret, "quic iv", 12)
+	hp = hkdfExpandLabel(clientSecret, "quic hp", 16)
+	return
+}
+
+// tls 1.3 的 HKDF-Expand-Label，context 为空
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+
+	info := make([]byte, 0, 4+len(label))
+	info = append(info, byte(length>>8), byte(length), byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+
+	out := make([]byte, length)
+	_, _ = io.ReadFull(hkdf.Expand(sha256.New, secret, info), out)
+	return out
+}
+
+// 按 quic 格式读取数据
+type quicParser struct {
+	b   []byte
+	err error
+}
+
+func (p *quicParser) bytes(n uint64) []byte {
+	if p.err != nil {
+		return nil
+	}
+	if uint64(len(p.b)) < n {
+		p.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	v := p.b[:n]
+	p.b = p.b[n:]
+	return v
+}
+
+// 变长整数，rfc9000 16
+func (p *quicParser) varint() uint64 {
+	first := p.bytes(1)
+	if p.err != nil {
+		return 0
+	}
+
+	l := 1 << (first[0] >> 6)
+	v := uint64(first[0] & 0x3f)
+	for _, b := range p.bytes(uint64(l - 1)) {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
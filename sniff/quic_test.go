@@ -0,0 +1,131 @@
+package sniff
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/tls"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestQuicInitialClientKeys(t *testing.T) {
+	// rfc9001 附录 A.1
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+
+	key, iv, hp := quicInitialClientKeys(dcid)
+
+	if hex.EncodeToString(key) != "1f369613dd76d5467730efcbe3b1a22d" ||
+		hex.EncodeToString(iv) != "fa044b2f42a3fd3b46fb255c" ||
+		hex.EncodeToString(hp) != "9f50449e04a0e810283a1e9933adedd2" {
+		t.Fatalf("key = %x, iv = %x, hp = %x", key, iv, hp)
+	}
+}
+
+// 取得 tls 库生成的 ClientHello 握手消息
+func testClientHelloMessage(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		_ = tls.Client(client, &tls.Config{
+			ServerName: serverName,
+			NextProtos: []string{"h3"},
+			MinVersion: tls.VersionTLS13,
+		}).Handshake()
+		_ = client.Close()
+	}()
+
+	header := make([]byte, 5)
+	_, err := io.ReadFull(server, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := make([]byte, int(header[3])<<8|int(header[4]))
+	_, err = io.ReadFull(server, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return msg
+}
+
+// 生成客户端 Initial 包，payload 会被填充到 1200 字节
+func testQuicInitialPacket(t *testing.T, dcid []byte, pn uint16, frames []byte) []byte {
+	key, iv, hp := quicInitialClientKeys(dcid)
+
+	// 2 字节包号，1 字节 scid 长度，1 字节 token 长度，2 字节 length
+	headerLen := 1 + 4 + 1 + len(dcid) + 1 + 1 + 2 + 2
+	payloadLen := 1200 - headerLen - 16
+	payload := make([]byte, payloadLen)
+	copy(payload, frames)
+
+	length := 2 + payloadLen + 16
+
+	header := []byte{0xc1, 0, 0, 0, 1, byte(len(dcid))}
+	header = append(header, dcid...)
+	header = append(header, 0, 0, 0x40|byte(length>>8), byte(length), byte(pn>>8), byte(pn))
+	pnOffset := len(header) - 2
+
+	nonce := append([]byte(nil), iv...)
+	nonce[len(nonce)-2] ^= byte(pn >> 8)
+	nonce[len(nonce)-1] ^= byte(pn)
+
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	packet := aead.Seal(append([]byte(nil), header...), nonce, payload, header)
+
+	hpBlock, _ := aes.NewCipher(hp)
+	mask := make([]byte, 16)
+	hpBlock.Encrypt(mask, packet[pnOffset+4:pnOffset+20])
+	packet[0] ^= mask[0] & 0x0f
+	packet[pnOffset] ^= mask[1]
+	packet[pnOffset+1] ^= mask[2]
+
+	return packet
+}
+
+func testQuicCryptoFrame(offset int, data []byte) []byte {
+	// 偏移、长度都使用 2 字节变长整数
+	frame := []byte{0x06, 0x40 | byte(offset>>8), byte(offset), 0x40 | byte(len(data)>>8), byte(len(data))}
+	return append(frame, data...)
+}
+
+func TestQuicSniffer(t *testing.T) {
+	msg := testClientHelloMessage(t, "www.example.com")
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	// ClientHello 拆分到两个包，后半部分先到达
+	half := len(msg) / 2
+	packet1 := testQuicInitialPacket(t, dcid, 1, testQuicCryptoFrame(half, msg[half:]))
+	packet2 := testQuicInitialPacket(t, dcid, 0, append([]byte{0x01}, testQuicCryptoFrame(0, msg[:half])...))
+
+	original := append([]byte(nil), packet1...)
+
+	q := QuicSniffer{}
+	_, err := q.Feed(packet1)
+	if err != ErrNeedMore {
+		t.Fatalf("err = %v", err)
+	}
+
+	// 不能修改调用方的数据，数据还需要发往网站
+	if bytes.Equal(original, packet1) == false {
+		t.Fatal("packet modified")
+	}
+
+	hello, err := q.Feed(packet2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.ServerName != "www.example.com" || len(hello.ALPN) != 1 || hello.ALPN[0] != "h3" {
+		t.Fatalf("hello = %#v", hello)
+	}
+
+	_, err = (&QuicSniffer{}).Feed([]byte("not quic packet"))
+	if err != ErrNotQuicInitial {
+		t.Fatalf("err = %v", err)
+	}
+}
@@ -0,0 +1,209 @@
+// 目标嗅探
+// 读取客户端发出的第一块数据，识别应用层协议，并从 tls SNI 或 http Host 中取得客户端实际访问的域名。
+// 读取的数据不会被消耗，返回的连接会重放这些数据。
+package sniff
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gamexg/proxylib/goio"
+	"github.com/gamexg/proxylib/tlsinfo"
+)
+
+// 最多读取的数据量
+const maxSniffSize = 16 * 1024
+
+type Protocol int
+
+const (
+	ProtocolUnknown Protocol = iota
+	ProtocolTLS
+	// http/1.x
+	ProtocolHTTP
+	// 明文 http2(h2c)，以连接序言开头
+	ProtocolHTTP2
+	ProtocolSSH
+	ProtocolBitTorrent
+	// quic v1，域名来自 Initial 包中的 ClientHello
+	ProtocolQUIC
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolTLS:
+		return "tls"
+	case ProtocolHTTP:
+		return "http"
+	case ProtocolHTTP2:
+		return "http2"
+	case ProtocolSSH:
+		return "ssh"
+	case ProtocolBitTorrent:
+		return "bittorrent"
+	case ProtocolQUIC:
+		return "quic"
+	default:
+		return "unknown"
+	}
+}
+
+// 各协议开头的固定内容
+const (
+	http2Preface        = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+	sshPrefix           = "SSH-"
+	bitTorrentHandshake = "\x13BitTorrent protocol"
+)
+
+type Result struct {
+	// 客户端请求的原始目标地址
+	Addr string
+
+	// 应用层协议，数据不足以识别时为 ProtocolUnknown
+	Protocol Protocol
+	// tls SNI 或 http Host，不含端口，未能取得时为空
+	Domain string
+}
+
+type resultKey struct{}
+
+// 将嗅探结果附加到 ctx，供 SiteTcpDialContext 等函数使用
+func NewContext(ctx context.Context, r *Result) context.Context {
+	return context.WithValue(ctx, resultKey{}, r)
+}
+
+// 取得附加到 ctx 的嗅探结果，没有时返回 nil
+func FromContext(ctx context.Context) *Result {
+	r, _ := ctx.Value(resultKey{}).(*Result)
+	return r
+}
+
+// 数据不完整，需要继续读取
+var ErrNeedMore = errors.New("need more data")
+
+// 嗅探 c 上客户端发出的第一块数据
+// 等待客户端数据最多 timeout，超时(例如网站先发出数据的协议)时返回已读到的部分。
+// 返回的连接会先重放已读取的数据，之后应使用返回的连接代替 c。
+func Sniff(c net.Conn, timeout time.Duration) (*Result, net.Conn) {
+	r := &Result{}
+
+	if timeout != 0 {
+		_ = c.SetReadDeadline(time.Now().Add(timeout))
+		defer c.SetReadDeadline(time.Time{})
+	}
+
+	buf := make([]byte, maxSniffSize)
+	n := 0
+	for n < len(buf) {
+		m, err := c.Read(buf[n:])
+		n += m
+
+		if m > 0 && parse(buf[:n], r) != ErrNeedMore {
+			break
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	return r, goio.NewPrefixConn(c, buf[:n])
+}
+
+// 解析数据，数据不完整时返回 ErrNeedMore
+func parse(b []byte, r *Result) error {
+	switch {
+	case b[0] == 0x16 && (len(b) < 2 || b[1] == 3):
+		r.Protocol = ProtocolTLS
+
+		hello, _, err := tlsinfo.ReadClientHello(bytes.NewReader(b))
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrNeedMore
+		}
+		if err != nil {
+			return err
+		}
+
+		r.Domain = hello.ServerName
+		return nil
+
+	// 需要在 http 方法前检查，"PRI" 与 "POST" 等方法开头相同
+	case hasPrefix(b, http2Preface):
+		if len(b) < len(http2Preface) {
+			return ErrNeedMore
+		}
+		r.Protocol = ProtocolHTTP2
+		return nil
+
+	case hasPrefix(b, sshPrefix):
+		if len(b) < len(sshPrefix) {
+			return ErrNeedMore
+		}
+		r.Protocol = ProtocolSSH
+		return nil
+
+	case hasPrefix(b, bitTorrentHandshake):
+		if len(b) < len(bitTorrentHandshake) {
+			return ErrNeedMore
+		}
+		r.Protocol = ProtocolBitTorrent
+		return nil
+
+	case isHttpMethodPrefix(b):
+		r.Protocol = ProtocolHTTP
+
+		// 只需要请求头
+		if bytes.Contains(b, []byte("\r\n\r\n")) == false {
+			return ErrNeedMore
+		}
+
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+		if err != nil {
+			return err
+		}
+
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+
+		// ip 不是域名
+		if net.ParseIP(host) == nil {
+			r.Domain = host
+		}
+		return nil
+	}
+
+	return nil
+}
+
+var httpMethods = []string{
+	"GET ", "POST ", "HEAD ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "TRACE ", "CONNECT ",
+}
+
+// b 是否以 http 方法开头，数据不完整时只比较已有部分
+func isHttpMethodPrefix(b []byte) bool {
+	for _, m := range httpMethods {
+		if hasPrefix(b, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// b 是否以 prefix 开头，数据不完整时只比较已有部分
+func hasPrefix(b []byte, prefix string) bool {
+	l := len(prefix)
+	if len(b) < l {
+		l = len(b)
+	}
+	return string(b[:l]) == prefix[:l]
+}
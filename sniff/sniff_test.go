@@ -0,0 +1,94 @@
+package sniff
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSniff(t *testing.T) {
+	t.Run("tls", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+
+		go func() {
+			_ = tls.Client(client, &tls.Config{ServerName: "www.example.com"}).Handshake()
+		}()
+
+		r, c := Sniff(server, time.Second)
+		if r.Protocol != ProtocolTLS || r.Domain != "www.example.com" {
+			t.Fatalf("r = %#v", r)
+		}
+
+		// 数据没有被消耗
+		b := make([]byte, 1)
+		_, err := c.Read(b)
+		if err != nil || b[0] != 0x16 {
+			t.Fatalf("b = %v, err = %v", b, err)
+		}
+	})
+
+	t.Run("http", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer server.Close()
+
+		request := "GET / HTTP/1.1\r\nHost: www.example.com:8080\r\n\r\nbody"
+		go func() {
+			// 分两次发出
+			_, _ = client.Write([]byte(request[:10]))
+			_, _ = client.Write([]byte(request[10:]))
+			_ = client.Close()
+		}()
+
+		r, c := Sniff(server, time.Second)
+		if r.Protocol != ProtocolHTTP || r.Domain != "www.example.com" {
+			t.Fatalf("r = %#v", r)
+		}
+
+		data, _ := ioutil.ReadAll(c)
+		if string(data) != request {
+			t.Fatalf("data = %q", data)
+		}
+	})
+
+	t.Run("protocol", func(t *testing.T) {
+		for _, v := range []struct {
+			data     string
+			protocol Protocol
+		}{
+			{"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", ProtocolHTTP2},
+			{"POST / HTTP/1.1\r\nHost: a.com\r\n\r\n", ProtocolHTTP},
+			{"SSH-2.0-OpenSSH_8.9\r\n", ProtocolSSH},
+			{"\x13BitTorrent protocol\x00\x00\x00\x00\x00\x10\x00\x05", ProtocolBitTorrent},
+			{"\x00\x01\x02\x03", ProtocolUnknown},
+		} {
+			client, server := net.Pipe()
+
+			go func() {
+				_, _ = client.Write([]byte(v.data))
+			}()
+
+			r, _ := Sniff(server, 100*time.Millisecond)
+			if r.Protocol != v.protocol {
+				t.Errorf("%q: protocol = %v", v.data, r.Protocol)
+			}
+
+			_ = client.Close()
+			_ = server.Close()
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+
+		r, _ := Sniff(server, 50*time.Millisecond)
+		if r.Protocol != ProtocolUnknown || len(r.Domain) != 0 {
+			t.Fatalf("r = %#v", r)
+		}
+	})
+}
@@ -0,0 +1,235 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// socks 地址
+// 保存 ipv4、ipv6 或域名及端口，实现了 net.Addr，域名不需要解析即可在 cmd、udp 包及 UdpConn 之间传递。
+type Addr struct {
+	Atyp Socks5AtypType
+	// Atyp 为 ipv4 时长度为 4，ipv6 时长度为 16
+	IP net.IP
+	// Atyp 为域名时使用
+	Domain string
+	Port   uint16
+}
+
+// 解析 host:port 格式的地址，host 不是 ip 时作为域名
+func ParseAddr(addr string) (*Addr, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	if port < 0 || port > 0xFFFF {
+		return nil, fmt.Errorf("port %v < 0 || port %v > 0xFFFF", port, port)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return NewIPAddr(ip, port)
+	}
+
+	return NewDomainAddr(host, port)
+}
+
+func NewIPAddr(ip net.IP, port int) (*Addr, error) {
+	a := Addr{Port: uint16(port)}
+
+	if ipv4 := ip.To4(); len(ipv4) == net.IPv4len {
+		a.Atyp = Socks5CmdAtypTypeIP4
+		a.IP = ipv4
+		return &a, nil
+	}
+
+	if ipv6 := ip.To16(); len(ipv6) == net.IPv6len {
+		a.Atyp = Socks5CmdAtypTypeIP6
+		a.IP = ipv6
+		return &a, nil
+	}
+
+	return nil, fmt.Errorf("%v is not ipv4 or ipv6 address", ip)
+}
+
+func NewDomainAddr(domain string, port int) (*Addr, error) {
+	if len(domain) == 0 || len(domain) > 0xFF {
+		return nil, fmt.Errorf("domain %v length is incorrect", domain)
+	}
+
+	return &Addr{
+		Atyp:   Socks5CmdAtypTypeDomain,
+		Domain: domain,
+		Port:   uint16(port),
+	}, nil
+}
+
+// 转换 *Addr、*net.UDPAddr、*net.TCPAddr，其他类型按 host:port 解析
+func AddrFromNetAddr(addr net.Addr) (*Addr, error) {
+	switch a := addr.(type) {
+	case *Addr:
+		return a, nil
+	case *net.UDPAddr:
+		return NewIPAddr(a.IP, a.Port)
+	case *net.TCPAddr:
+		return NewIPAddr(a.IP, a.Port)
+	case nil:
+		return nil, fmt.Errorf("addr is nil")
+	default:
+		return ParseAddr(a.String())
+	}
+}
+
+func (a *Addr) Network() string {
+	return "socks5"
+}
+
+func (a *Addr) String() string {
+	return net.JoinHostPort(a.Host(), strconv.Itoa(int(a.Port)))
+}
+
+// 域名或 ip 字符串
+func (a *Addr) Host() string {
+	if a.Atyp == Socks5CmdAtypTypeDomain {
+		return a.Domain
+	}
+	return a.IP.String()
+}
+
+func (a *Addr) IsDomain() bool {
+	return a.Atyp == Socks5CmdAtypTypeDomain
+}
+
+// 地址是 ip 时返回 *net.UDPAddr，域名时返回 nil
+func (a *Addr) UDPAddr() *net.UDPAddr {
+	if a.IsDomain() {
+		return nil
+	}
+	return &net.UDPAddr{IP: a.IP, Port: int(a.Port)}
+}
+
+// 编码后的长度
+func (a *Addr) Size() int {
+	switch a.Atyp {
+	case Socks5CmdAtypTypeIP4:
+		return 1 + net.IPv4len + 2
+	case Socks5CmdAtypTypeIP6:
+		return 1 + net.IPv6len + 2
+	default:
+		return 1 + 1 + len(a.Domain) + 2
+	}
+}
+
+// 按 ATYP、地址、端口 格式编码并追加到 b
+func (a *Addr) Append(b []byte) ([]byte, error) {
+	b = append(b, byte(a.Atyp))
+
+	switch a.Atyp {
+	case Socks5CmdAtypTypeIP4:
+		if len(a.IP) != net.IPv4len {
+			return nil, fmt.Errorf("ipv4 %v length is incorrect", a.IP)
+		}
+		b = append(b, a.IP...)
+	case Socks5CmdAtypTypeIP6:
+		if len(a.IP) != net.IPv6len {
+			return nil, fmt.Errorf("ipv6 %v length is incorrect", a.IP)
+		}
+		b = append(b, a.IP...)
+	case Socks5CmdAtypTypeDomain:
+		if len(a.Domain) > 0xFF {
+			return nil, fmt.Errorf("domain %v is too long", a.Domain)
+		}
+		b = append(b, byte(len(a.Domain)))
+		b = append(b, a.Domain...)
+	default:
+		return nil, fmt.Errorf("unexpected atyp %v", a.Atyp)
+	}
+
+	return append(b, byte(a.Port>>8), byte(a.Port)), nil
+}
+
+// 从 data 开头解析 ATYP、地址、端口，返回使用的字节数
+func ParseAddrBytes(data []byte) (*Addr, int, error) {
+	if len(data) < 1 {
+		return nil, 0, fmt.Errorf("data length is too short")
+	}
+
+	a := Addr{Atyp: Socks5AtypType(data[0])}
+	n := 1
+
+	switch a.Atyp {
+	case Socks5CmdAtypTypeIP4, Socks5CmdAtypTypeIP6:
+		l := net.IPv4len
+		if a.Atyp == Socks5CmdAtypTypeIP6 {
+			l = net.IPv6len
+		}
+		if len(data) < n+l+2 {
+			return nil, 0, fmt.Errorf("data length is too short")
+		}
+		a.IP = append(net.IP(nil), data[n:n+l]...)
+		n += l
+	case Socks5CmdAtypTypeDomain:
+		if len(data) < 2 || len(data) < 2+int(data[1])+2 {
+			return nil, 0, fmt.Errorf("data length is too short")
+		}
+		a.Domain = string(data[2 : 2+int(data[1])])
+		n += 1 + int(data[1])
+	default:
+		return nil, 0, fmt.Errorf("unexpected atyp %v", a.Atyp)
+	}
+
+	a.Port = binary.BigEndian.Uint16(data[n:])
+
+	return &a, n + 2, nil
+}
+
+// 从 r 读取 ATYP、地址、端口
+func ReadAddr(r io.Reader) (*Addr, error) {
+	atyp := [1]byte{}
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return nil, fmt.Errorf("failed to read atyp, %v", err)
+	}
+
+	return readAddr(r, Socks5AtypType(atyp[0]))
+}
+
+// 已经读取了 atyp，从 r 读取地址、端口
+func readAddr(r io.Reader, atyp Socks5AtypType) (*Addr, error) {
+	buf := make([]byte, MaxSocks5UdpHeaderSize)
+	buf[0] = byte(atyp)
+
+	var size int
+	switch atyp {
+	case Socks5CmdAtypTypeIP4:
+		size = 1 + net.IPv4len + 2
+	case Socks5CmdAtypTypeIP6:
+		size = 1 + net.IPv6len + 2
+	case Socks5CmdAtypTypeDomain:
+		if _, err := io.ReadFull(r, buf[1:2]); err != nil {
+			return nil, fmt.Errorf("failed to read domain length, %v", err)
+		}
+		size = 1 + 1 + int(buf[1]) + 2
+	default:
+		return nil, fmt.Errorf("unexpected address type %v", atyp)
+	}
+
+	start := 1
+	if atyp == Socks5CmdAtypTypeDomain {
+		start = 2
+	}
+
+	if _, err := io.ReadFull(r, buf[start:size]); err != nil {
+		return nil, fmt.Errorf("failed to read addr, %v", err)
+	}
+
+	a, _, err := ParseAddrBytes(buf[:size])
+	return a, err
+}
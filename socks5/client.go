@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net"
 	"time"
 )
 
@@ -58,6 +59,111 @@ func ClientTcpConn(ctx context.Context, conf *ClientConfig,
 	//	_ = socks5ServerConn.SetDeadline(time.Now().Add(conf.Socks5ShakeHandsTimeout))
 	//}
 
+	err = clientAuth(conf, socks5ServerConn)
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Write(socks5ServerConn)
+	if err != nil {
+		return fmt.Errorf("cmd.write, %v", err)
+	}
+
+	cmdR := Socks5CmdPack{}
+	err = cmdR.Read(socks5ServerConn)
+	if err != nil {
+		return fmt.Errorf("cmdR.read, %v", err)
+	}
+
+	switch cmdR.Cmd {
+	case Socks5CmdReplySucceeded:
+		return nil
+	default:
+		return fmt.Errorf("the server failed to connect to %v, status = %v", addr, cmdR.Cmd)
+	}
+}
+
+// 使用到服务器的连接完成鉴定及 UDP ASSOCIATE，返回服务器回复的 udp 中继地址
+// laddr 为客户端发出 udp 包使用的地址，为 nil 时发送 0.0.0.0:0 ，表示不限制来源
+// 中继地址的 ip 可能为 0，这时应使用代理服务器的 ip。
+// 返回后 socks5ServerConn 需要保持打开，关闭时服务器会结束 udp 关联。
+func ClientUdpAssociate(ctx context.Context, conf *ClientConfig,
+	socks5ServerConn io.ReadWriter, laddr *Addr) (*Addr, error) {
+	return clientUdpCmd(ctx, conf, socks5ServerConn, Socks5CmdTypeUdpAssociate, laddr)
+}
+
+// 使用到服务器的连接完成鉴定及 udp over tcp 私有命令
+// 成功后 udp 包经 socks5ServerConn 传输，使用 NewUdpOverTcpConn 建立 UdpConn。
+// 服务器不支持时回复 Socks5CmdReplyCommandNotSupported。
+func ClientUdpOverTcp(ctx context.Context, conf *ClientConfig, socks5ServerConn io.ReadWriter) error {
+	_, err := clientUdpCmd(ctx, conf, socks5ServerConn, Socks5CmdTypeUdpOverTcp, nil)
+	return err
+}
+
+func clientUdpCmd(ctx context.Context, conf *ClientConfig,
+	socks5ServerConn io.ReadWriter, cmdType Socks5CmdType, laddr *Addr) (*Addr, error) {
+
+	if laddr == nil {
+		laddr = &Addr{Atyp: Socks5CmdAtypTypeIP4, IP: net.IPv4zero.To4(), Port: 0}
+	}
+
+	cmd := Socks5CmdPack{
+		Ver:  Socks5Version,
+		Cmd:  cmdType,
+		Rsv:  0,
+		Atyp: 0,
+		Host: nil,
+		Port: 0,
+	}
+
+	err := cmd.SetAddr(laddr)
+	if err != nil {
+		return nil, fmt.Errorf("laddr is incorrect, %v", err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// 调用方可能在 ctx 结束时关闭连接来中断握手，这时返回 ctx.Err()
+	err = clientAuth(conf, socks5ServerConn)
+	if err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+
+	err = cmd.Write(socks5ServerConn)
+	if err != nil {
+		return nil, ctxErr(ctx, fmt.Errorf("cmd.write, %v", err))
+	}
+
+	cmdR := Socks5CmdPack{}
+	err = cmdR.Read(socks5ServerConn)
+	if err != nil {
+		return nil, ctxErr(ctx, fmt.Errorf("cmdR.read, %v", err))
+	}
+
+	if cmdR.Cmd != Socks5CmdReplySucceeded {
+		return nil, fmt.Errorf("the server failed to associate udp, cmd = %v, status = %v", cmdType, cmdR.Cmd)
+	}
+
+	relayAddr, err := cmdR.GetAddr()
+	if err != nil {
+		return nil, fmt.Errorf("cmdR.GetAddr, %v", err)
+	}
+
+	return relayAddr, nil
+}
+
+// ctx 已结束时返回 ctx.Err()，否则返回 err
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// 完成 socks5 鉴定，conf 提供用户名密码时同时提供用户名密码鉴定方式
+func clientAuth(conf *ClientConfig, socks5ServerConn io.ReadWriter) error {
 	auth := Socks5AuthPack{
 		Ver:     5,
 		Methods: nil,
@@ -68,7 +174,7 @@ func ClientTcpConn(ctx context.Context, conf *ClientConfig,
 		auth.Methods = []Socks5AuthMethodType{Socks5AuthMethodTypeNone}
 	}
 
-	err = auth.Write(socks5ServerConn)
+	err := auth.Write(socks5ServerConn)
 	if err != nil {
 		return fmt.Errorf("auth.Write, %v", err)
 	}
@@ -111,21 +217,5 @@ func ClientTcpConn(ctx context.Context, conf *ClientConfig,
 		}
 	}
 
-	err = cmd.Write(socks5ServerConn)
-	if err != nil {
-		return fmt.Errorf("cmd.write, %v", err)
-	}
-
-	cmdR := Socks5CmdPack{}
-	err = cmdR.Read(socks5ServerConn)
-	if err != nil {
-		return fmt.Errorf("cmdR.read, %v", err)
-	}
-
-	switch cmdR.Cmd {
-	case Socks5CmdReplySucceeded:
-		return nil
-	default:
-		return fmt.Errorf("the server failed to connect to %v, status = %v", addr, cmdR.Cmd)
-	}
+	return nil
 }
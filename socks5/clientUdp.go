@@ -1,9 +1,11 @@
 package socks5
 
 import (
+	"context"
 	"fmt"
 	"net"
-	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gamexg/proxylib/mempool"
@@ -15,18 +17,75 @@ import (
 type UdpClient struct {
 	proxyType string // 只支持  socks5
 	proxyAddr string
+	conf      *UdpClientConfig
+
+	// udp 包最大负载，为 0 时使用 MaxUdpDatagramSize
+	MaxDatagramSize int
+
+	// 在 UDP ASSOCIATE 请求中提供本地 udp 地址(tcp 控制连接的本地 ip 及 udp 端口)
+	// 服务器会只接受这个地址发出的包。经过 nat 时服务器看到的地址不同，不能启用。
+	BindLocalAddr bool
+
+	// 将 tcp 控制连接的本地端口放入 udp 包的 RSV 字段
+	// 服务器使用共用 udp 端口(UdpSharedListener)时据此区分 udp 关联，
+	// 不支持的服务器可能丢弃 RSV 非 0 的包。
+	UdpToken bool
+
+	// 使用私有命令 Socks5CmdTypeUdpOverTcp，udp 包经 tcp 控制连接传输，用于 udp 被阻断的网络
+	// 需要服务器支持(ServerConfig.UdpOverTcp)。
+	UdpOverTcp bool
+
+	// DnsExchange 复用的 udp 关联，键为上游地址
+	dnsM            sync.Mutex
+	dnsAssociations map[string]*dnsAssociation
+	// 正在建立的关联
+	dnsDials map[string]*dnsAssociationDial
 }
 
 type UdpConn struct {
 	tcpConn net.Conn
-	udpConn *net.UDPConn
-	hasDst  bool   // 客户使用 Dial 提供目标地址时为 true，并在 dst 内保存目标地址。
-	dstHost string // 客户提供的目标地址，可能是ip
-	dstIp   net.IP // 当客户提供的目标地址是ip时本值存在，可以保证ipv4是4位。
-	dstPort int
+	udpConn net.PacketConn
+	// 服务器的 udp 中继地址
+	relayAddr net.Addr
+	// 客户使用 Dial 提供的目标地址，Listen 建立时为 nil
+	dst *Addr
+
+	maxDatagramSize int
+	// 发出的 udp 包的 RSV 字段
+	rsv uint16
+}
+
+type UdpClientConfig struct {
+	// 用户名密码及握手超时
+	ClientConfig
+
+	// 建立到代理服务器的 tcp 控制连接
+	// 可以经过其他代理或使用自定义的 socket
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func (c *UdpClientConfig) Default() {
+	d := net.Dialer{}
+
+	*c = UdpClientConfig{
+		ClientConfig: ClientConfig{
+			Socks5AuthUsername:      "",
+			Socks5AuthPassword:      "",
+			Socks5ShakeHandsTimeout: 10 * time.Second,
+			Socks5CmdRTimeout:       10 * time.Second,
+		},
+		DialContext: d.DialContext,
+	}
 }
 
 func NewUdpClient(proxyType, proxyAddr string) (*UdpClient, error) {
+	conf := UdpClientConfig{}
+	conf.Default()
+
+	return NewUdpClientWithConfig(proxyType, proxyAddr, &conf)
+}
+
+func NewUdpClientWithConfig(proxyType, proxyAddr string, conf *UdpClientConfig) (*UdpClient, error) {
 	switch proxyType {
 	case "socks5":
 		break
@@ -34,52 +93,52 @@ func NewUdpClient(proxyType, proxyAddr string) (*UdpClient, error) {
 		return nil, fmt.Errorf("不支持的 proxyType %v 。", proxyType)
 	}
 
+	if conf.DialContext == nil {
+		return nil, fmt.Errorf("DialContext cannot be empty")
+	}
+
 	return &UdpClient{
 		proxyType: proxyType,
 		proxyAddr: proxyAddr,
+		conf:      conf,
 	}, nil
 }
 
-// todo read 现在未拦截不正确的 addr 来源的包
+// 建立发往 addr 的 udp 关联，返回的 UdpConn 可以作为 net.Conn 使用
+// Read 只返回 addr 发来的包
 func (c *UdpClient) Dial(network, addr string) (*UdpConn, error) {
+	return c.DialContext(context.Background(), network, addr)
+}
+
+func (c *UdpClient) DialContext(ctx context.Context, network, addr string) (*UdpConn, error) {
 	// 建立 tcp连接，完成握手
 	// 然后本地建立端口
 	// 返回给客户结构体。
 
-	host, port, err := net.SplitHostPort(addr)
-	if err != nil {
-		return nil, err
-	}
-
-	portInt, err := strconv.Atoi(port)
+	dst, err := ParseAddr(addr)
 	if err != nil {
 		return nil, err
 	}
 
-	ip := net.ParseIP(host)
-
-	if ip != nil {
-		if ipv4 := ip.To4(); len(ipv4) == net.IPv4len {
-			ip = ipv4
-		}
-	}
-
-	conn, err := c.Listen(network)
+	conn, err := c.ListenContext(ctx, network)
 	if err != nil {
 		return nil, err
 	}
 
-	conn.hasDst = true
-	conn.dstHost = host
-	conn.dstIp = ip
-	conn.dstPort = portInt
+	conn.dst = dst
 
 	return conn, nil
 }
 
 func (c *UdpClient) Listen(network string) (*UdpConn, error) {
+	return c.ListenContext(context.Background(), network)
+}
+
+// 建立 udp 关联
+// ctx 只用于建立过程，udp 关联建立后取消 ctx 不会关闭连接
+func (c *UdpClient) ListenContext(ctx context.Context, network string) (*UdpConn, error) {
 	switch network {
-	case "udp", "udp4":
+	case "udp", "udp4", "udp6":
 		break
 	default:
 		return nil, fmt.Errorf("不支持的 network %v 。", network)
@@ -92,9 +151,17 @@ func (c *UdpClient) Listen(network string) (*UdpConn, error) {
 		return nil, fmt.Errorf("不支持的 proxyType %v。", c.proxyType)
 	}
 
-	proxyServerConn, err := net.Dial("tcp", c.proxyAddr)
+	conf := c.conf
+
+	if conf.Socks5ShakeHandsTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, conf.Socks5ShakeHandsTimeout)
+		defer cancel()
+	}
+
+	proxyServerConn, err := conf.DialContext(ctx, "tcp", c.proxyAddr)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("DialContext, %v", err)
 	}
 	cancel := true
 	defer func() {
@@ -103,133 +170,364 @@ func (c *UdpClient) Listen(network string) (*UdpConn, error) {
 		}
 	}()
 
-	proxyServerTcpConn, _ := proxyServerConn.(*net.TCPConn)
-	if proxyServerTcpConn == nil {
-		return nil, fmt.Errorf("proxyServerTcpConn  == nil")
+	// 握手期间 ctx 被取消时关闭连接，中断读写
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			_ = proxyServerConn.Close()
+		case <-done:
+		}
+	}()
+
+	// 不按 ctx 设置连接的超时，否则超时返回的是 i/o timeout 而不是 ctx.Err()
+	var udpConn net.PacketConn
+	var relayAddr *net.UDPAddr
+	if c.UdpOverTcp {
+		if t := conf.Socks5CmdRTimeout; t > 0 {
+			deadline := time.Now().Add(t)
+			if d, ok := ctx.Deadline(); ok == false || deadline.Before(d) {
+				_ = proxyServerConn.SetReadDeadline(deadline)
+			}
+		}
+		err = ClientUdpOverTcp(ctx, &conf.ClientConfig, proxyServerConn)
+	} else {
+		udpConn, relayAddr, err = c.associate(ctx, proxyServerConn, network)
 	}
 
-	_ = proxyServerTcpConn.SetDeadline(time.Now().Add(10 * time.Second))
+	close(done)
+	<-exited
 
-	//发送 socks5鉴定 + cmd
-	auth := Socks5AuthPack{
-		Ver:     Socks5Version,
-		Methods: []Socks5AuthMethodType{Socks5AuthMethodTypeNone},
+	if ctx.Err() != nil {
+		if udpConn != nil {
+			_ = udpConn.Close()
+		}
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	cmd := Socks5CmdPack{
-		Ver:  Socks5Version,
-		Cmd:  Socks5CmdTypeUdpAssociate,
-		Rsv:  0,
-		Atyp: Socks5CmdAtypTypeIP4,
-		Host: []byte{0, 0, 0, 0},
-		Port: 0,
+	if tcpConn, _ := proxyServerConn.(*net.TCPConn); tcpConn != nil {
+		_ = tcpConn.SetKeepAlivePeriod(2 * time.Minute)
+		_ = tcpConn.SetKeepAlive(true)
 	}
 
-	err = auth.Write(proxyServerTcpConn)
-	if err != nil {
-		return nil, err
+	var conn *UdpConn
+	if c.UdpOverTcp {
+		conn = NewUdpOverTcpConn(proxyServerConn)
+	} else {
+		conn = NewUdpConn(proxyServerConn, udpConn, relayAddr)
 	}
+	conn.maxDatagramSize = c.maxDatagramSize()
 
-	err = cmd.Write(proxyServerTcpConn)
-	if err != nil {
-		return nil, err
+	if c.UdpToken {
+		if addr, _ := proxyServerConn.LocalAddr().(*net.TCPAddr); addr != nil {
+			conn.rsv = uint16(addr.Port)
+		}
 	}
 
-	authR := Socks5AuthRPack{}
+	cancel = false
+	return conn, nil
+}
 
-	err = authR.Read(proxyServerTcpConn)
-	if err != nil {
-		return nil, err
+// 使用已完成 UDP ASSOCIATE 的控制连接 tcpConn 及 udpConn 建立 UdpConn
+// 发出的包经 udpConn 发往 relayAddr，只接收 relayAddr 发来的包。
+// tcpConn 可以是经过其他代理或 tls 的连接，udpConn 可以是任意 net.PacketConn，
+// 例如使用 ClientUdpAssociate 完成握手后调用本函数。
+// tcpConn 关闭时 udpConn 也会被关闭，UdpConn 关闭时会关闭两者。
+func NewUdpConn(tcpConn net.Conn, udpConn net.PacketConn, relayAddr net.Addr) *UdpConn {
+	c := &UdpConn{
+		tcpConn:   tcpConn,
+		udpConn:   udpConn,
+		relayAddr: relayAddr,
+		dst:       nil,
+
+		maxDatagramSize: MaxUdpDatagramSize,
+		rsv:             0,
 	}
 
-	if authR.Method != Socks5AuthMethodTypeNone {
-		return nil, fmt.Errorf("不支持服务端的鉴定方法 %v 。", authR.Method)
+	go func() {
+		_ = tcpConn.SetDeadline(time.Time{})
+
+		buf := make([]byte, 1)
+		_, err := tcpConn.Read(buf)
+		if err != nil {
+			_ = udpConn.Close()
+			_ = tcpConn.Close()
+			return
+		}
+	}()
+
+	return c
+}
+
+// 使用已完成 udp over tcp 私有命令的控制连接 tcpConn 建立 UdpConn，见 ClientUdpOverTcp
+// 使用方法与 udp 关联相同，关闭 UdpConn 时关闭 tcpConn。
+func NewUdpOverTcpConn(tcpConn net.Conn) *UdpConn {
+	_ = tcpConn.SetDeadline(time.Time{})
+
+	relayAddr := udpOverTcpAddr{}
+
+	return &UdpConn{
+		tcpConn:   tcpConn,
+		udpConn:   newUdpOverTcpConn(tcpConn, relayAddr),
+		relayAddr: relayAddr,
+		dst:       nil,
+
+		maxDatagramSize: MaxUdpDatagramSize,
+		rsv:             0,
 	}
+}
 
-	cmdR := Socks5CmdPack{}
+// 在 tcp 控制连接上完成鉴定及 UDP ASSOCIATE，返回本地 udp 连接及服务器的 udp 中继地址
+func (c *UdpClient) associate(ctx context.Context, proxyServerConn net.Conn, network string) (net.PacketConn, *net.UDPAddr, error) {
+	// 先建立本地 udp 连接，BindLocalAddr 时需要在 cmd 中提供本地地址
+	// 未指定地址时，"udp" 在支持的系统上是双栈的
+	var laddr *net.UDPAddr
+	if c.BindLocalAddr {
+		tcpLocalAddr, _ := proxyServerConn.LocalAddr().(*net.TCPAddr)
+		if tcpLocalAddr == nil {
+			return nil, nil, fmt.Errorf("非预期的 tcp 本地地址, %#v", proxyServerConn.LocalAddr())
+		}
+		laddr = &net.UDPAddr{IP: tcpLocalAddr.IP, Zone: tcpLocalAddr.Zone}
+	}
 
-	err = cmdR.Read(proxyServerTcpConn)
+	udpConn, err := net.ListenUDP(network, laddr)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	ok := false
+	defer func() {
+		if ok == false {
+			udpConn.Close()
+		}
+	}()
+
+	var cmdAddr *Addr
+	switch {
+	case c.BindLocalAddr:
+		localAddr := udpConn.LocalAddr().(*net.UDPAddr)
+		cmdAddr, err = NewIPAddr(localAddr.IP, localAddr.Port)
+		if err != nil {
+			return nil, nil, err
+		}
+	case network == "udp6":
+		cmdAddr = &Addr{Atyp: Socks5CmdAtypTypeIP6, IP: net.IPv6zero, Port: 0}
 	}
 
-	if cmdR.Cmd != Socks5CmdReplySucceeded {
-		return nil, fmt.Errorf("服务器回复 cmd:%v", cmdR.Cmd)
+	if t := c.conf.Socks5CmdRTimeout; t > 0 {
+		deadline := time.Now().Add(t)
+		if d, ok := ctx.Deadline(); ok == false || deadline.Before(d) {
+			_ = proxyServerConn.SetReadDeadline(deadline)
+		}
 	}
 
-	cmdRAddr, err := cmdR.GetAddrString()
+	bndAddr, err := ClientUdpAssociate(ctx, &c.conf.ClientConfig, proxyServerConn, cmdAddr)
 	if err != nil {
-		return nil, fmt.Errorf("cmdR.GetAddrString, %v", err)
+		return nil, nil, err
 	}
 
-	udpConn, err := net.Dial("udp", cmdRAddr)
+	relayAddr, err := c.getUdpRelayAddr(ctx, bndAddr)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	go func() {
-		_ = proxyServerTcpConn.SetKeepAlivePeriod(2 * time.Minute)
-		_ = proxyServerTcpConn.SetKeepAlive(true)
-		_ = proxyServerTcpConn.SetDeadline(time.Time{})
+	switch {
+	case network == "udp4" && relayAddr.IP.To4() == nil:
+		return nil, nil, fmt.Errorf("服务器回复了 ipv6 udp 地址 %v", relayAddr)
+	case network == "udp6" && relayAddr.IP.To4() != nil:
+		return nil, nil, fmt.Errorf("服务器回复了 ipv4 udp 地址 %v", relayAddr)
+	}
 
-		buf := make([]byte, 1)
-		_, err := proxyServerTcpConn.Read(buf)
+	ok = true
+	return udpConn, relayAddr, nil
+}
+
+// 取得服务器回复的 udp 中继地址
+// 服务器回复的 ip 为 0 时使用代理服务器地址的 ip，tcp 控制连接可能经过其他代理，不能使用它的远端地址
+func (c *UdpClient) getUdpRelayAddr(ctx context.Context, bndAddr *Addr) (*net.UDPAddr, error) {
+	ip := bndAddr.IP
+	if bndAddr.IsDomain() {
+		ipAddr, err := net.DefaultResolver.LookupIPAddr(ctx, bndAddr.Domain)
 		if err != nil {
-			_ = udpConn.Close()
-			_ = proxyServerTcpConn.Close()
-			return
+			return nil, fmt.Errorf("LookupIPAddr, %v", err)
 		}
-	}()
+		if len(ipAddr) == 0 {
+			return nil, fmt.Errorf("%v 没有 ip", bndAddr.Domain)
+		}
+		ip = ipAddr[0].IP
+	}
 
-	cancel = false
-	return &UdpConn{
-		tcpConn: proxyServerTcpConn,
-		udpConn: udpConn.(*net.UDPConn),
-		hasDst:  false,
-	}, nil
+	addr := &net.UDPAddr{IP: ip, Port: int(bndAddr.Port)}
+
+	if ip.IsUnspecified() {
+		host, _, err := net.SplitHostPort(c.proxyAddr)
+		if err != nil {
+			return nil, fmt.Errorf("net.SplitHostPort, %v", err)
+		}
+
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, fmt.Errorf("LookupIPAddr, %v", err)
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("%v 没有 ip", host)
+		}
+
+		addr.IP = ips[0].IP
+		addr.Zone = ips[0].Zone
+	}
+
+	return addr, nil
 }
 
-func (c *UdpConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
-	buf := mempool.Get(2048)
+func (c *UdpClient) maxDatagramSize() int {
+	if n := c.MaxDatagramSize; n > 0 && n < MaxUdpDatagramSize {
+		return n
+	}
+	return MaxUdpDatagramSize
+}
+
+// 读取中继发来的一个 socks5 udp 包，忽略其他来源的包
+func (c *UdpConn) readPacket(buf []byte) (int, error) {
+	for {
+		n, addr, err := c.udpConn.ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+
+		if isSameAddr(addr, c.relayAddr) {
+			return n, nil
+		}
+	}
+}
+
+// *net.UDPAddr 比较 ip 及端口，ipv4 与 ipv4 映射的 ipv6 地址相同，其他类型比较字符串
+func isSameAddr(a, b net.Addr) bool {
+	ua, _ := a.(*net.UDPAddr)
+	ub, _ := b.(*net.UDPAddr)
+	if ua != nil && ub != nil {
+		return ua.Port == ub.Port && ua.IP.Equal(ub.IP)
+	}
+
+	return a != nil && b != nil && a.String() == b.String()
+}
+
+// 读取一个包，将负载复制到 b
+// match 不为 nil 时跳过 match 返回 false 的包，返回的 pack 不包含 Data
+func (c *UdpConn) readFrom(b []byte, match func(pack *Socks5UdpPack) bool) (int, *Socks5UdpPack, error) {
+	buf := mempool.Get(MaxSocks5UdpHeaderSize + c.maxDatagramSize)
 	defer mempool.Put(buf)
 
-	n, err := c.udpConn.Read(buf)
+	for {
+		n, err := c.readPacket(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		pack := Socks5UdpPack{}
+
+		err = pack.ParseNoCopy(buf[:n])
+		if err != nil {
+			// 格式错误的包可能是伪造的，跳过，不中断调用方的读取
+			continue
+		}
+
+		if match != nil && match(&pack) == false {
+			continue
+		}
+
+		size := copy(b, pack.Data)
+
+		// Data 引用了 buf，buf 返回后会被复用
+		pack.Data = nil
+
+		return size, &pack, nil
+	}
+}
+
+// 读取一个包，来源地址保留服务器发来的格式，域名不会被解析
+func (c *UdpConn) ReadFromAddr(b []byte) (int, *Addr, error) {
+	size, pack, err := c.readFrom(b, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	addr, err := pack.GetAddr()
 	if err != nil {
 		return 0, nil, err
 	}
 
-	pack := Socks5UdpPack{}
+	return size, addr, nil
+}
 
-	err = pack.Parse(buf[:n])
+// 来源地址是域名时无法表示为 *net.UDPAddr，返回错误，这个包被丢弃
+// 服务器可能以域名回应时请使用 ReadFrom 或 ReadFromAddr
+func (c *UdpConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	size, addr, err := c.ReadFromAddr(b)
 	if err != nil {
 		return 0, nil, err
 	}
 
-	// 将域名转换为 ip
-	// 如果域名、ip都没有，那么 addr 结果是 nil
-	if len(pack.Ip) == 0 && len(pack.Host) != 0 {
-		ips, err := net.LookupIP(pack.Host)
-		if err == nil && len(ips) > 0 {
-			pack.Ip = ips[0]
-		}
+	if addr.IsDomain() {
+		return 0, nil, fmt.Errorf("source address %v is a domain, use ReadFrom or ReadFromAddr", addr)
+	}
+
+	return size, addr.UDPAddr(), nil
+}
+
+// pack 是否来自 Dial 提供的目标地址
+// 目标是域名时，服务器可能使用域名或解析出的 ip 回应，回应为 ip 时只检查端口
+func (c *UdpConn) isDst(pack *Socks5UdpPack) bool {
+	if pack.Port != c.dst.Port {
+		return false
 	}
 
-	udpAddr := net.UDPAddr{
-		IP:   pack.Ip,
-		Port: int(pack.Port),
+	if c.dst.IsDomain() == false {
+		return pack.Ip.Equal(c.dst.IP)
 	}
 
-	size := len(pack.Data)
-	if size > len(b) {
-		size = len(b)
+	if len(pack.Ip) != 0 {
+		return true
 	}
 
-	copy(b[:size], pack.Data[:size])
+	return strings.EqualFold(pack.Host, c.dst.Domain)
+}
+
+// 读取 Dial 提供的目标地址发来的包，忽略其他来源的包
+func (c *UdpConn) Read(b []byte) (int, error) {
+	if c.dst == nil {
+		return 0, fmt.Errorf("UdpConn 不是由 Dial 建立的，请使用 ReadFrom")
+	}
 
-	return size, &udpAddr, nil
+	n, _, err := c.readFrom(b, c.isDst)
+	return n, err
 }
+
+// 向 Dial 提供的目标地址发送数据
+func (c *UdpConn) Write(b []byte) (int, error) {
+	if c.dst == nil {
+		return 0, fmt.Errorf("UdpConn 不是由 Dial 建立的，请使用 WriteTo")
+	}
+
+	return c.WriteTo(b, c.dst)
+}
+
+// 来源地址是 ip 时返回 *net.UDPAddr，域名时返回 *Addr
 func (c *UdpConn) ReadFrom(b []byte) (int, net.Addr, error) {
-	return c.ReadFromUDP(b)
+	n, addr, err := c.ReadFromAddr(b)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if addr.IsDomain() {
+		return n, addr, nil
+	}
+
+	return n, addr.UDPAddr(), nil
 }
 
 func (c *UdpConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
@@ -241,7 +539,7 @@ func (c *UdpConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
 	}
 
 	pack := Socks5UdpPack{
-		Rsv:  0,
+		Rsv:  c.rsv,
 		FRAG: 0,
 		ATYP: atyp,
 		Host: "",
@@ -250,7 +548,11 @@ func (c *UdpConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
 		Data: b,
 	}
 
-	buf := mempool.Get(2048)
+	if len(b) > c.maxDatagramSize {
+		return 0, fmt.Errorf("datagram is too large, %v", len(b))
+	}
+
+	buf := mempool.Get(MaxSocks5UdpHeaderSize + len(b))
 	defer mempool.Put(buf)
 
 	n, err := pack.To(buf)
@@ -258,15 +560,15 @@ func (c *UdpConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
 		return 0, err
 	}
 
-	_, err = c.udpConn.Write(buf[:n])
+	_, err = c.udpConn.WriteTo(buf[:n], c.relayAddr)
 	if err != nil {
 		return 0, err
 	}
-	return n, nil
+	return len(b), nil
 }
 func (c *UdpConn) WriteToDomain(b []byte, host string, port uint16) (int, error) {
 	pack := Socks5UdpPack{
-		Rsv:  0,
+		Rsv:  c.rsv,
 		FRAG: 0,
 		ATYP: Socks5CmdAtypTypeDomain, // 这里由于库使用处需要强制性发送 domain 格式，不能使用 auto
 		Host: host,
@@ -274,7 +576,11 @@ func (c *UdpConn) WriteToDomain(b []byte, host string, port uint16) (int, error)
 		Data: b,
 	}
 
-	buf := mempool.Get(2048)
+	if len(b) > c.maxDatagramSize {
+		return 0, fmt.Errorf("datagram is too large, %v", len(b))
+	}
+
+	buf := mempool.Get(MaxSocks5UdpHeaderSize + len(b))
 	defer mempool.Put(buf)
 
 	n, err := pack.To(buf)
@@ -282,20 +588,26 @@ func (c *UdpConn) WriteToDomain(b []byte, host string, port uint16) (int, error)
 		return 0, err
 	}
 
-	_, err = c.udpConn.Write(buf[:n])
+	_, err = c.udpConn.WriteTo(buf[:n], c.relayAddr)
 	if err != nil {
 		return 0, err
 	}
-	return n, nil
+	return len(b), nil
 }
 
+// addr 可以是 *net.UDPAddr 或 *Addr，*Addr 为域名时直接发送域名
 func (c *UdpConn) WriteTo(b []byte, addr net.Addr) (int, error) {
-	udpAddr, ok := addr.(*net.UDPAddr)
-	if !ok {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return c.WriteToUDP(b, a)
+	case *Addr:
+		if a.IsDomain() {
+			return c.WriteToDomain(b, a.Domain, a.Port)
+		}
+		return c.WriteToUDP(b, a.UDPAddr())
+	default:
 		return 0, fmt.Errorf("addr 不是udpAddr。")
 	}
-
-	return c.WriteToUDP(b, udpAddr)
 }
 
 func (c *UdpConn) Close() error {
@@ -312,3 +624,33 @@ func (c *UdpConn) Close() error {
 
 	return nil
 }
+
+// 本地 udp 地址
+func (c *UdpConn) LocalAddr() net.Addr {
+	return c.udpConn.LocalAddr()
+}
+
+// Dial 提供的目标地址，目标是 ip 时为 *net.UDPAddr，域名时为 *Addr，不是由 Dial 建立时为 nil
+func (c *UdpConn) RemoteAddr() net.Addr {
+	if c.dst == nil {
+		return nil
+	}
+
+	if c.dst.IsDomain() {
+		return c.dst
+	}
+
+	return c.dst.UDPAddr()
+}
+
+func (c *UdpConn) SetDeadline(t time.Time) error {
+	return c.udpConn.SetDeadline(t)
+}
+
+func (c *UdpConn) SetReadDeadline(t time.Time) error {
+	return c.udpConn.SetReadDeadline(t)
+}
+
+func (c *UdpConn) SetWriteDeadline(t time.Time) error {
+	return c.udpConn.SetWriteDeadline(t)
+}
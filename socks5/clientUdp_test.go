@@ -0,0 +1,462 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gamexg/proxylib/dns"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestUdpClient_Config(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	echo := NewEchoServer(&EchoServerConfig{UdpAddr: "127.0.0.1:0"})
+	err := echo.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		_ = echo.Serve()
+	}()
+	echoAddr := echo.udpConn.LocalAddr().(*net.UDPAddr)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := ServerConfig{}
+	conf.Default()
+	conf.Socks5AuthCheckMethod = func(a []Socks5AuthMethodType) Socks5AuthMethodType {
+		for _, v := range a {
+			if v == Socks5AuthMethodTypePassword {
+				return v
+			}
+		}
+		return Socks5AuthMethodTypeErr
+	}
+	conf.Socks5AuthCheckUserAndPassword = func(user, password string) error {
+		if user != "user" || password != "pass" {
+			return fmt.Errorf("user or password is incorrect")
+		}
+		return nil
+	}
+	go func() {
+		_ = ServerLinsten(ctx, ln, &conf)
+	}()
+
+	clientConf := UdpClientConfig{}
+	clientConf.Default()
+	dials := 0
+	dial := clientConf.DialContext
+	clientConf.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials++
+		return dial(ctx, network, addr)
+	}
+
+	client, err := NewUdpClientWithConfig("socks5", ln.Addr().String(), &clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 未提供密码
+	_, err = client.ListenContext(ctx, "udp")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	clientConf.Socks5AuthUsername = "user"
+	clientConf.Socks5AuthPassword = "pass"
+
+	conn, err := client.DialContext(ctx, "udp", echoAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if dials != 2 {
+		t.Fatalf("dials = %v", dials)
+	}
+
+	_, err = conn.WriteToUDP([]byte("hello"), echoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Fatalf("buf = %q", buf[:n])
+	}
+
+	// 服务器不回应时取消 ctx 需要立刻返回
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	client, err = NewUdpClientWithConfig("socks5", silent.Addr().String(), &clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancelCtx, cancelCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancelCancel()
+
+	_, err = client.ListenContext(cancelCtx, "udp")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestUdpConn_Dial(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var echoAddrs []*net.UDPAddr
+	for i := 0; i < 2; i++ {
+		echo := NewEchoServer(&EchoServerConfig{UdpAddr: "127.0.0.1:0"})
+		err := echo.Listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer echo.Close()
+		go func() {
+			_ = echo.Serve()
+		}()
+		echoAddrs = append(echoAddrs, echo.udpConn.LocalAddr().(*net.UDPAddr))
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := ServerConfig{}
+	conf.Default()
+	go func() {
+		_ = ServerLinsten(ctx, ln, &conf)
+	}()
+
+	client, err := NewUdpClient("socks5", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := client.Dial("udp", echoAddrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var _ net.Conn = conn
+	var _ net.PacketConn = conn
+
+	if conn.RemoteAddr().String() != echoAddrs[0].String() {
+		t.Fatalf("RemoteAddr = %v", conn.RemoteAddr())
+	}
+	if conn.LocalAddr().(*net.UDPAddr).Port == 0 {
+		t.Fatalf("LocalAddr = %v", conn.LocalAddr())
+	}
+
+	// 其他来源的回应需要被 Read 忽略
+	n, err := conn.WriteTo([]byte("other"), echoAddrs[1])
+	if err != nil || n != len("other") {
+		t.Fatalf("n = %v, err = %v", n, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	n, err = conn.Write([]byte("hello"))
+	if err != nil || n != len("hello") {
+		t.Fatalf("n = %v, err = %v", n, err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, err = conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Fatalf("buf = %q", buf[:n])
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = conn.Read(buf)
+	if ne, ok := err.(net.Error); ok == false || ne.Timeout() == false {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+// 包装后的连接，模拟经过 tls 等封装的控制连接
+type testWrapConn struct {
+	net.Conn
+}
+
+func TestClientUdpAssociate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	echo := NewEchoServer(&EchoServerConfig{UdpAddr: "127.0.0.1:0"})
+	err := echo.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		_ = echo.Serve()
+	}()
+	echoAddr := echo.udpConn.LocalAddr().(*net.UDPAddr)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := ServerConfig{}
+	conf.Default()
+	go func() {
+		_ = ServerLinsten(ctx, ln, &conf)
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpConn := &testWrapConn{c}
+
+	relayAddr, err := ClientUdpAssociate(ctx, &ClientConfig{}, tcpConn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relayAddr.IsDomain() || relayAddr.Port == 0 {
+		t.Fatalf("relayAddr = %v", relayAddr)
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := NewUdpConn(tcpConn, pc, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(relayAddr.Port)})
+	defer conn.Close()
+
+	_, err = conn.WriteTo([]byte("hello"), echoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, addr, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != echoAddr.String() || string(buf[:n]) != "hello" {
+		t.Fatalf("addr = %v, buf = %q", addr, buf[:n])
+	}
+
+	// 控制连接关闭后 udp 连接也被关闭
+	_ = tcpConn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadFrom(buf)
+	if ne, ok := err.(net.Error); err == nil || (ok && ne.Timeout()) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+// 使用本地 udp socket 模拟服务器的中继端口，返回 UdpConn 及中继端口
+func testRelayUdpConn(t *testing.T) (*UdpConn, net.PacketConn) {
+	relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = relay.Close() })
+
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcpConn, tcpServer := net.Pipe()
+	t.Cleanup(func() { _ = tcpServer.Close() })
+
+	conn := NewUdpConn(tcpConn, udpConn, relay.LocalAddr())
+	t.Cleanup(func() { _ = conn.Close() })
+
+	_ = udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	return conn, relay
+}
+
+func TestUdpConn_ReadMalformed(t *testing.T) {
+	conn, relay := testRelayUdpConn(t)
+
+	pack := Socks5UdpPack{
+		ATYP: Socks5CmdAtypTypeIP4,
+		Ip:   net.IPv4(1, 2, 3, 4).To4(),
+		Port: 53,
+		Data: []byte("hello"),
+	}
+	data := make([]byte, 1024)
+	n, err := pack.To(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 格式错误的包需要被跳过，不能中断读取
+	_, err = relay.WriteTo([]byte{0, 0, 0}, conn.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = relay.WriteTo(data[:n], conn.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	n, addr, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" || addr.String() != "1.2.3.4:53" {
+		t.Fatalf("addr = %v, buf = %q", addr, buf[:n])
+	}
+}
+
+func TestUdpConn_ReadFromUDPDomain(t *testing.T) {
+	conn, relay := testRelayUdpConn(t)
+
+	pack := Socks5UdpPack{
+		ATYP: Socks5CmdAtypTypeDomain,
+		Host: "www.example.com",
+		Port: 53,
+		Data: []byte("hello"),
+	}
+	data := make([]byte, 1024)
+	n, err := pack.To(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err = relay.WriteTo(data[:n], conn.LocalAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 域名来源无法表示为 *net.UDPAddr，不能返回 IP 为 nil 的地址
+	buf := make([]byte, 1024)
+	_, addr, err := conn.ReadFromUDP(buf)
+	if err == nil {
+		t.Fatalf("addr = %v", addr)
+	}
+
+	// ReadFrom 保留域名
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" || from.String() != "www.example.com:53" {
+		t.Fatalf("from = %v, buf = %q", from, buf[:n])
+	}
+}
+
+func TestUdpClient_DnsExchangeSlowDial(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsConf := dns.ServerConfig{}
+	dnsConf.Default()
+	dnsConf.Handler = dns.HostsHandler(map[string][]net.IP{
+		"www.example.com": {net.IPv4(1, 2, 3, 4)},
+	})
+	go func() {
+		_ = dns.ServePacketConn(ctx, upstream, &dnsConf)
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := ServerConfig{}
+	conf.Default()
+	go func() {
+		_ = ServerLinsten(ctx, ln, &conf)
+	}()
+
+	// 第一个关联的握手一直阻塞
+	release := make(chan struct{})
+	defer close(release)
+	dials := int32(0)
+
+	clientConf := UdpClientConfig{}
+	clientConf.Default()
+	dial := clientConf.DialContext
+	clientConf.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if atomic.AddInt32(&dials, 1) == 1 {
+			select {
+			case <-release:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		return dial(ctx, network, addr)
+	}
+	client, err := NewUdpClientWithConfig("socks5", ln.Addr().String(), &clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 1},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName("www.example.com."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	q, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		_, _ = client.DnsExchange(ctx, "127.0.0.1:1", q)
+	}()
+	for atomic.LoadInt32(&dials) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// 其他上游的查询不能被阻塞的握手影响
+	exCtx, exCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer exCancel()
+
+	resp, err := client.DnsExchange(exCtx, upstream.LocalAddr().String(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := dnsmessage.Message{}
+	err = m.Unpack(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Header.ID != 1 || len(m.Answers) != 1 {
+		t.Fatalf("m = %#v", m)
+	}
+}
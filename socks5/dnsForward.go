@@ -0,0 +1,344 @@
+package socks5
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gamexg/proxylib/dns"
+)
+
+// 复用的 dns udp 关联空闲超过这个时间后关闭
+const dnsAssociationIdleTimeout = 60 * time.Second
+
+// 每个 dns udp 关联最多同时等待回应的查询
+const maxDnsAssociationPending = 1024
+
+// 通过 socks5 udp 关联向 upstream 发出 dns 查询并返回回应
+// 同一 upstream 的查询复用一个 udp 关联，查询 ID 在关联内重新分配，回应按 ID 分发给查询方。
+// upstream 为域名时以 socks 域名地址发出，由代理服务器解析，不会在本地解析。
+// 来源不是 upstream 的包会被忽略。
+func (c *UdpClient) DnsExchange(ctx context.Context, upstream string, query []byte) ([]byte, error) {
+	if len(query) < 2 {
+		return nil, fmt.Errorf("query is too short")
+	}
+
+	a, err := c.dnsAssociation(ctx, upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.exchange(ctx, query)
+}
+
+// 返回到 upstream 的 dns udp 关联，没有或已失效时建立新的
+// 建立关联需要完成 socks5 握手，在锁外进行，同一 upstream 同时只建立一个，其他查询等待结果。
+func (c *UdpClient) dnsAssociation(ctx context.Context, upstream string) (*dnsAssociation, error) {
+	for {
+		c.dnsM.Lock()
+
+		if a := c.dnsAssociations[upstream]; a != nil {
+			select {
+			case <-a.done:
+			default:
+				c.dnsM.Unlock()
+				return a, nil
+			}
+		}
+
+		if d := c.dnsDials[upstream]; d != nil {
+			c.dnsM.Unlock()
+
+			select {
+			case <-d.done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+
+			// 建立关联的查询被取消时，由本查询重新建立
+			if d.err != nil && d.canceled == false {
+				return nil, d.err
+			}
+			continue
+		}
+
+		d := &dnsAssociationDial{done: make(chan struct{})}
+		if c.dnsDials == nil {
+			c.dnsDials = make(map[string]*dnsAssociationDial)
+		}
+		c.dnsDials[upstream] = d
+		c.dnsM.Unlock()
+
+		a, err := c.newDnsAssociation(ctx, upstream)
+
+		c.dnsM.Lock()
+		delete(c.dnsDials, upstream)
+		if err == nil {
+			if c.dnsAssociations == nil {
+				c.dnsAssociations = make(map[string]*dnsAssociation)
+			}
+			c.dnsAssociations[upstream] = a
+		}
+		d.err = err
+		d.canceled = ctx.Err() != nil
+		close(d.done)
+		c.dnsM.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+
+		go a.serve()
+
+		return a, nil
+	}
+}
+
+// 正在建立的 dns udp 关联
+type dnsAssociationDial struct {
+	done chan struct{}
+	err  error
+	// 建立关联的查询的 ctx 已被取消
+	canceled bool
+}
+
+func (c *UdpClient) newDnsAssociation(ctx context.Context, upstream string) (*dnsAssociation, error) {
+	conn, err := c.DialContext(ctx, "udp", upstream)
+	if err != nil {
+		return nil, fmt.Errorf("DialContext, %v", err)
+	}
+
+	a := &dnsAssociation{
+		c:        c,
+		upstream: upstream,
+		conn:     conn,
+		pending:  make(map[uint16]chan []byte),
+		done:     make(chan struct{}),
+		lastUsed: time.Now(),
+	}
+	a.idle = time.AfterFunc(dnsAssociationIdleTimeout, a.checkIdle)
+
+	return a, nil
+}
+
+// 复用的 dns udp 关联
+type dnsAssociation struct {
+	c        *UdpClient
+	upstream string
+	conn     *UdpConn
+
+	m sync.Mutex
+	// 等待回应的查询，键为关联内分配的查询 ID
+	pending  map[uint16]chan []byte
+	lastUsed time.Time
+	idle     *time.Timer
+
+	// 关联失效时关闭，err 为失效原因
+	done chan struct{}
+	err  error
+}
+
+func (a *dnsAssociation) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	id, respChan, err := a.add()
+	if err != nil {
+		return nil, err
+	}
+	defer a.remove(id)
+
+	q := append([]byte(nil), query...)
+	binary.BigEndian.PutUint16(q, id)
+
+	_, err = a.conn.Write(q)
+	if err != nil {
+		a.close(fmt.Errorf("Write, %v", err))
+		return nil, ctxErr(ctx, fmt.Errorf("Write, %v", err))
+	}
+
+	select {
+	case resp := <-respChan:
+		// 换回查询方使用的 ID
+		copy(resp, query[:2])
+		return resp, nil
+	case <-a.done:
+		return nil, ctxErr(ctx, a.err)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// 分配一个未使用的随机查询 ID
+func (a *dnsAssociation) add() (uint16, chan []byte, error) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if a.err != nil {
+		return 0, nil, a.err
+	}
+	if len(a.pending) >= maxDnsAssociationPending {
+		return 0, nil, fmt.Errorf("too many pending queries")
+	}
+
+	b := [2]byte{}
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, nil, fmt.Errorf("rand.Read, %v", err)
+		}
+
+		id := binary.BigEndian.Uint16(b[:])
+		if _, ok := a.pending[id]; ok {
+			continue
+		}
+
+		respChan := make(chan []byte, 1)
+		a.pending[id] = respChan
+		a.lastUsed = time.Now()
+		return id, respChan, nil
+	}
+}
+
+func (a *dnsAssociation) remove(id uint16) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	delete(a.pending, id)
+}
+
+// 读取回应并按 ID 分发
+func (a *dnsAssociation) serve() {
+	buf := make([]byte, MaxUdpDatagramSize)
+	for {
+		n, err := a.conn.Read(buf)
+		if err != nil {
+			a.close(fmt.Errorf("Read, %v", err))
+			return
+		}
+		if n < 2 {
+			continue
+		}
+
+		id := binary.BigEndian.Uint16(buf)
+
+		a.m.Lock()
+		respChan := a.pending[id]
+		delete(a.pending, id)
+		a.m.Unlock()
+
+		if respChan != nil {
+			respChan <- append([]byte(nil), buf[:n]...)
+		}
+	}
+}
+
+// 空闲超时后关闭关联
+func (a *dnsAssociation) checkIdle() {
+	a.m.Lock()
+	idle := len(a.pending) == 0 && time.Since(a.lastUsed) >= dnsAssociationIdleTimeout
+	if idle == false && a.err == nil {
+		a.idle.Reset(dnsAssociationIdleTimeout)
+	}
+	a.m.Unlock()
+
+	if idle {
+		a.close(fmt.Errorf("association is idle"))
+	}
+}
+
+// 关闭关联，等待中的查询返回 err，之后的查询会建立新的关联
+func (a *dnsAssociation) close(err error) {
+	a.m.Lock()
+	if a.err != nil {
+		a.m.Unlock()
+		return
+	}
+	a.err = err
+	close(a.done)
+	a.idle.Stop()
+	a.m.Unlock()
+
+	_ = a.conn.Close()
+
+	c := a.c
+	c.dnsM.Lock()
+	if c.dnsAssociations[a.upstream] == a {
+		delete(c.dnsAssociations, a.upstream)
+	}
+	c.dnsM.Unlock()
+}
+
+// 经代理服务器建立到 address 的 tcp 连接，使用 UdpClientConfig 中的 DialContext 及鉴定信息
+func (c *UdpClient) dialTcpContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conf := c.conf
+
+	if conf.Socks5ShakeHandsTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, conf.Socks5ShakeHandsTimeout)
+		defer cancel()
+	}
+
+	conn, err := conf.DialContext(ctx, "tcp", c.proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("DialContext, %v", err)
+	}
+
+	// 握手期间 ctx 被取消时关闭连接，中断读写
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+
+	err = ClientTcpConn(ctx, &conf.ClientConfig, conn, network, address)
+
+	close(done)
+	<-exited
+
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, ctxErr(ctx, err)
+	}
+
+	return conn, nil
+}
+
+// 生成通过 socks5 代理转发 dns 查询的配置
+// udp 查询使用 UdpClient 建立的 udp 关联，udp 被阻断或回应被截断时通过 CONNECT 使用 tcp 查询，
+// 使 dns 查询与其他流量经过同一代理，防止泄露。
+// 配合 dns.NewForwarder 及 dns.ServeAddr 即可在本机提供 dns 服务。
+// clientConf 为空时使用默认配置。
+func NewDnsForwarderConfig(proxyAddr string, clientConf *ClientConfig, upstream string) (*dns.ForwarderConfig, error) {
+	udpConf := UdpClientConfig{}
+	udpConf.Default()
+	if clientConf != nil {
+		udpConf.ClientConfig = *clientConf
+	}
+
+	udpClient, err := NewUdpClientWithConfig("socks5", proxyAddr, &udpConf)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewDnsForwarderConfigWithClient(udpClient, upstream), nil
+}
+
+// 同 NewDnsForwarderConfig，udp 及 tcp 查询都使用 client 的配置(包括 DialContext)连接代理服务器
+func NewDnsForwarderConfigWithClient(client *UdpClient, upstream string) *dns.ForwarderConfig {
+	conf := dns.ForwarderConfig{}
+	conf.Default()
+	conf.Upstream = upstream
+	conf.UdpExchange = client.DnsExchange
+	conf.TcpDialContext = client.dialTcpContext
+
+	return &conf
+}
@@ -167,7 +167,7 @@ func (s *EchoServer) TcpServer(ln *net.TCPListener) error {
 func (s *EchoServer) UdpServer(ln *net.UDPConn) error {
 	defer ln.Close()
 
-	buf := make([]byte, 2048)
+	buf := make([]byte, MaxUdpDatagramSize)
 
 	for {
 		n, addr, err := ln.ReadFrom(buf)
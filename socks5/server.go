@@ -5,12 +5,13 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"sync"
+	"strconv"
 	"time"
 
+	"github.com/gamexg/proxylib/dns"
 	"github.com/gamexg/proxylib/goio"
-
-	"github.com/gamexg/proxylib/mempool"
+	"github.com/gamexg/proxylib/sniff"
+	"github.com/gamexg/proxylib/tlsinfo"
 )
 
 type ServerConfig struct {
@@ -25,6 +26,20 @@ type ServerConfig struct {
 	// 使得 socks5 客户端可以立刻发出之后的请求(例如 http 请求)。
 	FastForward bool
 
+	// 目标嗅探
+	// 启用时先回复 cmdR，读取客户端发出的第一块数据，从 tls SNI 或 http Host 中取得域名后才建立到网站的连接。
+	// 嗅探结果通过 sniff.FromContext 附加在传给 SiteTcpDialContext 的 ctx 上。
+	// 与 FastForward 相同，建立连接失败时无法再告知客户端。
+	Sniff bool
+	// 等待客户端数据的超时时间，网站先发出数据的协议(例如 smtp)会等待这么久
+	SniffTimeout time.Duration
+	// 嗅探到域名时，将 ip 目标地址替换为 域名:原端口
+	// 客户端请求的是域名时不替换，只附加嗅探结果
+	SniffOverrideDestination bool
+	// 检查嗅探结果，例如禁止 BitTorrent 协议
+	// 在建立到网站的连接前调用，返回错误时关闭客户端连接，为空则不检查
+	SniffCheck func(ctx context.Context, r *sniff.Result) error
+
 	// udp cmd addr 兼容
 	// 按照 rfc1928 标准，当 cmd 命令提供 addr 字段时，表明 socks5 客户端只会从这个地址向 socks5 服务端发出 udp 包，服务器要丢弃其他
 	// 地址发出的 udp 包。但是有些 socks5 客户端实现错误，会将目标网站的地址填入 cmd addr 字段内，造成 socks5 udp 无法工作。
@@ -39,6 +54,56 @@ type ServerConfig struct {
 	SiteUdpListen func(ctx context.Context) (net.PacketConn, error)
 	// SiteUdpListen 曹氏时间
 	SiteUdpListenTimeout time.Duration
+	// udp 包最大负载，超出的包会被丢弃，为 0 时使用 MaxUdpDatagramSize
+	UdpMaxDatagramSize int
+	// udp nat 过滤行为，决定网站发来的包是否转发给客户端
+	UdpNatFilter UdpNatFilter
+	// nat 会话空闲超时时间，只在客户端发出数据时刷新，为 0 时不超时
+	UdpNatIdleTimeout time.Duration
+	// 每个 udp 关联最多的 nat 会话数量，超出时替换最久未使用的会话，为 0 时不限制
+	UdpNatMaxMappings int
+	// 检查客户端发出的每个 udp 包的目标，返回错误时丢弃，为空时不检查，例如使用 UdpDstRules.Check
+	// 目标为域名时 dst 为 *Addr，之后解析出的 ip 或 fake ip 换回的地址等实际发往的地址会再次检查。
+	// 每个包都会调用，需要尽快返回。
+	UdpCheckDst func(ctx context.Context, dst net.Addr) error
+	// 每个 udp 关联每秒最多发出的包数量及负载字节数，超出的包被丢弃，为 0 时不限制
+	// 允许 1 秒的突发，UdpMaxBytesPerSecond 小于单个包的负载时这个包总是被丢弃。
+	UdpMaxPacketsPerSecond int
+	UdpMaxBytesPerSecond   int
+	// 不为空时记录各原因丢弃的 udp 包数量
+	UdpStats *UdpStats
+	// udp 嗅探
+	// 启用时解析发往每个目标的 quic v1 Initial 包，从 ClientHello 中取得域名。
+	// ClientHello 跨多个包时，嗅探完成前的包会被暂存。
+	UdpSniff bool
+	// 决定发往某个目标的数据包的去向，每个目标只在第一次嗅探完成后调用一次
+	// 返回错误时丢弃发往该目标的数据包，返回非空地址时改为发往该地址，返回 nil 表示不修改。
+	// 在转发线程中调用，不能阻塞太久，为空则只嗅探不处理
+	UdpSniffRoute func(ctx context.Context, dst *net.UDPAddr, r *sniff.Result) (net.Addr, error)
+	// udp dns 拦截
+	// 不为空时，发往 UdpDnsServers 的 dns 查询交由本函数处理，例如 dns.ResolverHandler 使用本机解析，
+	// 回应以原目标地址发回客户端，客户端看到的仍是它的 dns 服务器在回应。
+	// 返回 nil, nil 时按原样转发查询，返回错误时回应 SERVFAIL。
+	UdpDnsHandler dns.Handler
+	// 拦截的 dns 服务器地址，为空时拦截所有发往 53 端口的查询
+	UdpDnsServers []*net.UDPAddr
+	// UdpDnsHandler 超时时间
+	UdpDnsTimeout time.Duration
+
+	// fake ip
+	// 不为空时，CONNECT 目标及 udp 包目标为 fake ip 时先换回域名再处理，通常设置为 dns.FakeIP 的 Lookup 方法。
+	FakeIPLookup func(ip net.IP) (string, bool)
+	// 解析 udp 域名目标(包括 fake ip 换回的域名)使用的函数
+	// 网站回应的来源地址会被换回客户端请求时使用的域名或 fake ip
+	UdpLookupIP func(ctx context.Context, host string) ([]net.IP, error)
+	// UdpLookupIP 超时时间
+	UdpLookupIPTimeout time.Duration
+	// 每个 udp 关联内缓存解析结果的时间
+	UdpLookupIPCacheTime time.Duration
+	// 决定发往 udp 域名目标的数据包的去向，每个目标在解析后调用一次，结果与解析结果一同缓存
+	// addr 为解析得到的地址，返回错误时丢弃数据包，返回非空地址时改为发往该地址，返回 nil 表示不修改。
+	// 在转发线程中调用，不能阻塞太久，为空则发往解析得到的地址
+	UdpDomainRoute func(ctx context.Context, domain string, addr *net.UDPAddr) (net.Addr, error)
 
 	// 向 socks5 客户端建立监听使用的函数
 	Socks5ClientUdpListen func(ctx context.Context, network string) (net.PacketConn, error)
@@ -47,9 +112,37 @@ type ServerConfig struct {
 	Socks5ClientUdpDial func(ctx context.Context, network, addr string) (net.PacketConn, error)
 	// Socks5ClientUdpListen、Socks5ClientUdpDial 超时时间
 	Socks5ClientUdpListenAndDialTimeout time.Duration
+	// 共用 udp 端口
+	// 不为空时所有 udp 关联共用这个端口，不再使用 Socks5ClientUdpListen、Socks5ClientUdpDial
+	Socks5ClientUdpShared *UdpSharedListener
+
+	// UDP ASSOCIATE 回复中的 udp 地址
+	// 默认使用本地 udp 地址，未绑定 ip 时使用 tcp 控制连接的本地 ip。
+	// 服务器位于 nat 之后或容器内时这个地址客户端无法访问，需要指定对外地址。
+	Socks5ClientUdpAdvertiseIPv4 net.IP
+	Socks5ClientUdpAdvertiseIPv6 net.IP
+	// 端口映射，键为本地 udp 端口，值为对外端口，不在表中的端口不修改
+	Socks5ClientUdpAdvertisePorts map[int]int
+	// 按 tcp 控制连接的协议选择对外地址，ipv6 客户端使用 Socks5ClientUdpAdvertiseIPv6，
+	// 对应协议的地址为空时使用本地地址。
+	// 为 false 时优先使用 Socks5ClientUdpAdvertiseIPv4。
+	Socks5ClientUdpAdvertiseByClient bool
+	// 是否接受私有命令 Socks5CmdTypeUdpOverTcp，udp 包经 tcp 控制连接传输，默认关闭
+	UdpOverTcp bool
 
 	Socks5AuthCheckMethod          func(a []Socks5AuthMethodType) Socks5AuthMethodType
 	Socks5AuthCheckUserAndPassword func(user, password string) error
+
+	// tls 握手检查
+	// 不为空时，被动解析 CONNECT 隧道中的 tls 握手，在转发应用数据前检查网站的回应，
+	// 例如使用 tlsinfo.VerifyCertificates 验证 tls 1.2 的证书链。
+	// 返回错误时关闭到网站的连接，并再次调用 SiteTcpDialContext 重新建立连接，
+	// SiteTcpDialContext 可以通过 tlsinfo.DialAttemptFromContext 得知重试次数，以切换线路。
+	SiteTlsVerify func(ctx context.Context, addr string, hello *tlsinfo.ClientHello, server *tlsinfo.ServerHandshake) error
+	// 最多尝试次数，包含第一次
+	SiteTlsVerifyAttempts int
+	// 读取 ClientHello 及网站回应的超时时间
+	SiteTlsVerifyTimeout time.Duration
 }
 
 func (c *ServerConfig) Default() {
@@ -60,13 +153,37 @@ func (c *ServerConfig) Default() {
 		ForwardTimeout:                   2 * 60 * time.Second,
 		ForwardBufSize:                   32 * 1024,
 		FastForward:                      false,
+		Sniff:                            false,
+		SniffTimeout:                     300 * time.Millisecond,
+		SniffOverrideDestination:         true,
+		SniffCheck:                       nil,
 		UdpAssociateCmdAddrCompatibility: false,
 		SiteTcpDialContext:               dial.DialContext,
 		SiteTcpDialContextDialTimeout:    10 * time.Second,
 		SiteUdpListen: func(ctx context.Context) (net.PacketConn, error) {
 			return net.ListenPacket("udp", ":0")
 		},
-		SiteUdpListenTimeout: 10 * time.Second,
+		SiteUdpListenTimeout:   10 * time.Second,
+		UdpMaxDatagramSize:     MaxUdpDatagramSize,
+		UdpNatFilter:           UdpNatFilterEndpointIndependent,
+		UdpNatIdleTimeout:      2 * 60 * time.Second,
+		UdpNatMaxMappings:      1024,
+		UdpCheckDst:            nil,
+		UdpMaxPacketsPerSecond: 0,
+		UdpMaxBytesPerSecond:   0,
+		UdpStats:               nil,
+		UdpSniff:               false,
+		UdpSniffRoute:          nil,
+		UdpDnsHandler:          nil,
+		UdpDnsServers:          nil,
+		UdpDnsTimeout:          5 * time.Second,
+		FakeIPLookup:           nil,
+		UdpLookupIP: func(ctx context.Context, host string) ([]net.IP, error) {
+			return net.DefaultResolver.LookupIP(ctx, "ip", host)
+		},
+		UdpLookupIPTimeout:   5 * time.Second,
+		UdpLookupIPCacheTime: 60 * time.Second,
+		UdpDomainRoute:       nil,
 		Socks5ClientUdpListen: func(ctx context.Context, network string) (net.PacketConn, error) {
 			return net.ListenPacket(network, ":0")
 		},
@@ -85,6 +202,12 @@ func (c *ServerConfig) Default() {
 			return udpConn, nil
 		},
 		Socks5ClientUdpListenAndDialTimeout: 10 * time.Second,
+		Socks5ClientUdpShared:               nil,
+		Socks5ClientUdpAdvertiseIPv4:        nil,
+		Socks5ClientUdpAdvertiseIPv6:        nil,
+		Socks5ClientUdpAdvertisePorts:       nil,
+		Socks5ClientUdpAdvertiseByClient:    false,
+		UdpOverTcp:                          false,
 		Socks5AuthCheckMethod: func(a []Socks5AuthMethodType) Socks5AuthMethodType {
 			for _, v := range a {
 				if v == Socks5AuthMethodTypeNone {
@@ -97,6 +220,9 @@ func (c *ServerConfig) Default() {
 		Socks5AuthCheckUserAndPassword: func(user, password string) error {
 			return fmt.Errorf("not support")
 		},
+		SiteTlsVerify:         nil,
+		SiteTlsVerifyAttempts: 3,
+		SiteTlsVerifyTimeout:  10 * time.Second,
 	}
 }
 
@@ -168,6 +294,18 @@ func ServeConn(ctx context.Context, c net.Conn, conf *ServerConfig) error {
 			return err
 		}
 
+	case Socks5CmdTypeUdpOverTcp:
+		if conf.UdpOverTcp == false {
+			cmdR.Cmd = Socks5CmdReplyCommandNotSupported
+			_ = cmdR.Write(c)
+			return fmt.Errorf("udp over tcp is disabled")
+		}
+
+		err = serverConnUdpAssociate(lCtx, c, conf, &cmd, &cmdR)
+		if err != nil {
+			return err
+		}
+
 		//case CSocks5Bind:
 	default:
 		cmdR.Cmd = Socks5CmdReplyCommandNotSupported
@@ -181,6 +319,16 @@ func ServeConn(ctx context.Context, c net.Conn, conf *ServerConfig) error {
 // 建立到 socks5 客户端的 udp 连接
 // 如果 src 为空，则内部使用 listen
 func serverConnUdpSocks5ClientDial(ctx context.Context, conf *ServerConfig, socks5ClientSrcAddr *net.UDPAddr, tpcConn net.Conn) (net.PacketConn, bool, error) {
+	// 共用端口按来源地址区分 udp 关联，不需要再检查来源
+	if shared := conf.Socks5ClientUdpShared; shared != nil {
+		packConn, err := shared.Listen(tpcConn, socks5ClientSrcAddr)
+		if err != nil {
+			return nil, true, fmt.Errorf("Socks5ClientUdpShared.Listen, %v", err)
+		}
+
+		return packConn, true, nil
+	}
+
 	if conf.Socks5ClientUdpDial == nil {
 		socks5ClientSrcAddr = nil
 	}
@@ -214,7 +362,7 @@ func serverConnUdpAssociate(ctx context.Context, clientConn net.Conn, conf *Serv
 	return s.Serve()
 }
 
-func getSocks5ListenUdpAddr(clientConn net.Conn, udpConn net.PacketConn) (*net.UDPAddr, error) {
+func getSocks5ListenUdpAddr(conf *ServerConfig, clientConn net.Conn, udpConn net.PacketConn) (*net.UDPAddr, error) {
 	localAddr := udpConn.LocalAddr()
 
 	localUdpAddr, _ := localAddr.(*net.UDPAddr)
@@ -222,22 +370,63 @@ func getSocks5ListenUdpAddr(clientConn net.Conn, udpConn net.PacketConn) (*net.U
 		return nil, fmt.Errorf("localUdpAddr==nil, %#v", localAddr)
 	}
 
-	// 如果 udp 连接绑定了 ip，则直接使用
-	// todo: 检查 listen 不同情况下 ip 地址区别
-	if ip := localUdpAddr.IP; len(ip) != 0 &&
-		net.IPv4zero.Equal(ip) == false &&
-		net.IPv6zero.Equal(ip) == false {
-		return localUdpAddr, nil
+	// LocalAddr 可能返回连接内部使用的地址，不能修改
+	addr := *localUdpAddr
+
+	// 如果 udp 连接未绑定 ip，则使用客户端连接到的 tcp 本地 ip
+	if ip := addr.IP; len(ip) == 0 || ip.IsUnspecified() {
+		localTcpAddr, _ := clientConn.LocalAddr().(*net.TCPAddr)
+		if localTcpAddr == nil {
+			return nil, fmt.Errorf("非预期的 tcp 本地地址， %#v", clientConn.LocalAddr())
+		}
+
+		addr.IP = localTcpAddr.IP
 	}
 
-	localTcpAddr, _ := clientConn.LocalAddr().(*net.TCPAddr)
-	if localTcpAddr == nil {
-		return nil, fmt.Errorf("非预期的 tcp 本地地址， %#v", localTcpAddr)
+	if ip, err := getSocks5AdvertiseIp(conf, clientConn); err != nil {
+		return nil, err
+	} else if ip != nil {
+		addr.IP = ip
 	}
 
-	localUdpAddr.IP = localTcpAddr.IP
+	if port, ok := conf.Socks5ClientUdpAdvertisePorts[addr.Port]; ok {
+		addr.Port = port
+	}
 
-	return localUdpAddr, nil
+	return &addr, nil
+}
+
+// 取得配置的对外 ip，未配置时返回 nil
+func getSocks5AdvertiseIp(conf *ServerConfig, clientConn net.Conn) (net.IP, error) {
+	ipv4 := conf.Socks5ClientUdpAdvertiseIPv4
+	ipv6 := conf.Socks5ClientUdpAdvertiseIPv6
+
+	if conf.Socks5ClientUdpAdvertiseByClient == false {
+		if len(ipv4) != 0 {
+			return ipv4, nil
+		}
+		if len(ipv6) != 0 {
+			return ipv6, nil
+		}
+		return nil, nil
+	}
+
+	isIpv6, err := ConnIsIpv6(clientConn)
+	if err != nil {
+		return nil, fmt.Errorf("ConnIsIpv6, %v", err)
+	}
+
+	if isIpv6 {
+		if len(ipv6) != 0 {
+			return ipv6, nil
+		}
+		return nil, nil
+	}
+
+	if len(ipv4) != 0 {
+		return ipv4, nil
+	}
+	return nil, nil
 }
 
 // 判断 conn 是否是 ipv6 协议
@@ -276,20 +465,15 @@ func ConnIsIpv6(c net.Conn) (bool, error) {
 }
 
 func serverConnConnect(ctx context.Context, clientConn net.Conn, conf *ServerConfig, cmd *Socks5CmdPack, cmdR *Socks5CmdPack) error {
-	if conf.FastForward {
+	// 嗅探需要先回复 cmdR 才能读到客户端的数据
+	replied := conf.FastForward || conf.Sniff
+	if replied {
 		err := cmdR.Write(clientConn)
 		if err != nil {
 			return fmt.Errorf("cmdR.Write, %v", err)
 		}
 	}
 
-	dialTimeout := conf.SiteTcpDialContextDialTimeout
-	if dialTimeout == 0 {
-		dialTimeout = 60 * time.Second
-	}
-	dialCtx, dialCtxCancel := context.WithTimeout(ctx, dialTimeout)
-	defer dialCtxCancel()
-
 	rAddr, err := cmd.GetAddrString()
 	if err != nil {
 		// 不支持请求中的 atyp
@@ -298,6 +482,43 @@ func serverConnConnect(ctx context.Context, clientConn net.Conn, conf *ServerCon
 		return fmt.Errorf("cmd.GetAddrString, %v", err)
 	}
 
+	isDomain := cmd.Atyp == Socks5CmdAtypTypeDomain
+	if conf.FakeIPLookup != nil && isDomain == false {
+		ip, err := cmd.GetHostIp()
+		if err == nil {
+			if domain, ok := conf.FakeIPLookup(ip); ok {
+				rAddr = net.JoinHostPort(domain, strconv.Itoa(int(cmd.Port)))
+				isDomain = true
+			}
+		}
+	}
+
+	if conf.Sniff {
+		var r *sniff.Result
+		r, clientConn = sniff.Sniff(clientConn, conf.SniffTimeout)
+		r.Addr = rAddr
+
+		if len(r.Domain) != 0 && conf.SniffOverrideDestination && isDomain == false {
+			rAddr = net.JoinHostPort(r.Domain, strconv.Itoa(int(cmd.Port)))
+		}
+
+		ctx = sniff.NewContext(ctx, r)
+
+		if conf.SniffCheck != nil {
+			err := conf.SniffCheck(ctx, r)
+			if err != nil {
+				return fmt.Errorf("SniffCheck %v %v, %v", rAddr, r.Protocol, err)
+			}
+		}
+	}
+
+	dialTimeout := conf.SiteTcpDialContextDialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = 60 * time.Second
+	}
+	dialCtx, dialCtxCancel := context.WithTimeout(ctx, dialTimeout)
+	defer dialCtxCancel()
+
 	siteConn, err := conf.SiteTcpDialContext(dialCtx, "tcp", rAddr)
 	if err != nil {
 		// 主机不可达
@@ -305,80 +526,39 @@ func serverConnConnect(ctx context.Context, clientConn net.Conn, conf *ServerCon
 		_ = cmdR.Write(clientConn)
 		return fmt.Errorf("SiteTcpDialContext, %v", err)
 	}
-	defer siteConn.Close()
+	defer func() {
+		if siteConn != nil {
+			_ = siteConn.Close()
+		}
+	}()
 
-	if !conf.FastForward {
+	if !replied {
 		err := cmdR.Write(clientConn)
 		if err != nil {
 			return fmt.Errorf("cmdR.Write, %v", err)
 		}
 	}
 
-	var forwardErr error
-	var forwardM sync.Mutex
-	setForwardErr := func(err error) {
-		forwardM.Lock()
-		defer forwardM.Unlock()
-
-		if forwardErr == nil {
-			forwardErr = err
-		}
-	}
-	getForwardErr := func() error {
-		forwardM.Lock()
-		defer forwardM.Unlock()
-
-		return forwardErr
-	}
-
-	forward := func(srcConn, dstConn net.Conn, srcName, dstName string) {
-		buf := mempool.Get(conf.ForwardBufSize)
-		defer mempool.Put(buf)
-
-		for {
-			select {
-			case <-ctx.Done():
-				setForwardErr(ctx.Err())
-				return
-			default:
-				break
-			}
-
-			deadline := time.Now().Add(conf.ForwardTimeout)
-			_ = srcConn.SetDeadline(deadline)
-			_ = dstConn.SetDeadline(deadline)
-
-			n, err := srcConn.Read(buf)
-			if err != nil {
-				setForwardErr(fmt.Errorf("%v.Read, %v", srcName, err))
-				return
-			}
-
-			select {
-			case <-ctx.Done():
-				setForwardErr(ctx.Err())
-				return
-			default:
-				break
-			}
-
-			data := buf[:n]
-
-			_, err = goio.WriteAll(dstConn, data)
-			if err != nil {
-				setForwardErr(fmt.Errorf("%v.Write, %v", dstName, err))
-				return
-			}
+	if conf.SiteTlsVerify != nil {
+		clientConn, siteConn, err = tlsinfo.RelayHandshake(ctx, clientConn, siteConn, &tlsinfo.RelayConfig{
+			Timeout: conf.SiteTlsVerifyTimeout,
+			Verify: func(hello *tlsinfo.ClientHello, server *tlsinfo.ServerHandshake) error {
+				return conf.SiteTlsVerify(ctx, rAddr, hello, server)
+			},
+			MaxAttempts: conf.SiteTlsVerifyAttempts,
+			Redial: func(ctx context.Context, attempt int, lastErr error) (net.Conn, error) {
+				dialCtx, dialCtxCancel := context.WithTimeout(tlsinfo.WithDialAttempt(ctx, attempt, lastErr), dialTimeout)
+				defer dialCtxCancel()
+
+				return conf.SiteTcpDialContext(dialCtx, "tcp", rAddr)
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("RelayHandshake, %v", err)
 		}
 	}
 
-	// 将 siteConn 的数据发送给 clientConn
-	go forward(siteConn, clientConn, "siteConn", "clientConn")
-
-	// 将 clientConn 的数据转发给 siteConn
-	forward(clientConn, siteConn, "clientConn", "siteConn")
-
-	return getForwardErr()
+	return goio.Forward(ctx, clientConn, siteConn, "clientConn", "siteConn", conf.ForwardBufSize, conf.ForwardTimeout)
 }
 
 func serverConnAuthPassword(c io.ReadWriter, conf *ServerConfig) error {
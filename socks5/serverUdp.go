@@ -5,7 +5,15 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/gamexg/proxylib/dns"
+	"github.com/gamexg/proxylib/mempool"
+	"github.com/gamexg/proxylib/sniff"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 // 处理 socks5 udp支持
@@ -23,12 +31,100 @@ type udpServer struct {
 
 	// 到 socks5 客户端的连接是否为 dial 建立的
 	socks5ClientIsDial bool
+	// udp over tcp，socks5CliteUdpConn 使用 tcp 控制连接
+	udpOverTcp bool
 
 	udpSiteConn        net.PacketConn
 	socks5CliteUdpConn net.PacketConn
 
 	// socks5 客户端的udp地址
 	socks5ClientAddr atomic.Value
+
+	// 保护 udpSniffs、udpDomainRoutes 及限速状态
+	// udpSend2Site 处理每个包时持有，域名解析完成后解析线程持有并转发暂存的包
+	sendMu sync.Mutex
+
+	// 每个目标的嗅探状态
+	udpSniffs map[string]*udpSniffState
+
+	// 客户端到各目标的 nat 会话
+	udpNat *udpNatTable
+
+	// 发出的包数量及字节数限制
+	udpPacketRate *udpRateLimiter
+	udpByteRate   *udpRateLimiter
+
+	// 限制同时处理的 dns 查询数量
+	udpDnsSem chan struct{}
+	// 限制同时解析的域名数量
+	udpLookupSem chan struct{}
+
+	// 域名目标(包括 fake ip 换回的域名)的去向，键为 域名:端口
+	udpDomainRoutes map[string]*udpDomainRoute
+
+	udpReplyMu sync.Mutex
+	// 网站回应的来源地址需要换回的地址，键为实际地址
+	// 只记录客户端以域名或 fake ip 发出的目标，与 udpDomainRoutes 同时过期
+	udpReplyAddrs map[string]*udpReplyAddr
+}
+
+// 域名解析失败时，这段时间内不再重新解析
+const udpLookupIPFailCacheTime = 5 * time.Second
+
+type udpDomainRoute struct {
+	// 解析出的地址
+	addr *net.UDPAddr
+	// 按 UdpDomainRoute 决定的去向
+	route net.Addr
+	err   error
+
+	expire time.Time
+
+	// 正在解析，收到的包暂存在 pending
+	resolving bool
+	pending   []udpPendingPacket
+}
+
+type udpPendingPacket struct {
+	clientDst net.Addr
+	data      []byte
+}
+
+type udpReplyAddr struct {
+	addr   net.Addr
+	expire time.Time
+}
+
+// 最多同时处理的 dns 查询，超过时按原样转发
+const maxUdpDnsPending = 64
+
+// 最多同时解析的域名，超过时丢弃发往新域名的包
+const maxUdpLookupPending = 64
+
+// 每个域名解析完成前最多暂存的包
+const maxUdpRoutePending = 8
+
+// 最多同时嗅探、记录的目标数量
+const maxUdpSniffEntries = 1024
+
+// 暂存的包超过这个数量时不再等待 ClientHello
+const maxUdpSniffPending = 4
+
+// 空闲超过这个时间的目标在记录过多时被清除
+const udpSniffIdleTimeout = 2 * time.Minute
+
+type udpSniffState struct {
+	sniffer sniff.QuicSniffer
+	// 等待嗅探完成的包
+	pending [][]byte
+
+	done bool
+	// 嗅探完成后发往的地址
+	route net.Addr
+	// 不为空表示丢弃发往该目标的包
+	err error
+
+	lastUsed time.Time
 }
 
 func newUdpServer(ctx context.Context, conf *ServerConfig,
@@ -43,6 +139,14 @@ func newUdpServer(ctx context.Context, conf *ServerConfig,
 		socks5ClienTcpConn: sock5ClientTcpConn,
 		cmd:                cmd,
 		cmdR:               cmdR,
+		udpSniffs:          make(map[string]*udpSniffState),
+		udpDnsSem:          make(chan struct{}, maxUdpDnsPending),
+		udpLookupSem:       make(chan struct{}, maxUdpLookupPending),
+		udpDomainRoutes:    make(map[string]*udpDomainRoute),
+		udpReplyAddrs:      make(map[string]*udpReplyAddr),
+		udpNat:             newUdpNatTable(conf.UdpNatFilter, conf.UdpNatIdleTimeout, conf.UdpNatMaxMappings),
+		udpPacketRate:      newUdpRateLimiter(conf.UdpMaxPacketsPerSecond),
+		udpByteRate:        newUdpRateLimiter(conf.UdpMaxBytesPerSecond),
 	}
 
 	return &srv
@@ -73,64 +177,33 @@ func (s *udpServer) Serve() (err error) {
 		return fmt.Errorf("siteUdpListen == nil")
 	}
 
-	// 建立到 socks5 客户端的连接的函数
-	socks5ClientListen := conf.Socks5ClientUdpListen
-	if socks5ClientListen == nil {
-		cmdR.Cmd = Socks5CmdReplyInternalError
-		return fmt.Errorf("socks5ClientListen == nil")
-	}
-
-	// socks5 客户端发出 socks5 udp 请求的源地址
-	// 为 nil 表示不限制，否则需要检查来源。
-	var socks5ClientCmdUdpAddr *net.UDPAddr
+	if cmd.Cmd == Socks5CmdTypeUdpOverTcp {
+		// 来源地址总是 tcp 控制连接的远端地址，回复的 udp 地址为 0.0.0.0:0
+		clientAddr := &net.UDPAddr{}
+		if a, _ := socks5ClienTcpConn.RemoteAddr().(*net.TCPAddr); a != nil {
+			clientAddr = &net.UDPAddr{IP: a.IP, Port: a.Port, Zone: a.Zone}
+		}
 
-	// 获取 socks5 客户端的 udp 源地址
-	// 这里简单只检查 port 不能为 0(客户端要求限制的情况)
-	if conf.UdpAssociateCmdAddrCompatibility != true && cmd.Port != 0 {
-		ip, err := cmd.GetHostIp()
+		s.udpOverTcp = true
+		s.socks5ClientIsDial = true
+		s.socks5CliteUdpConn = newUdpOverTcpConn(socks5ClienTcpConn, clientAddr)
+	} else {
+		err = s.socks5ClientListen()
 		if err != nil {
-			cmdR.Cmd = Socks5CmdReplyAddressTypeNotSupported
-			return fmt.Errorf("cmd.GetHostIp, %V", err)
+			return err
 		}
-
-		socks5ClientCmdUdpAddr = &net.UDPAddr{IP: ip, Port: int(cmd.Port)}
-		s.socks5ClientCmdUdpAddr = socks5ClientCmdUdpAddr
-	}
-
-	// 到客户端的连接
-	// 根据情况，可能是 dial 直接建立的到客户端的 udp 连接
-	// 可能能是 listen 建立的连接
-	dialClientCtx, dialClientCtxCancel := context.WithTimeout(ctx, conf.Socks5ClientUdpListenAndDialTimeout)
-	defer dialClientCtxCancel()
-	socks5ClientUdpConn, isDial, err := serverConnUdpSocks5ClientDial(dialClientCtx, conf, socks5ClientCmdUdpAddr, socks5ClienTcpConn)
-	if err != nil {
-		cmdR.Cmd = Socks5CmdReplyHostUnreachable
-		return fmt.Errorf("serverConnUdpSocks5ClientDial, %v", err)
-	}
-	defer socks5ClientUdpConn.Close()
-	s.socks5CliteUdpConn = socks5ClientUdpConn
-	s.socks5ClientIsDial = isDial
-
-	// 获得 socks5 客户端建立连接时连接到的服务器 udp 地址
-	socks5ClientAddr, err := getSocks5ListenUdpAddr(socks5ClienTcpConn, socks5ClientUdpConn)
-	if err != nil {
-		cmdR.Cmd = Socks5CmdReplyInternalError
-		return fmt.Errorf("getSocks5ListenUdpAddr, %v", err)
-	}
-
-	err = cmdR.SetHostIp(socks5ClientAddr.IP)
-	if err != nil {
-		cmdR.Cmd = Socks5CmdReplyInternalError
-		return fmt.Errorf("cmdR.SetHostIp, %v", err)
+		defer s.socks5CliteUdpConn.Close()
 	}
-	cmdR.Port = uint16(socks5ClientAddr.Port)
 
 	if conf.FastForward {
 		sendCmdR = true
+		cmdR.Cmd = Socks5CmdReplySucceeded
 		err := cmdR.Write(socks5ClienTcpConn)
 		if err != nil {
 			return fmt.Errorf("cmdR.Write, %v", err)
 		}
+		// 握手完成，清除 ServeConn 设置的握手超时，udp 关联的生存期由 tcp 连接决定
+		_ = socks5ClienTcpConn.SetDeadline(time.Time{})
 	}
 
 	// 开始建立到目标网站的连接
@@ -147,16 +220,25 @@ func (s *udpServer) Serve() (err error) {
 
 	if conf.FastForward == false {
 		sendCmdR = true
+		cmdR.Cmd = Socks5CmdReplySucceeded
 		err := cmdR.Write(socks5ClienTcpConn)
 		if err != nil {
 			return fmt.Errorf("cmdR.Write, %v", err)
 		}
+		// 握手完成，清除 ServeConn 设置的握手超时，udp 关联的生存期由 tcp 连接决定
+		_ = socks5ClienTcpConn.SetDeadline(time.Time{})
 	}
 
 	// 启动线程， udp 连接包
 	go s.udpSend2Client()
 	go s.udpSend2Site()
 
+	// udp over tcp 时 tcp 连接由 udpSend2Site 读取，出错时会取消 ctx
+	if s.udpOverTcp {
+		<-ctx.Done()
+		return nil
+	}
+
 	//等待 tcp 连接终止
 	buf := make([]byte, 1)
 	for {
@@ -174,14 +256,82 @@ func (s *udpServer) Serve() (err error) {
 	}
 }
 
+// 建立接收 socks5 客户端 udp 包的连接，并在 cmdR 中填写客户端需要连接的 udp 地址
+func (s *udpServer) socks5ClientListen() (err error) {
+	conf := s.conf
+	cmd := s.cmd
+	cmdR := s.cmdR
+	ctx := s.ctx
+	socks5ClienTcpConn := s.socks5ClienTcpConn
+
+	// 建立到 socks5 客户端的连接的函数
+	socks5ClientListen := conf.Socks5ClientUdpListen
+	if socks5ClientListen == nil && conf.Socks5ClientUdpShared == nil {
+		cmdR.Cmd = Socks5CmdReplyInternalError
+		return fmt.Errorf("socks5ClientListen == nil")
+	}
+
+	// socks5 客户端发出 socks5 udp 请求的源地址
+	// 为 nil 表示不限制，否则需要检查来源。
+	var socks5ClientCmdUdpAddr *net.UDPAddr
+
+	// 获取 socks5 客户端的 udp 源地址
+	// 这里简单只检查 port 不能为 0(客户端要求限制的情况)
+	if conf.UdpAssociateCmdAddrCompatibility != true && cmd.Port != 0 {
+		ip, err := cmd.GetHostIp()
+		if err != nil {
+			cmdR.Cmd = Socks5CmdReplyAddressTypeNotSupported
+			return fmt.Errorf("cmd.GetHostIp, %V", err)
+		}
+
+		socks5ClientCmdUdpAddr = &net.UDPAddr{IP: ip, Port: int(cmd.Port)}
+		s.socks5ClientCmdUdpAddr = socks5ClientCmdUdpAddr
+	}
+
+	// 到客户端的连接
+	// 根据情况，可能是 dial 直接建立的到客户端的 udp 连接
+	// 可能能是 listen 建立的连接
+	dialClientCtx, dialClientCtxCancel := context.WithTimeout(ctx, conf.Socks5ClientUdpListenAndDialTimeout)
+	defer dialClientCtxCancel()
+	socks5ClientUdpConn, isDial, err := serverConnUdpSocks5ClientDial(dialClientCtx, conf, socks5ClientCmdUdpAddr, socks5ClienTcpConn)
+	if err != nil {
+		cmdR.Cmd = Socks5CmdReplyHostUnreachable
+		return fmt.Errorf("serverConnUdpSocks5ClientDial, %v", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = socks5ClientUdpConn.Close()
+		}
+	}()
+	s.socks5CliteUdpConn = socks5ClientUdpConn
+	s.socks5ClientIsDial = isDial
+
+	// 获得 socks5 客户端建立连接时连接到的服务器 udp 地址
+	socks5ClientAddr, err := getSocks5ListenUdpAddr(conf, socks5ClienTcpConn, socks5ClientUdpConn)
+	if err != nil {
+		cmdR.Cmd = Socks5CmdReplyInternalError
+		return fmt.Errorf("getSocks5ListenUdpAddr, %v", err)
+	}
+
+	err = cmdR.SetHostIp(socks5ClientAddr.IP)
+	if err != nil {
+		cmdR.Cmd = Socks5CmdReplyInternalError
+		return fmt.Errorf("cmdR.SetHostIp, %v", err)
+	}
+	cmdR.Port = uint16(socks5ClientAddr.Port)
+
+	return nil
+}
+
 func (s *udpServer) udpSend2Client() {
 	ctx := s.ctx
 	siteConn := s.udpSiteConn
-	socks5CliteUdpConn := s.socks5CliteUdpConn
 
-	readBuf := make([]byte, 2048)
-	writeBuf := make([]byte, 2048)
-	udpPack := Socks5UdpPack{}
+	maxSize := s.maxDatagramSize()
+	// 多读 1 字节，用来发现超出 maxSize 的包
+	readBuf := mempool.Get(maxSize + 1)
+	defer mempool.Put(readBuf)
+
 	for {
 		n, addr, err := siteConn.ReadFrom(readBuf)
 		select {
@@ -194,37 +344,35 @@ func (s *udpServer) udpSend2Client() {
 			return
 		}
 
-		udpPack.Data = readBuf[:n]
-
-		err = udpPack.SetAddr(addr)
-		if err != nil {
+		socks5ClientUdpAddr := s.getSocks5ClientAddr()
+		if socks5ClientUdpAddr == nil {
 			continue
 		}
-
-		_, err = udpPack.To(writeBuf)
-		if err != nil {
+		if s.udpNat.Inbound(socks5ClientUdpAddr, addr, time.Now()) == false {
+			s.drop(UdpDropNatFiltered)
 			continue
 		}
 
-		socks5ClientUdpAddr := s.getSocks5ClientAddr()
-		if socks5ClientUdpAddr == nil {
-			continue
-		}
+		// fake ip 及域名目标的回应，来源地址换回客户端请求时使用的地址
+		addr = s.replyAddr(addr)
 
-		_, err = socks5CliteUdpConn.WriteTo(writeBuf, socks5ClientUdpAddr)
-		if err != nil {
+		if n > maxSize {
+			s.drop(UdpDropOversize)
 			continue
 		}
+
+		_ = s.writeToClient(addr, readBuf[:n])
 	}
 }
 
 func (s *udpServer) udpSend2Site() {
 	ctx := s.ctx
 	socks5CliteUdpConn := s.socks5CliteUdpConn
-	udpSiteConn := s.udpSiteConn
 
+	maxSize := s.maxDatagramSize()
 	udpPack := Socks5UdpPack{}
-	readBuf := make([]byte, 2048)
+	readBuf := mempool.Get(MaxSocks5UdpHeaderSize + maxSize + 1)
+	defer mempool.Put(readBuf)
 
 	for {
 		n, addr, err := socks5CliteUdpConn.ReadFrom(readBuf)
@@ -236,6 +384,11 @@ func (s *udpServer) udpSend2Site() {
 		}
 
 		if err != nil {
+			// tcp 控制连接出错，结束 udp 关联
+			if s.udpOverTcp {
+				s.cancel()
+				return
+			}
 			continue
 		}
 
@@ -251,27 +404,502 @@ func (s *udpServer) udpSend2Site() {
 
 			if udpAddr.Port != a.Port || udpAddr.IP.Equal(a.IP) == false {
 				// 来源地址不正确
+				s.drop(UdpDropBadSource)
 				continue
 			}
 		}
 
+		// udpPack.Data 引用 readBuf，排队等待的数据需要各自复制
 		data := readBuf[:n]
-		err = udpPack.Parse(data)
+		err = udpPack.ParseNoCopy(data)
 		if err != nil {
+			s.drop(UdpDropMalformed)
+			continue
+		}
+		if len(udpPack.Data) > maxSize {
+			s.drop(UdpDropOversize)
 			continue
 		}
 
-		udpPackAddr, err := udpPack.GetUdpAddr()
+		s.setSocks5ClientUdpAddr(udpAddr)
+
+		s.sendMu.Lock()
+		err = s.route(&udpPack)
+		s.sendMu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// 决定 udpPack 的去向并发出，域名目标在解析完成后发出
+// 调用方需要持有 sendMu，只有写入失败时返回错误
+func (s *udpServer) route(udpPack *Socks5UdpPack) error {
+	if udpPack.ATYP == Socks5CmdAtypTypeDomain {
+		clientDst := &Addr{Atyp: Socks5CmdAtypTypeDomain, Domain: udpPack.Host, Port: udpPack.Port}
+		return s.domainRoute(udpPack.Host, int(udpPack.Port), clientDst, udpPack.Data)
+	}
+
+	dst, err := udpPack.GetUdpAddr()
+	if err != nil {
+		s.drop(UdpDropRoute)
+		return nil
+	}
+
+	// 目标为 fake ip 时换回域名
+	if f := s.conf.FakeIPLookup; f != nil {
+		if domain, ok := f(dst.IP); ok {
+			return s.domainRoute(domain, dst.Port, dst, udpPack.Data)
+		}
+	}
+
+	// 客户端直接使用 ip 时，该地址的回应不再换回域名
+	s.deleteReplyAddr(dst)
+
+	return s.forward(dst, dst, udpPack.Data)
+}
+
+// 检查、限速并发出发往 clientDst 的包，route 是实际发往的地址
+// 调用方需要持有 sendMu，只有写入失败时返回错误
+func (s *udpServer) forward(clientDst, route net.Addr, data []byte) error {
+	if s.checkDst(clientDst) == false || (route != clientDst && s.checkDst(route) == false) {
+		return nil
+	}
+
+	now := time.Now()
+	if s.udpPacketRate.Allow(1, now) == false {
+		s.drop(UdpDropPacketRate)
+		return nil
+	}
+	if s.udpByteRate.Allow(len(data), now) == false {
+		s.drop(UdpDropByteRate)
+		return nil
+	}
+
+	// 路由规则可能返回其他类型的地址，只有 udp 地址需要拦截 dns 及嗅探
+	udpPackAddr, _ := route.(*net.UDPAddr)
+	if udpPackAddr == nil {
+		return s.writeToSite(data, route)
+	}
+
+	if s.conf.UdpDnsHandler != nil && s.isUdpDnsServer(udpPackAddr) && s.interceptDns(udpPackAddr, clientDst, data) {
+		return nil
+	}
+
+	if s.conf.UdpSniff {
+		route, packets := s.sniffUdp(udpPackAddr, data)
+		// 嗅探可能改变去向，需要再次检查
+		if len(packets) != 0 && route != net.Addr(udpPackAddr) && s.checkDst(route) == false {
+			return nil
+		}
+		for _, v := range packets {
+			err := s.writeToSite(v, route)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return s.writeToSite(data, udpPackAddr)
+}
+
+// 发出域名目标(包括 fake ip 换回的域名)的包
+// 解析结果缓存在 udpDomainRoutes，未缓存时在单独的线程中解析，解析完成前的包暂存，
+// 避免慢速的解析阻塞其他目标的转发。
+// 调用方需要持有 sendMu，只有写入失败时返回错误
+func (s *udpServer) domainRoute(domain string, port int, clientDst net.Addr, data []byte) error {
+	key := net.JoinHostPort(domain, strconv.Itoa(port))
+	now := time.Now()
+
+	r := s.udpDomainRoutes[key]
+	if r != nil && r.resolving {
+		if len(r.pending) >= maxUdpRoutePending {
+			s.drop(UdpDropRoute)
+			return nil
+		}
+		// data 在 readBuf 中，之后会被覆盖
+		r.pending = append(r.pending, udpPendingPacket{clientDst: clientDst, data: append([]byte(nil), data...)})
+		return nil
+	}
+
+	if r != nil && now.Before(r.expire) {
+		if r.err != nil {
+			s.drop(UdpDropRoute)
+			return nil
+		}
+		s.setReplyAddr(r, clientDst)
+		return s.forward(clientDst, r.route, data)
+	}
+
+	select {
+	case s.udpLookupSem <- struct{}{}:
+	default:
+		s.drop(UdpDropRoute)
+		return nil
+	}
+
+	s.cleanUdpDomainRoutes(now)
+
+	r = &udpDomainRoute{
+		resolving: true,
+		pending:   []udpPendingPacket{{clientDst: clientDst, data: append([]byte(nil), data...)}},
+	}
+	s.udpDomainRoutes[key] = r
+
+	go func() {
+		defer func() { <-s.udpLookupSem }()
+
+		addr, route, err := s.resolveDomainRoute(domain, port)
+
+		s.sendMu.Lock()
+		defer s.sendMu.Unlock()
+
+		now := time.Now()
+		r.addr, r.route, r.err = addr, route, err
+		r.expire = now.Add(s.conf.UdpLookupIPCacheTime)
 		if err != nil {
+			// 解析失败时稍后重试
+			r.expire = now.Add(udpLookupIPFailCacheTime)
+		}
+		r.resolving = false
+
+		pending := r.pending
+		r.pending = nil
+
+		for _, v := range pending {
+			if err != nil || s.ctx.Err() != nil {
+				s.drop(UdpDropRoute)
+				continue
+			}
+
+			s.setReplyAddr(r, v.clientDst)
+			if s.forward(v.clientDst, route, v.data) != nil {
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// 记录过多时清除过期的目标，仍然过多时清除所有解析完成的目标
+func (s *udpServer) cleanUdpDomainRoutes(now time.Time) {
+	if len(s.udpDomainRoutes) < maxUdpSniffEntries {
+		return
+	}
+
+	for k, v := range s.udpDomainRoutes {
+		if v.resolving == false && now.After(v.expire) {
+			delete(s.udpDomainRoutes, k)
+		}
+	}
+
+	if len(s.udpDomainRoutes) >= maxUdpSniffEntries {
+		for k, v := range s.udpDomainRoutes {
+			if v.resolving == false {
+				delete(s.udpDomainRoutes, k)
+			}
+		}
+	}
+}
+
+// 记录 r 的回应需要换回 clientDst，与 r 同时过期
+func (s *udpServer) setReplyAddr(r *udpDomainRoute, clientDst net.Addr) {
+	s.udpReplyMu.Lock()
+	defer s.udpReplyMu.Unlock()
+
+	now := time.Now()
+	for _, addr := range []net.Addr{r.addr, r.route} {
+		if addr == nil {
 			continue
 		}
 
-		s.setSocks5ClientUdpAddr(udpAddr)
+		key := addr.String()
+		if v := s.udpReplyAddrs[key]; v != nil {
+			v.addr, v.expire = clientDst, r.expire
+			continue
+		}
+
+		if len(s.udpReplyAddrs) >= maxUdpSniffEntries {
+			for k, v := range s.udpReplyAddrs {
+				if now.After(v.expire) {
+					delete(s.udpReplyAddrs, k)
+				}
+			}
+			if len(s.udpReplyAddrs) >= maxUdpSniffEntries {
+				s.udpReplyAddrs = make(map[string]*udpReplyAddr)
+			}
+		}
+		s.udpReplyAddrs[key] = &udpReplyAddr{addr: clientDst, expire: r.expire}
+	}
+}
 
-		_, err = udpSiteConn.WriteTo(udpPack.Data, udpPackAddr)
+func (s *udpServer) deleteReplyAddr(addr net.Addr) {
+	s.udpReplyMu.Lock()
+	defer s.udpReplyMu.Unlock()
+
+	if len(s.udpReplyAddrs) != 0 {
+		delete(s.udpReplyAddrs, addr.String())
+	}
+}
+
+// 网站回应的来源地址 addr 需要换回的地址，没有记录或已过期时返回 addr
+func (s *udpServer) replyAddr(addr net.Addr) net.Addr {
+	s.udpReplyMu.Lock()
+	defer s.udpReplyMu.Unlock()
+
+	if len(s.udpReplyAddrs) == 0 {
+		return addr
+	}
+
+	key := addr.String()
+	v := s.udpReplyAddrs[key]
+	if v == nil {
+		return addr
+	}
+	if time.Now().After(v.expire) {
+		delete(s.udpReplyAddrs, key)
+		return addr
+	}
+	return v.addr
+}
+
+// 解析域名，并按 UdpDomainRoute 决定去向，返回解析出的地址及实际发往的地址
+func (s *udpServer) resolveDomainRoute(domain string, port int) (*net.UDPAddr, net.Addr, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.conf.UdpLookupIPTimeout)
+	defer cancel()
+
+	ips, err := s.conf.UdpLookupIP(ctx, domain)
+	if err != nil {
+		return nil, nil, fmt.Errorf("UdpLookupIP %v, %v", domain, err)
+	}
+	if len(ips) == 0 {
+		return nil, nil, fmt.Errorf("UdpLookupIP %v, no address", domain)
+	}
+
+	// 优先使用 ipv4
+	ip := ips[0]
+	for _, v := range ips {
+		if v.To4() != nil {
+			ip = v
+			break
+		}
+	}
+
+	addr := &net.UDPAddr{IP: ip, Port: port}
+
+	var route net.Addr = addr
+	if f := s.conf.UdpDomainRoute; f != nil {
+		r, err := f(ctx, domain, addr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("UdpDomainRoute %v, %v", domain, err)
+		}
+		if r != nil {
+			route = r
+		}
+	}
+
+	return addr, route, nil
+}
+
+func (s *udpServer) isUdpDnsServer(dst *net.UDPAddr) bool {
+	if len(s.conf.UdpDnsServers) == 0 {
+		return dst.Port == 53
+	}
+
+	for _, v := range s.conf.UdpDnsServers {
+		if v.Port == dst.Port && v.IP.Equal(dst.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// 拦截发往 dst 的 dns 查询，回应以 clientDst 为来源地址发回客户端
+// 返回 false 表示不是 dns 查询或无法处理，调用方应按原样转发
+func (s *udpServer) interceptDns(dst *net.UDPAddr, clientDst net.Addr, data []byte) bool {
+	query := dnsmessage.Message{}
+	err := query.Unpack(data)
+	if err != nil || query.Header.Response {
+		return false
+	}
+
+	select {
+	case s.udpDnsSem <- struct{}{}:
+	default:
+		return false
+	}
+
+	// 解析可能较慢，不能阻塞转发线程
+	// data 在 readBuf 中，之后会被覆盖
+	data = append([]byte(nil), data...)
+	go func() {
+		defer func() { <-s.udpDnsSem }()
+
+		ctx, cancel := context.WithTimeout(s.ctx, s.conf.UdpDnsTimeout)
+		defer cancel()
+
+		resp, err := s.conf.UdpDnsHandler(ctx, &query)
+		if err != nil {
+			resp = dns.NewResponse(&query, dnsmessage.RCodeServerFailure)
+		}
+
+		if resp == nil {
+			_ = s.writeToSite(data, dst)
+			return
+		}
+
+		b, err := resp.Pack()
 		if err != nil {
 			return
 		}
+
+		_ = s.writeToClient(clientDst, b)
+	}()
+
+	return true
+}
+
+// 按 UdpCheckDst 检查目标，不允许时记录丢弃
+func (s *udpServer) checkDst(dst net.Addr) bool {
+	f := s.conf.UdpCheckDst
+	if f == nil {
+		return true
+	}
+
+	if f(s.ctx, dst) != nil {
+		s.drop(UdpDropDenied)
+		return false
+	}
+	return true
+}
+
+func (s *udpServer) drop(r UdpDropReason) {
+	s.conf.UdpStats.addDrop(r)
+}
+
+// 向网站发出 data，并记录 nat 会话
+func (s *udpServer) writeToSite(data []byte, dst net.Addr) error {
+	socks5ClientUdpAddr := s.getSocks5ClientAddr()
+	if socks5ClientUdpAddr == nil {
+		return nil
+	}
+	s.udpNat.Outbound(socks5ClientUdpAddr, dst, time.Now())
+
+	_, err := s.udpSiteConn.WriteTo(data, dst)
+	return err
+}
+
+// 以 from 为来源地址向 socks5 客户端发出 data
+// from 为域名的 *Addr 时使用域名地址
+func (s *udpServer) writeToClient(from net.Addr, data []byte) error {
+	socks5ClientUdpAddr := s.getSocks5ClientAddr()
+	if socks5ClientUdpAddr == nil {
+		return fmt.Errorf("socks5 client udp addr is unknown")
+	}
+
+	udpPack := Socks5UdpPack{Data: data}
+	err := udpPack.SetAddr(from)
+	if err != nil {
+		return err
+	}
+
+	if len(data) > s.maxDatagramSize() {
+		return fmt.Errorf("datagram is too large, %v", len(data))
+	}
+
+	buf := mempool.Get(MaxSocks5UdpHeaderSize + len(data))
+	defer mempool.Put(buf)
+
+	n, err := udpPack.To(buf)
+	if err != nil {
+		return err
+	}
+
+	// Socks5ClientUdpDial 建立的是已连接的 udp 连接，不能使用 WriteTo
+	if c, ok := s.socks5CliteUdpConn.(net.Conn); ok && s.socks5ClientIsDial && c.RemoteAddr() != nil {
+		_, err = c.Write(buf[:n])
+		return err
+	}
+
+	_, err = s.socks5CliteUdpConn.WriteTo(buf[:n], socks5ClientUdpAddr)
+	return err
+}
+
+// 嗅探发往 dst 的包
+// 返回包发往的地址及现在需要发出的包，嗅探未完成或目标被禁止时不返回包
+func (s *udpServer) sniffUdp(dst *net.UDPAddr, data []byte) (net.Addr, [][]byte) {
+	key := dst.String()
+	now := time.Now()
+
+	st := s.udpSniffs[key]
+	if st == nil {
+		s.cleanUdpSniffs(now)
+
+		st = &udpSniffState{}
+		s.udpSniffs[key] = st
+	}
+	st.lastUsed = now
+
+	if st.done {
+		if st.err != nil {
+			s.drop(UdpDropSniffDenied)
+			return nil, nil
+		}
+		return st.route, [][]byte{data}
+	}
+
+	hello, err := st.sniffer.Feed(data)
+	if err == sniff.ErrNeedMore && len(st.pending) < maxUdpSniffPending {
+		st.pending = append(st.pending, append([]byte(nil), data...))
+		return nil, nil
+	}
+
+	r := &sniff.Result{Addr: key}
+	if err == nil || err == sniff.ErrNeedMore {
+		r.Protocol = sniff.ProtocolQUIC
+	}
+	if hello != nil {
+		r.Domain = hello.ServerName
+	}
+
+	packets := append(st.pending, data)
+	st.pending = nil
+	st.done = true
+	st.route = dst
+
+	if f := s.conf.UdpSniffRoute; f != nil {
+		route, err := f(sniff.NewContext(s.ctx, r), dst, r)
+		if err != nil {
+			st.err = err
+			for range packets {
+				s.drop(UdpDropSniffDenied)
+			}
+			return nil, nil
+		}
+		if route != nil {
+			st.route = route
+		}
+	}
+
+	return st.route, packets
+}
+
+// 记录过多时清除空闲的目标，仍然过多时全部清除
+func (s *udpServer) cleanUdpSniffs(now time.Time) {
+	if len(s.udpSniffs) < maxUdpSniffEntries {
+		return
+	}
+
+	for k, v := range s.udpSniffs {
+		if now.Sub(v.lastUsed) > udpSniffIdleTimeout {
+			delete(s.udpSniffs, k)
+		}
+	}
+
+	if len(s.udpSniffs) >= maxUdpSniffEntries {
+		s.udpSniffs = make(map[string]*udpSniffState)
 	}
 }
 
@@ -293,12 +921,20 @@ func (s *udpServer) Close() {
 	}
 }
 
+func (s *udpServer) maxDatagramSize() int {
+	if n := s.conf.UdpMaxDatagramSize; n > 0 && n < MaxUdpDatagramSize {
+		return n
+	}
+	return MaxUdpDatagramSize
+}
+
 func (s *udpServer) getSocks5ClientAddr() *net.UDPAddr {
 	if addr := s.socks5ClientCmdUdpAddr; addr != nil {
 		return addr
 	}
 
-	return s.socks5ClientAddr.Load().(*net.UDPAddr)
+	addr, _ := s.socks5ClientAddr.Load().(*net.UDPAddr)
+	return addr
 }
 
 func (s *udpServer) setSocks5ClientUdpAddr(addr *net.UDPAddr) {
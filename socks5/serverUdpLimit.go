@@ -0,0 +1,206 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// udp 包被丢弃的原因
+type UdpDropReason int
+
+const (
+	// 来源地址与客户端在 UDP ASSOCIATE 请求中提供的地址不同
+	UdpDropBadSource UdpDropReason = iota
+	// 无法解析的 socks5 udp 包
+	UdpDropMalformed
+	// 超过 UdpMaxDatagramSize
+	UdpDropOversize
+	// 目标域名解析或路由失败
+	UdpDropRoute
+	// 目标被 UdpCheckDst 拒绝
+	UdpDropDenied
+	// 超过 UdpMaxPacketsPerSecond
+	UdpDropPacketRate
+	// 超过 UdpMaxBytesPerSecond
+	UdpDropByteRate
+	// 网站发来的包被 UdpNatFilter 过滤
+	UdpDropNatFiltered
+	// 目标被 UdpSniffRoute 拒绝
+	UdpDropSniffDenied
+
+	udpDropReasonCount
+)
+
+func (r UdpDropReason) String() string {
+	switch r {
+	case UdpDropBadSource:
+		return "bad-source"
+	case UdpDropMalformed:
+		return "malformed"
+	case UdpDropOversize:
+		return "oversize"
+	case UdpDropRoute:
+		return "route"
+	case UdpDropDenied:
+		return "denied"
+	case UdpDropPacketRate:
+		return "packet-rate"
+	case UdpDropByteRate:
+		return "byte-rate"
+	case UdpDropNatFiltered:
+		return "nat-filtered"
+	case UdpDropSniffDenied:
+		return "sniff-denied"
+	default:
+		return "unknown"
+	}
+}
+
+// udp 关联的统计，可以被多个服务器、udp 关联共用
+type UdpStats struct {
+	drops [udpDropReasonCount]uint64
+}
+
+func (s *UdpStats) addDrop(r UdpDropReason) {
+	if s == nil || r < 0 || r >= udpDropReasonCount {
+		return
+	}
+	atomic.AddUint64(&s.drops[r], 1)
+}
+
+// 因 r 丢弃的包数量
+func (s *UdpStats) Drops(r UdpDropReason) uint64 {
+	if r < 0 || r >= udpDropReasonCount {
+		return 0
+	}
+	return atomic.LoadUint64(&s.drops[r])
+}
+
+// 各原因丢弃的包数量，不包含数量为 0 的原因
+func (s *UdpStats) AllDrops() map[UdpDropReason]uint64 {
+	m := make(map[UdpDropReason]uint64)
+	for r := UdpDropReason(0); r < udpDropReasonCount; r++ {
+		if v := s.Drops(r); v != 0 {
+			m[r] = v
+		}
+	}
+	return m
+}
+
+// udp 目标规则，Check 可以直接作为 ServerConfig.UdpCheckDst 使用
+// 先检查 Deny，再检查 Allow，Allow 为空表示允许所有。
+// 目标为域名时只检查端口，解析出的 ip 会再次检查。
+type UdpDstRules struct {
+	AllowNets  []*net.IPNet
+	DenyNets   []*net.IPNet
+	AllowPorts []int
+	DenyPorts  []int
+}
+
+// 解析 cidr 列表，例如 10.0.0.0/8
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	r := make([]*net.IPNet, 0, len(cidrs))
+	for _, v := range cidrs {
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("net.ParseCIDR, %v", err)
+		}
+		r = append(r, n)
+	}
+	return r, nil
+}
+
+func (r *UdpDstRules) Check(ctx context.Context, dst net.Addr) error {
+	var ip net.IP
+	var port int
+
+	switch a := dst.(type) {
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	case *Addr:
+		ip, port = a.IP, int(a.Port)
+	default:
+		return fmt.Errorf("unexpected addr %v", dst)
+	}
+
+	if containsPort(r.DenyPorts, port) {
+		return fmt.Errorf("port %v is denied", port)
+	}
+	if len(r.AllowPorts) != 0 && containsPort(r.AllowPorts, port) == false {
+		return fmt.Errorf("port %v is not allowed", port)
+	}
+
+	if ip == nil {
+		return nil
+	}
+
+	if containsIP(r.DenyNets, ip) {
+		return fmt.Errorf("ip %v is denied", ip)
+	}
+	if len(r.AllowNets) != 0 && containsIP(r.AllowNets, ip) == false {
+		return fmt.Errorf("ip %v is not allowed", ip)
+	}
+
+	return nil
+}
+
+func containsPort(ports []int, port int) bool {
+	for _, v := range ports {
+		if v == port {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, v := range nets {
+		if v.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 令牌桶，允许 1 秒的突发，不是并发安全的，udpServer 中由 sendMu 保护
+type udpRateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newUdpRateLimiter(rate int) *udpRateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &udpRateLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+	}
+}
+
+// 是否允许消耗 n 个令牌，limiter 为 nil 时不限制
+func (l *udpRateLimiter) Allow(n int, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+
+	if l.last.IsZero() == false {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+	}
+	l.last = now
+
+	if l.tokens < float64(n) {
+		return false
+	}
+
+	l.tokens -= float64(n)
+	return true
+}
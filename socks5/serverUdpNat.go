@@ -0,0 +1,187 @@
+package socks5
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+// udp 关联的 nat 过滤行为，rfc4787 5
+// 映射总是端点无关的，一个 udp 关联只使用一个到网站的 udp 连接
+type UdpNatFilter int
+
+const (
+	// 端点无关过滤(full cone)，任何地址发来的包都转发给客户端
+	UdpNatFilterEndpointIndependent UdpNatFilter = iota
+	// 地址相关过滤，只转发客户端发送过数据的 ip 发来的包
+	UdpNatFilterAddressDependent
+	// 地址及端口相关过滤，只转发客户端发送过数据的 ip:端口 发来的包
+	UdpNatFilterAddressAndPortDependent
+)
+
+func (f UdpNatFilter) String() string {
+	switch f {
+	case UdpNatFilterEndpointIndependent:
+		return "endpoint-independent"
+	case UdpNatFilterAddressDependent:
+		return "address-dependent"
+	case UdpNatFilterAddressAndPortDependent:
+		return "address-and-port-dependent"
+	default:
+		return "unknown"
+	}
+}
+
+// udp 关联的 nat 会话表
+// 记录 客户端 -> 目标 的会话，会话空闲超时后失效，决定网站发来的包是否转发给客户端。
+// 会话按最近使用的顺序排列，数量达到上限时替换最久未使用的会话。
+// 所有过滤行为都会记录会话，网站发来的包匹配会话时更新使用顺序，但不刷新空闲超时。
+type udpNatTable struct {
+	filter      UdpNatFilter
+	idleTimeout time.Duration
+	maxMappings int
+
+	m sync.Mutex
+	// 值为 lru 中的元素，Value 为 *udpNatSession
+	sessions map[udpNatKey]*list.Element
+	// 最近使用的会话在前
+	lru *list.List
+	// 地址相关过滤使用，dst 只有 ip
+	hosts map[udpNatKey]*udpNatHostEntry
+}
+
+type udpNatKey struct {
+	client string
+	dst    string
+}
+
+type udpNatSession struct {
+	key     udpNatKey
+	hostKey udpNatKey
+	// 最后一次发出数据的时间
+	last time.Time
+}
+
+type udpNatHostEntry struct {
+	// 该 ip 的会话中最后一次发出数据的时间
+	last time.Time
+	// 该 ip 的会话数量
+	refs int
+}
+
+func newUdpNatTable(filter UdpNatFilter, idleTimeout time.Duration, maxMappings int) *udpNatTable {
+	return &udpNatTable{
+		filter:      filter,
+		idleTimeout: idleTimeout,
+		maxMappings: maxMappings,
+		sessions:    make(map[udpNatKey]*list.Element),
+		lru:         list.New(),
+		hosts:       make(map[udpNatKey]*udpNatHostEntry),
+	}
+}
+
+func udpNatHost(addr net.Addr) string {
+	if a, ok := addr.(*net.UDPAddr); ok {
+		return a.IP.String()
+	}
+	return addr.String()
+}
+
+// 客户端向 dst 发出数据，记录或刷新会话
+// 会话数量达到上限时替换最久未使用的会话
+func (t *udpNatTable) Outbound(client, dst net.Addr, now time.Time) {
+	key := udpNatKey{client.String(), dst.String()}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	host := t.hosts[udpNatKey{key.client, udpNatHost(dst)}]
+
+	if e := t.sessions[key]; e != nil {
+		e.Value.(*udpNatSession).last = now
+		host.last = now
+		t.lru.MoveToFront(e)
+		return
+	}
+
+	t.cleanLocked(now)
+	for t.maxMappings > 0 && t.lru.Len() >= t.maxMappings {
+		t.removeLocked(t.lru.Back())
+	}
+
+	session := &udpNatSession{
+		key:     key,
+		hostKey: udpNatKey{key.client, udpNatHost(dst)},
+		last:    now,
+	}
+	t.sessions[key] = t.lru.PushFront(session)
+
+	host = t.hosts[session.hostKey]
+	if host == nil {
+		host = &udpNatHostEntry{}
+		t.hosts[session.hostKey] = host
+	}
+	host.last = now
+	host.refs++
+}
+
+// 网站 src 发往客户端的数据是否允许转发
+func (t *udpNatTable) Inbound(client, src net.Addr, now time.Time) bool {
+	key := udpNatKey{client.String(), src.String()}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	e := t.sessions[key]
+	if e != nil {
+		if t.expired(e.Value.(*udpNatSession).last, now) {
+			t.removeLocked(e)
+			e = nil
+		} else {
+			t.lru.MoveToFront(e)
+		}
+	}
+
+	switch t.filter {
+	case UdpNatFilterEndpointIndependent:
+		return true
+	case UdpNatFilterAddressDependent:
+		host := t.hosts[udpNatKey{key.client, udpNatHost(src)}]
+		return host != nil && t.expired(host.last, now) == false
+	default:
+		return e != nil
+	}
+}
+
+// 会话数量
+func (t *udpNatTable) Len() int {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	return t.lru.Len()
+}
+
+func (t *udpNatTable) expired(last, now time.Time) bool {
+	return t.idleTimeout > 0 && now.Sub(last) > t.idleTimeout
+}
+
+func (t *udpNatTable) removeLocked(e *list.Element) {
+	session := t.lru.Remove(e).(*udpNatSession)
+	delete(t.sessions, session.key)
+
+	if host := t.hosts[session.hostKey]; host != nil {
+		host.refs--
+		if host.refs <= 0 {
+			delete(t.hosts, session.hostKey)
+		}
+	}
+}
+
+// 清除空闲超时的会话
+// 只检查最久未使用的一端，其余过期会话在数量达到上限或匹配时清除
+func (t *udpNatTable) cleanLocked(now time.Time) {
+	for e := t.lru.Back(); e != nil && t.expired(e.Value.(*udpNatSession).last, now); e = t.lru.Back() {
+		t.removeLocked(e)
+	}
+}
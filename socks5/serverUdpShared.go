@@ -0,0 +1,408 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// 每个 udp 关联最多暂存的包，超出时丢弃
+const udpSharedQueueSize = 128
+
+// 共用 udp 端口
+// 所有 udp 关联共用一个 udp 端口，防火墙只需要放行这一个端口。
+// 收到的包按以下顺序分配给 udp 关联：
+//  1. 已记录的客户端来源地址，包括客户端在 UDP ASSOCIATE 请求中提供的地址
+//  2. UdpSharedConfig.MatchToken 开启时，RSV 字段非 0 的包按令牌与 tcp 控制连接的客户端端口及 ip 匹配(UdpClient.UdpToken)
+//  3. UdpSharedConfig.MatchIP 开启时，来自同一 ip、尚未收到过包的 udp 关联中最早建立的一个
+//
+// 之后该来源地址的包都分配给这个 udp 关联。tcp 控制连接关闭后 udp 关联的记录被删除。
+// 默认只按 UDP ASSOCIATE 请求中的地址匹配，客户端需要提供 udp 地址(UdpClient.BindLocalAddr)。
+type UdpSharedListener struct {
+	conn net.PacketConn
+	conf UdpSharedConfig
+
+	m       sync.Mutex
+	byAddr  map[string]*udpSharedConn
+	byToken map[udpSharedToken]*udpSharedConn
+	// 尚未收到过包的 udp 关联，键为客户端 ip，按建立顺序排列
+	pending map[string][]*udpSharedConn
+	closed  bool
+}
+
+type udpSharedToken struct {
+	ip    string
+	token uint16
+}
+
+// 共用 udp 端口的配置
+type UdpSharedConfig struct {
+	// 按 RSV 字段中的令牌匹配 udp 关联
+	// 令牌是 tcp 控制连接的客户端端口，容易被猜到，与客户端同一 ip 的其他主机(例如同一 nat 后)
+	// 可以抢先发包劫持 udp 关联，只应在客户端可信的网络中开启。
+	MatchToken bool
+	// 来源地址没有匹配时，分配给同一 ip 尚未收到过包的 udp 关联中最早建立的一个
+	// 用于经过 nat、无法提供 udp 地址的客户端，风险同 MatchToken。
+	MatchIP bool
+}
+
+func (c *UdpSharedConfig) Default() {
+	*c = UdpSharedConfig{
+		MatchToken: false,
+		MatchIP:    false,
+	}
+}
+
+// 在 conn 上提供共用 udp 端口，conn 由 UdpSharedListener 负责关闭
+// 使用默认配置，只按 UDP ASSOCIATE 请求中的地址匹配
+func NewUdpSharedListener(conn net.PacketConn) *UdpSharedListener {
+	conf := UdpSharedConfig{}
+	conf.Default()
+	return NewUdpSharedListenerWithConfig(conn, &conf)
+}
+
+func NewUdpSharedListenerWithConfig(conn net.PacketConn, conf *UdpSharedConfig) *UdpSharedListener {
+	l := &UdpSharedListener{
+		conn:    conn,
+		conf:    *conf,
+		byAddr:  make(map[string]*udpSharedConn),
+		byToken: make(map[udpSharedToken]*udpSharedConn),
+		pending: make(map[string][]*udpSharedConn),
+	}
+
+	go l.serve()
+
+	return l
+}
+
+func (l *UdpSharedListener) serve() {
+	defer l.Close()
+
+	buf := make([]byte, MaxSocks5UdpHeaderSize+MaxUdpDatagramSize)
+	for {
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+
+		udpAddr, _ := addr.(*net.UDPAddr)
+		if udpAddr == nil || n < 2 {
+			continue
+		}
+
+		c := l.lookup(udpAddr, binary.BigEndian.Uint16(buf))
+		if c == nil {
+			continue
+		}
+
+		c.push(append([]byte(nil), buf[:n]...), udpAddr)
+	}
+}
+
+func (l *UdpSharedListener) lookup(addr *net.UDPAddr, token uint16) *udpSharedConn {
+	key := addr.String()
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if c := l.byAddr[key]; c != nil {
+		return c
+	}
+
+	ip := addr.IP.String()
+	var c *udpSharedConn
+
+	if token != 0 && l.conf.MatchToken {
+		c = l.byToken[udpSharedToken{ip, token}]
+	}
+
+	if c == nil && l.conf.MatchIP {
+		for _, v := range l.pending[ip] {
+			if v.bound == false {
+				c = v
+				break
+			}
+		}
+	}
+
+	if c == nil {
+		return nil
+	}
+
+	l.bindLocked(c, key)
+	return c
+}
+
+func (l *UdpSharedListener) bindLocked(c *udpSharedConn, key string) {
+	c.bound = true
+	c.addrs = append(c.addrs, key)
+	l.byAddr[key] = c
+
+	l.removePendingLocked(c)
+}
+
+func (l *UdpSharedListener) removePendingLocked(c *udpSharedConn) {
+	list := l.pending[c.clientIP]
+	for i, v := range list {
+		if v == c {
+			list = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(l.pending, c.clientIP)
+	} else {
+		l.pending[c.clientIP] = list
+	}
+}
+
+// 为 tcp 控制连接 tcpConn 建立 udp 关联
+// cmdAddr 为客户端在 UDP ASSOCIATE 请求中提供的地址，未提供时为 nil
+func (l *UdpSharedListener) Listen(tcpConn net.Conn, cmdAddr *net.UDPAddr) (net.PacketConn, error) {
+	remote, _ := tcpConn.RemoteAddr().(*net.TCPAddr)
+	if remote == nil {
+		return nil, fmt.Errorf("非预期的 tcp 远端地址, %#v", tcpConn.RemoteAddr())
+	}
+
+	hasCmdAddr := cmdAddr != nil && cmdAddr.Port != 0
+	if hasCmdAddr == false && l.conf.MatchToken == false && l.conf.MatchIP == false {
+		return nil, fmt.Errorf("客户端未提供 udp 地址，无法匹配 udp 关联")
+	}
+
+	c := &udpSharedConn{
+		l:             l,
+		clientIP:      remote.IP.String(),
+		token:         udpSharedToken{remote.IP.String(), uint16(remote.Port)},
+		packets:       make(chan udpSharedPacket, udpSharedQueueSize),
+		done:          make(chan struct{}),
+		readDeadline:  newUdpSharedDeadline(),
+		writeDeadline: newUdpSharedDeadline(),
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.closed {
+		return nil, fmt.Errorf("listener is closed")
+	}
+
+	l.byToken[c.token] = c
+
+	if hasCmdAddr {
+		// ip 为 0 时使用 tcp 控制连接的 ip
+		addr := *cmdAddr
+		if len(addr.IP) == 0 || addr.IP.IsUnspecified() {
+			addr.IP = remote.IP
+		}
+		c.clientIP = addr.IP.String()
+		l.bindLocked(c, addr.String())
+	} else {
+		l.pending[c.clientIP] = append(l.pending[c.clientIP], c)
+	}
+
+	return c, nil
+}
+
+// 删除 c 的记录
+func (l *UdpSharedListener) remove(c *udpSharedConn) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	for _, v := range c.addrs {
+		if l.byAddr[v] == c {
+			delete(l.byAddr, v)
+		}
+	}
+	if l.byToken[c.token] == c {
+		delete(l.byToken, c.token)
+	}
+	l.removePendingLocked(c)
+}
+
+// udp 关联数量
+func (l *UdpSharedListener) Len() int {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	return len(l.byToken)
+}
+
+func (l *UdpSharedListener) LocalAddr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+func (l *UdpSharedListener) Close() error {
+	l.m.Lock()
+	l.closed = true
+	l.m.Unlock()
+
+	return l.conn.Close()
+}
+
+type udpSharedPacket struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+// 共用 udp 端口上的一个 udp 关联
+type udpSharedConn struct {
+	l        *UdpSharedListener
+	clientIP string
+	token    udpSharedToken
+
+	// 以下字段由 l.m 保护
+	bound bool
+	addrs []string
+
+	packets   chan udpSharedPacket
+	done      chan struct{}
+	closeOnce sync.Once
+
+	readDeadline  udpSharedDeadline
+	writeDeadline udpSharedDeadline
+}
+
+func (c *udpSharedConn) push(data []byte, addr *net.UDPAddr) {
+	select {
+	case c.packets <- udpSharedPacket{data, addr}:
+	case <-c.done:
+	default:
+		// 客户端处理不过来时丢弃
+	}
+}
+
+func (c *udpSharedConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	// 超时已到时不再读取暂存的包
+	select {
+	case <-c.readDeadline.wait():
+		return 0, nil, &net.OpError{Op: "read", Net: "udp", Err: udpSharedTimeoutError{}}
+	default:
+	}
+
+	select {
+	case p := <-c.packets:
+		n := copy(b, p.data)
+		return n, p.addr, nil
+	case <-c.done:
+		return 0, nil, fmt.Errorf("use of closed connection")
+	case <-c.readDeadline.wait():
+		return 0, nil, &net.OpError{Op: "read", Net: "udp", Err: udpSharedTimeoutError{}}
+	}
+}
+
+// 共用的 udp 端口不能单独设置写超时，超时已到时直接返回错误
+// udp 写入一般不会阻塞，所以只在写入前检查。
+func (c *udpSharedConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.done:
+		return 0, fmt.Errorf("use of closed connection")
+	case <-c.writeDeadline.wait():
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: addr, Err: udpSharedTimeoutError{}}
+	default:
+	}
+
+	return c.l.conn.WriteTo(b, addr)
+}
+
+func (c *udpSharedConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.l.remove(c)
+	})
+	return nil
+}
+
+func (c *udpSharedConn) LocalAddr() net.Addr {
+	return c.l.conn.LocalAddr()
+}
+
+func (c *udpSharedConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// 修改超时会唤醒阻塞中的 ReadFrom
+func (c *udpSharedConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *udpSharedConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// 可以随时修改的超时，到期时关闭 wait 返回的 channel
+// 修改超时时阻塞在旧 channel 上的读取也会被唤醒。
+type udpSharedDeadline struct {
+	m      sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newUdpSharedDeadline() udpSharedDeadline {
+	return udpSharedDeadline{cancel: make(chan struct{})}
+}
+
+func (d *udpSharedDeadline) set(t time.Time) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	// 定时器已经触发时等待它关闭 cancel
+	if d.timer != nil && d.timer.Stop() == false {
+		<-d.cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+
+	if closed == false {
+		close(d.cancel)
+	}
+}
+
+func (d *udpSharedDeadline) wait() chan struct{} {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	return d.cancel
+}
+
+func isClosedChan(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+type udpSharedTimeoutError struct{}
+
+func (udpSharedTimeoutError) Error() string   { return "i/o timeout" }
+func (udpSharedTimeoutError) Timeout() bool   { return true }
+func (udpSharedTimeoutError) Temporary() bool { return true }
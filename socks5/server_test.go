@@ -3,11 +3,20 @@ package socks5
 import (
 	"bytes"
 	"context"
+	"fmt"
+	"io"
 	"math/rand"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/gamexg/proxyclient"
+	"github.com/gamexg/proxylib/dns"
+	"github.com/gamexg/proxylib/sniff"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 func TestConnIsIpv6(t *testing.T) {
@@ -39,7 +48,7 @@ func TestServeConn(t *testing.T) {
 			case <-ctx.Done():
 				return
 			default:
-				t.Fatal(err)
+				t.Error(err)
 			}
 		}
 	}()
@@ -50,13 +59,15 @@ func TestServeConn(t *testing.T) {
 		UdpAddr: "127.0.0.1:4521",
 	}
 	echoServer := NewEchoServer(&echoServerConf)
-	func() {
-		err := echoServer.Listen()
-		if err != nil {
-			t.Fatal(err)
-		}
-		defer echoServer.Close()
+	err := echoServer.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoServer.Close()
+	// 先于 echoServer.Close 执行，使得 Serve 的关闭错误被忽略
+	defer cancel()
 
+	func() {
 		go func() {
 			err := echoServer.Serve()
 			if err != nil {
@@ -97,7 +108,8 @@ func TestServeConn(t *testing.T) {
 			for _, v := range dataList {
 				_, err := c.Write(v)
 				if err != nil {
-					t.Fatal(err)
+					t.Error(err)
+					return
 				}
 			}
 		}()
@@ -125,3 +137,1464 @@ func TestServeConn(t *testing.T) {
 	}()
 
 }
+
+// 建立一对 tcp 连接，用于测试半关闭
+func testTcpPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c2, err := ln.Accept()
+	if err != nil {
+		_ = c1.Close()
+		t.Fatal(err)
+	}
+
+	return c1, c2
+}
+
+func TestServeConn_ConnectRelayEnd(t *testing.T) {
+	// 建立 CONNECT 隧道，返回客户端连接、网站端连接及 ServeConn 的结果
+	connect := func(t *testing.T, ctx context.Context) (net.Conn, net.Conn, chan error) {
+		client, server := testTcpPair(t)
+		t.Cleanup(func() { _ = client.Close() })
+
+		siteClient, siteServer := net.Pipe()
+		t.Cleanup(func() { _ = siteServer.Close() })
+
+		conf := ServerConfig{}
+		conf.Default()
+		conf.SiteTcpDialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return siteClient, nil
+		}
+
+		serveErr := make(chan error, 1)
+		go func() {
+			serveErr <- ServeConn(ctx, server, &conf)
+		}()
+
+		clientConf := ClientConfig{
+			Socks5ShakeHandsTimeout: 5 * time.Second,
+			Socks5CmdRTimeout:       5 * time.Second,
+		}
+		err := ClientTcpConn(context.Background(), &clientConf, client, "tcp", "1.2.3.4:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return client, siteServer, serveErr
+	}
+
+	wait := func(t *testing.T, serveErr chan error) error {
+		select {
+		case err := <-serveErr:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("ServeConn did not return")
+			return nil
+		}
+	}
+
+	// 客户端半关闭后结束转发，并关闭到网站的连接
+	t.Run("half-close", func(t *testing.T) {
+		client, siteServer, serveErr := connect(t, context.Background())
+
+		err := client.(*net.TCPConn).CloseWrite()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = wait(t, serveErr)
+		if err == nil || strings.Contains(err.Error(), "clientConn.Read") == false {
+			t.Fatalf("err = %v", err)
+		}
+
+		_ = siteServer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = siteServer.Read(make([]byte, 1))
+		if err != io.EOF {
+			t.Fatalf("siteServer.Read, err = %v", err)
+		}
+	})
+
+	// ctx 取消后立即中断空闲的转发，不等待 ForwardTimeout
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		_, _, serveErr := connect(t, ctx)
+
+		cancel()
+
+		err := wait(t, serveErr)
+		if err != context.Canceled {
+			t.Fatalf("err = %v", err)
+		}
+	})
+}
+
+func TestServeConn_Sniff(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	siteClient, siteServer := net.Pipe()
+	defer siteServer.Close()
+
+	type dialInfo struct {
+		addr   string
+		result *sniff.Result
+	}
+	dialChan := make(chan dialInfo, 1)
+
+	conf := ServerConfig{}
+	conf.Default()
+	conf.Sniff = true
+	conf.SiteTcpDialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialChan <- dialInfo{address, sniff.FromContext(ctx)}
+		return siteClient, nil
+	}
+
+	go func() {
+		_ = ServeConn(context.Background(), server, &conf)
+	}()
+
+	clientConf := ClientConfig{
+		Socks5ShakeHandsTimeout: 5 * time.Second,
+		Socks5CmdRTimeout:       5 * time.Second,
+	}
+	err := ClientTcpConn(context.Background(), &clientConf, client, "tcp", "1.2.3.4:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := []byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n")
+	go func() {
+		_, _ = client.Write(request)
+	}()
+
+	info := <-dialChan
+	if info.addr != "www.example.com:80" ||
+		info.result == nil ||
+		info.result.Addr != "1.2.3.4:80" ||
+		info.result.Protocol != sniff.ProtocolHTTP {
+		t.Fatalf("info = %#v, result = %#v", info, info.result)
+	}
+
+	// 嗅探读取的数据需要原样发往网站
+	buf := make([]byte, len(request))
+	_, err = io.ReadFull(siteServer, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(buf, request) == false {
+		t.Fatalf("buf = %q", buf)
+	}
+}
+
+func TestServeConn_SniffCheck(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	conf := ServerConfig{}
+	conf.Default()
+	conf.Sniff = true
+	conf.SiteTcpDialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		t.Error("unexpected dial")
+		return nil, fmt.Errorf("unexpected dial")
+	}
+	conf.SniffCheck = func(ctx context.Context, r *sniff.Result) error {
+		if r.Protocol == sniff.ProtocolBitTorrent {
+			return fmt.Errorf("bittorrent is forbidden")
+		}
+		return nil
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- ServeConn(context.Background(), server, &conf)
+	}()
+
+	clientConf := ClientConfig{
+		Socks5ShakeHandsTimeout: 5 * time.Second,
+		Socks5CmdRTimeout:       5 * time.Second,
+	}
+	err := ClientTcpConn(context.Background(), &clientConf, client, "tcp", "1.2.3.4:6881")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		_, _ = client.Write([]byte("\x13BitTorrent protocol\x00\x00\x00\x00\x00\x00\x00\x00"))
+	}()
+
+	err = <-serveErr
+	if err == nil || strings.Contains(err.Error(), "bittorrent is forbidden") == false {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestUdpServer_SniffUdp(t *testing.T) {
+	routeAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9999}
+	calls := 0
+
+	conf := ServerConfig{}
+	conf.Default()
+	conf.UdpSniff = true
+	conf.UdpStats = &UdpStats{}
+	conf.UdpSniffRoute = func(ctx context.Context, dst *net.UDPAddr, r *sniff.Result) (net.Addr, error) {
+		calls++
+		if sniff.FromContext(ctx) != r || r.Addr != dst.String() || r.Protocol != sniff.ProtocolUnknown {
+			t.Errorf("r = %#v", r)
+		}
+		if dst.Port == 53 {
+			return nil, fmt.Errorf("forbidden")
+		}
+		return routeAddr, nil
+	}
+
+	s := newUdpServer(context.Background(), &conf, nil, nil, nil)
+
+	dst := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 443}
+	for i := 0; i < 2; i++ {
+		route, packets := s.sniffUdp(dst, []byte("data"))
+		if route != routeAddr || len(packets) != 1 || string(packets[0]) != "data" {
+			t.Fatalf("route = %v, packets = %q", route, packets)
+		}
+	}
+
+	// 被拒绝的目标之后的包同样需要记录丢弃
+	for i := 0; i < 2; i++ {
+		_, packets := s.sniffUdp(&net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}, []byte("data"))
+		if len(packets) != 0 {
+			t.Fatalf("packets = %q", packets)
+		}
+	}
+
+	if calls != 2 {
+		t.Fatalf("calls = %v", calls)
+	}
+
+	if n := conf.UdpStats.Drops(UdpDropSniffDenied); n != 2 {
+		t.Fatalf("drops = %v", n)
+	}
+}
+
+func TestUdpServer_InterceptDns(t *testing.T) {
+	conf := ServerConfig{}
+	conf.Default()
+	conf.UdpDnsHandler = dns.HostsHandler(map[string][]net.IP{
+		"www.example.com": {net.IPv4(1, 2, 3, 4)},
+	})
+
+	s := newUdpServer(context.Background(), &conf, nil, nil, nil)
+	defer s.cancel()
+
+	serverConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	clientConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	s.socks5CliteUdpConn = serverConn
+	s.setSocks5ClientUdpAddr(clientConn.LocalAddr().(*net.UDPAddr))
+
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 1},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName("www.example.com."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	data, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53}
+	if s.isUdpDnsServer(dst) == false || s.isUdpDnsServer(&net.UDPAddr{IP: dst.IP, Port: 443}) {
+		t.Fatal("isUdpDnsServer")
+	}
+	if s.interceptDns(dst, dst, []byte("not dns")) {
+		t.Fatal("intercepted non dns packet")
+	}
+	if s.interceptDns(dst, dst, data) == false {
+		t.Fatal("not intercepted")
+	}
+
+	_ = clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := clientConn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 回应需要来自原 dns 服务器地址
+	udpPack := Socks5UdpPack{}
+	err = udpPack.Parse(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, _ := udpPack.GetUdpAddr()
+	if from.String() != dst.String() {
+		t.Fatalf("from = %v", from)
+	}
+
+	resp := dnsmessage.Message{}
+	err = resp.Unpack(udpPack.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.ID != 1 || len(resp.Answers) != 1 {
+		t.Fatalf("resp = %#v", resp)
+	}
+}
+
+func TestServeConn_FakeIP(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	fake, err := dns.NewFakeIP("198.18.0.0/15", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip, _ := fake.Alloc("www.example.com")
+
+	dialChan := make(chan string, 1)
+
+	conf := ServerConfig{}
+	conf.Default()
+	conf.FakeIPLookup = fake.Lookup
+	conf.SiteTcpDialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialChan <- address
+		return nil, fmt.Errorf("refused")
+	}
+
+	go func() {
+		_ = ServeConn(context.Background(), server, &conf)
+	}()
+
+	clientConf := ClientConfig{
+		Socks5ShakeHandsTimeout: 5 * time.Second,
+		Socks5CmdRTimeout:       5 * time.Second,
+	}
+	_ = ClientTcpConn(context.Background(), &clientConf, client, "tcp", net.JoinHostPort(ip.String(), "443"))
+
+	if addr := <-dialChan; addr != "www.example.com:443" {
+		t.Fatalf("addr = %v", addr)
+	}
+}
+
+func TestUdpServer_FakeIPRoute(t *testing.T) {
+	site, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer site.Close()
+	siteAddr := site.LocalAddr().(*net.UDPAddr)
+
+	other, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	otherAddr := other.LocalAddr().(*net.UDPAddr)
+
+	fake, _ := dns.NewFakeIP("198.18.0.0/15", "", 0)
+	ip, _ := fake.Alloc("www.example.com")
+
+	release := make(chan struct{})
+	conf := ServerConfig{}
+	conf.Default()
+	conf.FakeIPLookup = fake.Lookup
+	conf.UdpLookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		if host != "www.example.com" {
+			t.Errorf("host = %v", host)
+		}
+		<-release
+		return []net.IP{net.ParseIP("::1"), net.IPv4(127, 0, 0, 1)}, nil
+	}
+
+	s := newUdpServer(context.Background(), &conf, nil, nil, nil)
+	defer s.cancel()
+	s.udpSiteConn, err = net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.udpSiteConn.Close()
+	s.setSocks5ClientUdpAddr(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+
+	send := func(dst *net.UDPAddr, data string) {
+		udpPack := Socks5UdpPack{Data: []byte(data)}
+		if err := udpPack.SetAddr(dst); err != nil {
+			t.Fatal(err)
+		}
+		s.sendMu.Lock()
+		defer s.sendMu.Unlock()
+		if err := s.route(&udpPack); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recv := func(c net.PacketConn, data string) {
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 100)
+		n, _, err := c.ReadFrom(buf)
+		if err != nil || string(buf[:n]) != data {
+			t.Fatalf("buf = %q, err = %v", buf[:n], err)
+		}
+	}
+
+	// 解析未完成时暂存包，不阻塞发往其他目标的包
+	dst := &net.UDPAddr{IP: ip, Port: siteAddr.Port}
+	send(dst, "1")
+	send(dst, "2")
+	send(otherAddr, "other")
+	recv(other, "other")
+
+	close(release)
+	recv(site, "1")
+	recv(site, "2")
+
+	// 回应的来源地址需要换回 fake ip
+	if v := s.replyAddr(siteAddr); v.String() != dst.String() {
+		t.Fatalf("v = %v", v)
+	}
+	// 非 fake ip 不处理
+	if v := s.replyAddr(otherAddr); v != net.Addr(otherAddr) {
+		t.Fatalf("v = %v", v)
+	}
+
+	// 已解析的目标直接发出
+	send(dst, "3")
+	recv(site, "3")
+
+	// 客户端直接使用 ip 后，回应不再换回 fake ip
+	send(siteAddr, "4")
+	recv(site, "4")
+	if v := s.replyAddr(siteAddr); v.String() != siteAddr.String() {
+		t.Fatalf("v = %v", v)
+	}
+}
+
+func TestDnsForwarder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 上游 dns 服务器
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsConf := dns.ServerConfig{}
+	dnsConf.Default()
+	dnsConf.Handler = dns.HostsHandler(map[string][]net.IP{
+		"www.example.com": {net.IPv4(1, 2, 3, 4)},
+	})
+	go func() {
+		_ = dns.ServePacketConn(ctx, upstream, &dnsConf)
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := ServerConfig{}
+	conf.Default()
+	// 上游为域名时由代理服务器解析
+	conf.UdpLookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		if host != "dns.example.com" {
+			return nil, fmt.Errorf("unexpected host %v", host)
+		}
+		return []net.IP{net.IPv4(127, 0, 0, 1)}, nil
+	}
+	go func() {
+		_ = ServerLinsten(ctx, ln, &conf)
+	}()
+
+	clientConf := UdpClientConfig{}
+	clientConf.Default()
+	dials := int32(0)
+	dial := clientConf.DialContext
+	clientConf.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return dial(ctx, network, addr)
+	}
+	client, err := NewUdpClientWithConfig("socks5", ln.Addr().String(), &clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstreamPort := upstream.LocalAddr().(*net.UDPAddr).Port
+	forwarderConf := NewDnsForwarderConfigWithClient(client, net.JoinHostPort("dns.example.com", fmt.Sprint(upstreamPort)))
+	// 只测试 udp
+	forwarderConf.TcpDialContext = nil
+	forwarderConf.CacheSize = 0
+
+	f, err := dns.NewForwarder(forwarderConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 1},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName("www.example.com."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+
+	// 并发的查询使用相同的 ID，复用同一个 udp 关联
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			resp, err := f.Exchange(ctx, &query)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if resp.Header.ID != 1 || len(resp.Answers) != 1 ||
+				resp.Answers[0].Body.(*dnsmessage.AResource).A != [4]byte{1, 2, 3, 4} {
+				t.Errorf("resp = %#v", resp)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Fatalf("dials = %v", n)
+	}
+
+	// tcp 查询经过同一个客户端
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = dns.ServerListen(ctx, tcpLn, &dnsConf)
+	}()
+
+	tcpConf := NewDnsForwarderConfigWithClient(client, tcpLn.Addr().String())
+	tcpConf.UdpExchange = nil
+	f, err = dns.NewForwarder(tcpConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := f.Exchange(ctx, &query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answers) != 1 || resp.Answers[0].Body.(*dnsmessage.AResource).A != [4]byte{1, 2, 3, 4} {
+		t.Fatalf("resp = %#v", resp)
+	}
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Fatalf("dials = %v", n)
+	}
+}
+
+func TestServeConn_UdpDomain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	echo := NewEchoServer(&EchoServerConfig{UdpAddr: "127.0.0.1:0"})
+	err := echo.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		_ = echo.Serve()
+	}()
+	echoAddr := echo.udpConn.LocalAddr().(*net.UDPAddr)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := ServerConfig{}
+	conf.Default()
+	conf.UdpLookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		return []net.IP{net.IPv4(127, 0, 0, 1)}, nil
+	}
+	conf.UdpDomainRoute = func(ctx context.Context, domain string, addr *net.UDPAddr) (net.Addr, error) {
+		if domain == "blocked.example.com" {
+			return nil, fmt.Errorf("blocked")
+		}
+		return nil, nil
+	}
+	go func() {
+		_ = ServerLinsten(ctx, ln, &conf)
+	}()
+
+	client, err := NewUdpClient("socks5", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := client.Listen("udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 被路由规则禁止的目标不会有回应
+	_, err = conn.WriteToDomain([]byte("blocked"), "blocked.example.com", uint16(echoAddr.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.WriteToDomain([]byte("hello"), "echo.example.com", uint16(echoAddr.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 回应需要使用客户端请求的域名
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, addr, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, _ := addr.(*Addr)
+	if a == nil || a.IsDomain() == false || a.String() != net.JoinHostPort("echo.example.com", fmt.Sprint(echoAddr.Port)) ||
+		string(buf[:n]) != "hello" {
+		t.Fatalf("addr = %#v, buf = %q", addr, buf[:n])
+	}
+
+	// 域名地址可以直接用于 WriteTo
+	_, err = conn.WriteTo([]byte("again"), a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, a, err = conn.ReadFromAddr(buf)
+	if err != nil || a.Domain != "echo.example.com" || string(buf[:n]) != "again" {
+		t.Fatalf("addr = %v, buf = %q, err = %v", a, buf[:n], err)
+	}
+}
+
+func TestServeConn_UdpLargeDatagram(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	echo := NewEchoServer(&EchoServerConfig{UdpAddr: "127.0.0.1:0"})
+	err := echo.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		_ = echo.Serve()
+	}()
+	echoAddr := echo.udpConn.LocalAddr().(*net.UDPAddr)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := ServerConfig{}
+	conf.Default()
+	go func() {
+		_ = ServerLinsten(ctx, ln, &conf)
+	}()
+
+	client, err := NewUdpClient("socks5", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := client.Listen("udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 加上 socks5 头部后仍需要小于 udp 包最大长度
+	data := make([]byte, MaxUdpDatagramSize-10)
+	rand.Read(data)
+
+	_, err = conn.WriteToUDP(data, echoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, MaxUdpDatagramSize)
+	n, addr, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != echoAddr.String() || bytes.Equal(buf[:n], data) == false {
+		t.Fatalf("addr = %v, n = %v", addr, n)
+	}
+
+	_, err = conn.WriteToUDP(make([]byte, MaxUdpDatagramSize+1), echoAddr)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestServeConn_UdpIPv6(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, v := range []struct {
+		name          string
+		host          string
+		network       string
+		bindLocalAddr bool
+	}{
+		{"ipv4-bind", "127.0.0.1", "udp4", true},
+		{"ipv6", "::1", "udp6", false},
+		{"ipv6-bind", "::1", "udp6", true},
+		{"ipv6-dual", "::1", "udp", false},
+	} {
+		t.Run(v.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", net.JoinHostPort(v.host, "0"))
+			if err != nil {
+				t.Skip(err)
+			}
+			conf := ServerConfig{}
+			conf.Default()
+			go func() {
+				_ = ServerLinsten(ctx, ln, &conf)
+			}()
+
+			echo := NewEchoServer(&EchoServerConfig{UdpAddr: net.JoinHostPort(v.host, "0")})
+			err = echo.Listen()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer echo.Close()
+			go func() {
+				_ = echo.Serve()
+			}()
+			echoAddr := echo.udpConn.LocalAddr().(*net.UDPAddr)
+
+			client, err := NewUdpClient("socks5", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.BindLocalAddr = v.bindLocalAddr
+
+			conn, err := client.Listen(v.network)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if conn.relayAddr.(*net.UDPAddr).IP.Equal(net.ParseIP(v.host)) == false {
+				t.Fatalf("relay addr = %v", conn.relayAddr)
+			}
+
+			_, err = conn.WriteToUDP([]byte("hello"), echoAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_ = conn.udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 2048)
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr.String() != echoAddr.String() || string(buf[:n]) != "hello" {
+				t.Fatalf("addr = %v, buf = %q", addr, buf[:n])
+			}
+		})
+	}
+}
+
+func TestServeConn_UdpOverTcp(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	echo := NewEchoServer(&EchoServerConfig{UdpAddr: "127.0.0.1:0"})
+	err := echo.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		_ = echo.Serve()
+	}()
+	echoAddr := echo.udpConn.LocalAddr().(*net.UDPAddr)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := ServerConfig{}
+	conf.Default()
+	conf.UdpOverTcp = true
+	// udp over tcp 不需要到客户端的 udp 连接
+	conf.Socks5ClientUdpListen = nil
+	conf.Socks5ClientUdpDial = nil
+	go func() {
+		_ = ServerLinsten(ctx, ln, &conf)
+	}()
+
+	client, err := NewUdpClient("socks5", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.UdpOverTcp = true
+
+	conn, err := client.Dial("udp", echoAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, size := range []int{1, 1000, 60000} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		_, err = conn.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, MaxUdpDatagramSize)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr.String() != echoAddr.String() || bytes.Equal(buf[:n], data) == false {
+			t.Fatalf("addr = %v, n = %v", addr, n)
+		}
+	}
+
+	// 服务器禁用时返回错误
+	ln2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf2 := conf
+	conf2.UdpOverTcp = false
+	go func() {
+		_ = ServerLinsten(ctx, ln2, &conf2)
+	}()
+
+	client, err = NewUdpClient("socks5", ln2.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.UdpOverTcp = true
+
+	_, err = client.Listen("udp")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// 握手超时只作用于握手阶段，udp 关联建立后可以一直使用
+func TestServeConn_UdpHandshakeTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	echo := NewEchoServer(&EchoServerConfig{UdpAddr: "127.0.0.1:0"})
+	err := echo.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		_ = echo.Serve()
+	}()
+	echoAddr := echo.udpConn.LocalAddr().(*net.UDPAddr)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := ServerConfig{}
+	conf.Default()
+	conf.UdpOverTcp = true
+	conf.Socks5ShakeHandsTimeout = 300 * time.Millisecond
+	go func() {
+		_ = ServerLinsten(ctx, ln, &conf)
+	}()
+
+	for _, udpOverTcp := range []bool{false, true} {
+		client, err := NewUdpClient("socks5", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.UdpOverTcp = udpOverTcp
+
+		conn, err := client.Dial("udp", echoAddr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			if i != 0 {
+				time.Sleep(3 * conf.Socks5ShakeHandsTimeout)
+			}
+
+			_, err = conn.Write([]byte("hello"))
+			if err != nil {
+				t.Fatalf("udpOverTcp: %v, %v", udpOverTcp, err)
+			}
+
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 100)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatalf("udpOverTcp: %v, %v", udpOverTcp, err)
+			}
+			if string(buf[:n]) != "hello" {
+				t.Fatalf("udpOverTcp: %v, buf = %q", udpOverTcp, buf[:n])
+			}
+		}
+
+		_ = conn.Close()
+	}
+}
+
+func TestUdpDstRules(t *testing.T) {
+	denyNets, err := ParseCIDRs("10.0.0.0/8", "fc00::/7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowNets, err := ParseCIDRs("0.0.0.0/0", "::/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules := UdpDstRules{
+		AllowNets: allowNets,
+		DenyNets:  denyNets,
+		DenyPorts: []int{19},
+	}
+
+	for _, v := range []struct {
+		addr net.Addr
+		ok   bool
+	}{
+		{&net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53}, true},
+		{&net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 19}, false},
+		{&net.UDPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 53}, false},
+		{&net.UDPAddr{IP: net.ParseIP("fd00::1"), Port: 53}, false},
+		{&Addr{Atyp: Socks5CmdAtypTypeDomain, Domain: "abc.com", Port: 53}, true},
+		{&Addr{Atyp: Socks5CmdAtypTypeDomain, Domain: "abc.com", Port: 19}, false},
+	} {
+		err := rules.Check(context.Background(), v.addr)
+		if (err == nil) != v.ok {
+			t.Errorf("%v: err = %v", v.addr, err)
+		}
+	}
+
+	rules = UdpDstRules{AllowPorts: []int{53}}
+	if rules.Check(context.Background(), &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 80}) == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestUdpRateLimiter(t *testing.T) {
+	var l *udpRateLimiter
+	if l.Allow(1000, time.Now()) == false {
+		t.Fatal("nil limiter should allow")
+	}
+
+	now := time.Now()
+	l = newUdpRateLimiter(10)
+	for i := 0; i < 10; i++ {
+		if l.Allow(1, now) == false {
+			t.Fatalf("i = %v", i)
+		}
+	}
+	if l.Allow(1, now) {
+		t.Fatal("expected limit")
+	}
+
+	// 100ms 恢复 1 个
+	now = now.Add(100 * time.Millisecond)
+	if l.Allow(1, now) == false || l.Allow(1, now) {
+		t.Fatal("expected 1 token")
+	}
+
+	// 最多积累 1 秒
+	now = now.Add(time.Minute)
+	if l.Allow(11, now) || l.Allow(10, now) == false {
+		t.Fatal("expected burst of 10")
+	}
+}
+
+func TestServeConn_UdpLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var echoAddrs []*net.UDPAddr
+	for i := 0; i < 2; i++ {
+		echo := NewEchoServer(&EchoServerConfig{UdpAddr: "127.0.0.1:0"})
+		err := echo.Listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer echo.Close()
+		go func() {
+			_ = echo.Serve()
+		}()
+		echoAddrs = append(echoAddrs, echo.udpConn.LocalAddr().(*net.UDPAddr))
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := &UdpStats{}
+	rules := &UdpDstRules{DenyPorts: []int{echoAddrs[1].Port}}
+	conf := ServerConfig{}
+	conf.Default()
+	conf.UdpCheckDst = rules.Check
+	conf.UdpMaxPacketsPerSecond = 3
+	conf.UdpStats = stats
+	go func() {
+		_ = ServerLinsten(ctx, ln, &conf)
+	}()
+
+	client, err := NewUdpClient("socks5", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := client.Listen("udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = conn.WriteToUDP([]byte("denied"), echoAddrs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		_, err = conn.WriteToUDP([]byte(fmt.Sprint(i)), echoAddrs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 只有前 3 个包被转发
+	buf := make([]byte, 2048)
+	for i := 0; i < 3; i++ {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr.String() != echoAddrs[0].String() || string(buf[:n]) != fmt.Sprint(i) {
+			t.Fatalf("addr = %v, buf = %q", addr, buf[:n])
+		}
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = conn.ReadFromUDP(buf)
+	if err == nil {
+		t.Fatal("expected timeout")
+	}
+
+	if stats.Drops(UdpDropDenied) != 1 || stats.Drops(UdpDropPacketRate) != 2 {
+		t.Fatalf("drops = %v", stats.AllDrops())
+	}
+}
+
+func TestUdpNatTable(t *testing.T) {
+	client := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	site := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}
+	sitePort2 := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 54}
+	other := &net.UDPAddr{IP: net.IPv4(5, 6, 7, 8), Port: 53}
+	now := time.Now()
+
+	tests := []struct {
+		filter                 UdpNatFilter
+		site, sitePort2, other bool
+	}{
+		{UdpNatFilterEndpointIndependent, true, true, true},
+		{UdpNatFilterAddressDependent, true, true, false},
+		{UdpNatFilterAddressAndPortDependent, true, false, false},
+	}
+
+	for _, v := range tests {
+		t.Run(v.filter.String(), func(t *testing.T) {
+			nat := newUdpNatTable(v.filter, time.Minute, 0)
+			nat.Outbound(client, site, now)
+
+			if nat.Inbound(client, site, now) != v.site ||
+				nat.Inbound(client, sitePort2, now) != v.sitePort2 ||
+				nat.Inbound(client, other, now) != v.other {
+				t.Fatal("Inbound")
+			}
+		})
+	}
+
+	t.Run("idle", func(t *testing.T) {
+		nat := newUdpNatTable(UdpNatFilterAddressAndPortDependent, time.Minute, 0)
+		nat.Outbound(client, site, now)
+
+		// 空闲超时后会话失效并被清除
+		later := now.Add(2 * time.Minute)
+		if nat.Inbound(client, site, later) || nat.Len() != 0 {
+			t.Fatal("Inbound site")
+		}
+	})
+
+	for _, idleTimeout := range []time.Duration{time.Minute, 0} {
+		t.Run(fmt.Sprint("lru-", idleTimeout), func(t *testing.T) {
+			nat := newUdpNatTable(UdpNatFilterEndpointIndependent, idleTimeout, 2)
+			nat.Outbound(client, site, now)
+			nat.Outbound(client, sitePort2, now)
+
+			// site 收到回应，sitePort2 成为最久未使用的会话
+			nat.Inbound(client, site, now)
+
+			// 超过上限时替换最久未使用的会话
+			nat.Outbound(client, other, now)
+			if nat.Len() != 2 {
+				t.Fatalf("Len = %v", nat.Len())
+			}
+
+			nat.m.Lock()
+			_, hasSite := nat.sessions[udpNatKey{client.String(), site.String()}]
+			_, hasSitePort2 := nat.sessions[udpNatKey{client.String(), sitePort2.String()}]
+			nat.m.Unlock()
+			if hasSite == false || hasSitePort2 {
+				t.Fatalf("site = %v, sitePort2 = %v", hasSite, hasSitePort2)
+			}
+		})
+	}
+}
+
+func TestServeConn_UdpShared(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	echo := NewEchoServer(&EchoServerConfig{UdpAddr: "127.0.0.1:0"})
+	err := echo.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		_ = echo.Serve()
+	}()
+	echoAddr := echo.udpConn.LocalAddr().(*net.UDPAddr)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharedConf := UdpSharedConfig{}
+	sharedConf.Default()
+	sharedConf.MatchToken = true
+	shared := NewUdpSharedListenerWithConfig(pc, &sharedConf)
+	defer shared.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := ServerConfig{}
+	conf.Default()
+	conf.Socks5ClientUdpShared = shared
+	go func() {
+		_ = ServerLinsten(ctx, ln, &conf)
+	}()
+
+	client, err := NewUdpClient("socks5", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.UdpToken = true
+
+	// 同一 ip 的两个 udp 关联，后建立的先发出数据，依靠令牌区分
+	var conns []*UdpConn
+	for i := 0; i < 2; i++ {
+		conn, err := client.Listen("udp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if conn.relayAddr.String() != pc.LocalAddr().String() {
+			t.Fatalf("relay addr = %v", conn.relayAddr)
+		}
+		conns = append(conns, conn)
+	}
+
+	for i := len(conns) - 1; i >= 0; i-- {
+		conn := conns[i]
+		data := []byte(fmt.Sprint("hello ", i))
+
+		_, err = conn.WriteToUDP(data, echoAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_ = conn.udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 2048)
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != string(data) {
+			t.Fatalf("buf = %q", buf[:n])
+		}
+
+		// 来源地址需要绑定到本连接的 udp 关联
+		localPort := conn.udpConn.LocalAddr().(*net.UDPAddr).Port
+		shared.m.Lock()
+		c := shared.byAddr[fmt.Sprint("127.0.0.1:", localPort)]
+		shared.m.Unlock()
+		if c == nil || int(c.token.token) != conn.tcpConn.LocalAddr().(*net.TCPAddr).Port {
+			t.Fatalf("c = %#v", c)
+		}
+	}
+
+	// tcp 控制连接关闭后删除记录
+	for _, v := range conns {
+		_ = v.Close()
+	}
+	for i := 0; i < 100 && shared.Len() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if shared.Len() != 0 {
+		t.Fatalf("Len = %v", shared.Len())
+	}
+}
+
+// 默认只按 UDP ASSOCIATE 请求中的地址匹配，同一 ip 的其他来源不能抢占 udp 关联
+func TestServeConn_UdpSharedExplicit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	echo := NewEchoServer(&EchoServerConfig{UdpAddr: "127.0.0.1:0"})
+	err := echo.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		_ = echo.Serve()
+	}()
+	echoAddr := echo.udpConn.LocalAddr().(*net.UDPAddr)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := NewUdpSharedListener(pc)
+	defer shared.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := ServerConfig{}
+	conf.Default()
+	conf.Socks5ClientUdpShared = shared
+	go func() {
+		_ = ServerLinsten(ctx, ln, &conf)
+	}()
+
+	client, err := NewUdpClient("socks5", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 未提供 udp 地址时拒绝
+	_, err = client.Listen("udp")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	client.BindLocalAddr = true
+	client.UdpToken = true
+	conn, err := client.Listen("udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 同一 ip 的其他来源使用猜测的令牌发包，不会被转发
+	attacker, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer attacker.Close()
+
+	udpPack := Socks5UdpPack{Rsv: conn.rsv, Data: []byte("attack")}
+	err = udpPack.SetAddr(echoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	n, err := udpPack.To(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = attacker.WriteTo(buf[:n], pc.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = conn.WriteToUDP([]byte("hello"), echoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err = conn.ReadFromUDP(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("buf = %q, err = %v", buf[:n], err)
+	}
+
+	_ = attacker.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, _, err := attacker.ReadFrom(buf); err == nil {
+		t.Fatalf("attacker received %q", buf[:n])
+	}
+}
+
+func TestUdpSharedConn_Deadline(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := UdpSharedConfig{}
+	conf.Default()
+	conf.MatchIP = true
+	shared := NewUdpSharedListenerWithConfig(pc, &conf)
+	defer shared.Close()
+
+	tcpConn := &testAddrConn{remote: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}}
+	c, err := shared.Listen(tcpConn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 阻塞中的读取在修改超时后被唤醒
+	errChan := make(chan error, 1)
+	go func() {
+		_, _, err := c.ReadFrom(make([]byte, 100))
+		errChan <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	_ = c.SetReadDeadline(time.Now().Add(-time.Second))
+
+	select {
+	case err := <-errChan:
+		if ne, ok := err.(net.Error); ok == false || ne.Timeout() == false {
+			t.Fatalf("err = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadFrom is not woken up")
+	}
+
+	// 清除超时后可以继续读取
+	_ = c.SetReadDeadline(time.Time{})
+	go func() {
+		_, _, err := c.ReadFrom(make([]byte, 100))
+		errChan <- err
+	}()
+	_ = c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	select {
+	case err := <-errChan:
+		if ne, ok := err.(net.Error); ok == false || ne.Timeout() == false {
+			t.Fatalf("err = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadFrom is not woken up")
+	}
+
+	// 写超时
+	_ = c.SetWriteDeadline(time.Now().Add(-time.Second))
+	_, err = c.WriteTo([]byte("a"), pc.LocalAddr())
+	if ne, ok := err.(net.Error); ok == false || ne.Timeout() == false {
+		t.Fatalf("err = %v", err)
+	}
+	_ = c.SetWriteDeadline(time.Time{})
+	_, err = c.WriteTo([]byte("a"), pc.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 只提供地址的连接
+type testAddrConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *testAddrConn) LocalAddr() net.Addr  { return c.local }
+func (c *testAddrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestGetSocks5ListenUdpAddr(t *testing.T) {
+	udpConn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	port := udpConn.LocalAddr().(*net.UDPAddr).Port
+
+	v4Conn := &testAddrConn{
+		local:  &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1080},
+		remote: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 50000},
+	}
+	v6Conn := &testAddrConn{
+		local:  &net.TCPAddr{IP: net.ParseIP("fd00::2"), Port: 1080},
+		remote: &net.TCPAddr{IP: net.ParseIP("fd00::3"), Port: 50000},
+	}
+
+	tests := []struct {
+		name     string
+		byClient bool
+		conn     net.Conn
+		want     string
+	}{
+		{"local", false, v4Conn, net.JoinHostPort("10.0.0.2", fmt.Sprint(port))},
+		{"ipv4", false, v6Conn, "203.0.113.1:20000"},
+		{"byClient-ipv4", true, v4Conn, "203.0.113.1:20000"},
+		{"byClient-ipv6", true, v6Conn, "[2001:db8::1]:20000"},
+	}
+
+	for _, v := range tests {
+		t.Run(v.name, func(t *testing.T) {
+			conf := ServerConfig{}
+			conf.Default()
+			if v.name != "local" {
+				conf.Socks5ClientUdpAdvertiseIPv4 = net.ParseIP("203.0.113.1")
+				conf.Socks5ClientUdpAdvertiseIPv6 = net.ParseIP("2001:db8::1")
+				conf.Socks5ClientUdpAdvertisePorts = map[int]int{port: 20000}
+			}
+			conf.Socks5ClientUdpAdvertiseByClient = v.byClient
+
+			addr, err := getSocks5ListenUdpAddr(&conf, v.conn, udpConn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr.String() != v.want {
+				t.Fatalf("addr = %v, want %v", addr, v.want)
+			}
+		})
+	}
+
+	// 不能修改 udp 连接的本地地址
+	if ip := udpConn.LocalAddr().(*net.UDPAddr).IP; ip.IsUnspecified() == false {
+		t.Fatalf("local ip = %v", ip)
+	}
+}
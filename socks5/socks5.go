@@ -35,6 +35,9 @@ const (
 	Socks5CmdTypeBind         Socks5CmdType = 0x02
 	Socks5CmdTypeUdpAssociate Socks5CmdType = 0x3
 
+	// 私有命令，udp over tcp，udp 包封装为帧经 tcp 控制连接传输，见 udpOverTcpConn
+	Socks5CmdTypeUdpOverTcp Socks5CmdType = 0x83
+
 	// cmd 回复，成功
 	Socks5CmdReplySucceeded Socks5CmdType = 0x00
 
@@ -251,35 +254,24 @@ func WriteSocks5Cmd(w io.Writer, cmd *Socks5CmdPack) error {
 
 }
 func (cmd *Socks5CmdPack) Write(w io.Writer) error {
-	hostSize := len(cmd.Host)
-	if cmd.Atyp == Socks5CmdAtypTypeDomain && hostSize > 255 {
-		return fmt.Errorf("domain %v is too long", cmd.Host)
+	addr, err := cmd.GetAddr()
+	if err != nil {
+		return err
 	}
 
 	buf := mempool.Get(1024)
 	defer mempool.Put(buf)
 
-	port := [2]byte{0}
-	binary.BigEndian.PutUint16(port[:], cmd.Port)
-
 	buf[0] = cmd.Ver
 	buf[1] = byte(cmd.Cmd)
 	buf[2] = cmd.Rsv
-	buf[3] = byte(cmd.Atyp)
-	buf = buf[:4]
+	buf = buf[:3]
 
-	switch cmd.Atyp {
-	case Socks5CmdAtypTypeIP4, Socks5CmdAtypTypeIP6:
-		buf = append(buf, cmd.Host...)
-	case Socks5CmdAtypTypeDomain:
-		buf = append(buf, uint8(len(cmd.Host)))
-		buf = append(buf, []byte(cmd.Host)...)
-	default:
-		return fmt.Errorf("unknown atyp %v type", cmd.Atyp)
+	buf, err = addr.Append(buf)
+	if err != nil {
+		return err
 	}
 
-	buf = append(buf, port[0], port[1])
-
 	if _, err := w.Write(buf); err != nil {
 		return fmt.Errorf("w.write, %v", err)
 	}
@@ -320,41 +312,12 @@ func (cmd *Socks5CmdPack) Read(r io.Reader) error {
 				return nil, fmt.Errorf("未知的命令，cmd:%v。", cmd.Cmd)
 			}*/
 
-	/*if cmd.atyp == Socks5CmdAtypTypeIP4 {
-	    buf = buf[:net.IPv4len]
-	}else */
-
-	switch cmd.Atyp {
-	case Socks5CmdAtypTypeIP4:
-		buf = buf[:net.IPv4len]
-	case Socks5CmdAtypTypeIP6:
-		buf = buf[:net.IPv6len]
-	case Socks5CmdAtypTypeDomain:
-		buf = buf[:1]
-	default:
-		return fmt.Errorf("unexpected address type %v", cmd.Atyp)
-	}
-
-	if _, err := io.ReadFull(r, buf); err != nil {
-		return fmt.Errorf("failed to read socks5 cmd.Host, %v", err)
-	}
-
-	switch cmd.Atyp {
-	case Socks5CmdAtypTypeIP4, Socks5CmdAtypTypeIP6:
-		cmd.Host = append(cmd.Host[:0], buf...)
-	case Socks5CmdAtypTypeDomain:
-		buf = buf[:buf[0]]
-		if _, err := io.ReadFull(r, buf); err != nil {
-			return fmt.Errorf("failed to read socks5 cmd.Host, %v", err)
-		}
-		cmd.Host = append(cmd.Host, buf...)
+	addr, err := readAddr(r, cmd.Atyp)
+	if err != nil {
+		return fmt.Errorf("failed to read socks5 cmd addr, %v", err)
 	}
 
-	buf = buf[:2]
-	if _, err := io.ReadFull(r, buf); err != nil {
-		return fmt.Errorf("failed to read socks5 cmd.Port, %v", err)
-	}
-	cmd.Port = binary.BigEndian.Uint16(buf)
+	cmd.setAddr(addr)
 
 	return nil
 }
@@ -419,6 +382,47 @@ func (s *Socks5CmdPack) SetAddrAuto(addr string) error {
 	return nil
 }
 
+// 取得 Atyp、Host、Port 表示的地址
+func (s *Socks5CmdPack) GetAddr() (*Addr, error) {
+	switch s.Atyp {
+	case Socks5CmdAtypTypeIP4, Socks5CmdAtypTypeIP6:
+		a := Addr{Atyp: s.Atyp, IP: net.IP(s.Host), Port: s.Port}
+		if (s.Atyp == Socks5CmdAtypTypeIP4 && len(a.IP) != net.IPv4len) ||
+			(s.Atyp == Socks5CmdAtypTypeIP6 && len(a.IP) != net.IPv6len) {
+			return nil, fmt.Errorf("ip %v length is incorrect", s.Host)
+		}
+		return &a, nil
+	case Socks5CmdAtypTypeDomain:
+		if len(s.Host) > 0xFF {
+			return nil, fmt.Errorf("domain %v is too long", s.Host)
+		}
+		return &Addr{Atyp: s.Atyp, Domain: string(s.Host), Port: s.Port}, nil
+	default:
+		return nil, fmt.Errorf("unknown atyp %v type", s.Atyp)
+	}
+}
+
+func (s *Socks5CmdPack) SetAddr(a *Addr) error {
+	switch a.Atyp {
+	case Socks5CmdAtypTypeIP4, Socks5CmdAtypTypeIP6, Socks5CmdAtypTypeDomain:
+		s.setAddr(a)
+		return nil
+	default:
+		return fmt.Errorf("unexpected atyp %v", a.Atyp)
+	}
+}
+
+// 本函数会复用 s.Host 空间
+func (s *Socks5CmdPack) setAddr(a *Addr) {
+	s.Atyp = a.Atyp
+	if a.Atyp == Socks5CmdAtypTypeDomain {
+		s.Host = append(s.Host[:0], a.Domain...)
+	} else {
+		s.Host = append(s.Host[:0], a.IP...)
+	}
+	s.Port = a.Port
+}
+
 func (s *Socks5CmdPack) GetHostIp() (net.IP, error) {
 	var ip net.IP
 
@@ -548,7 +552,7 @@ func WriteSocks5AuthPassword(w io.Writer, pass *Socks5AuthPasswordPack) error {
 
 func (pass *Socks5AuthPasswordPack) Write(w io.Writer) error {
 
-	if len(pass.Username) > 0xFF || len(pass.Username) > 0xFF {
+	if len(pass.Username) > 0xFF || len(pass.Password) > 0xFF {
 		return fmt.Errorf("username or password is too long")
 	}
 
@@ -616,6 +620,12 @@ func (r *Socks5AuthPasswordRPack) Write(w io.Writer) error {
 	return nil
 }
 
+// udp 包最大负载，65535 减去 ipv4 头 20 字节及 udp 头 8 字节
+const MaxUdpDatagramSize = 65507
+
+// Socks5UdpPack 头部最大长度，地址为 255 字节的域名时
+const MaxSocks5UdpHeaderSize = 2 + 1 + 1 + 1 + 0xFF + 2
+
 type Socks5UdpPack struct {
 	Rsv  uint16
 	FRAG byte
@@ -626,54 +636,45 @@ type Socks5UdpPack struct {
 	Data []byte
 }
 
+// 解析 socks5 udp 包
+// Data 是负载的副本，之后可以复用 data
 func (p *Socks5UdpPack) Parse(data []byte) error {
+	err := p.ParseNoCopy(data)
+	if err != nil {
+		return err
+	}
+
+	p.Data = append([]byte(nil), p.Data...)
+
+	return nil
+}
+
+// 解析 socks5 udp 包，不复制负载
+// Data 引用 data，用于转发等在复用 data 前就用完 Data 的场合；Ip 及 Host 是独立的副本。
+func (p *Socks5UdpPack) ParseNoCopy(data []byte) error {
 	if len(data) < 11 {
 		return fmt.Errorf("data length is too short")
 	}
 
 	rsv := binary.BigEndian.Uint16(data)
 	frag := data[2]
-	atyp := Socks5AtypType(data[3])
-	ip := p.Ip[:0]
-	host := ""
-	portData := data
-
-	switch Socks5AtypType(atyp) {
-	case Socks5CmdAtypTypeIP4:
-		ip = append(ip, data[4:4+net.IPv4len]...)
-		portData = data[4+net.IPv4len:]
-
-	case Socks5CmdAtypTypeIP6:
-		if len(data) < 23 {
-			return fmt.Errorf("data length is too short")
-		}
-		ip = append(ip, data[4:4+net.IPv6len]...)
-		portData = data[4+net.IPv6len:]
 
-	case Socks5CmdAtypTypeDomain:
-		l := int(data[4])
-		if len(data) < 7+l {
-			return fmt.Errorf("data length is too short")
-		}
-
-		host = string(data[5 : 5+l])
-		portData = data[5+l:]
-	default:
-		return fmt.Errorf("unexpected atyp %v", atyp)
+	addr, n, err := ParseAddrBytes(data[3:])
+	if err != nil {
+		return err
 	}
 
-	*p = Socks5UdpPack{}
+	udpData := data[3+n:]
 
-	port := binary.BigEndian.Uint16(portData[:2])
-	udpData := portData[2:]
+	*p = Socks5UdpPack{}
 
 	p.Rsv = rsv
 	p.FRAG = frag
-	p.ATYP = atyp
-	p.Host = host
-	p.Ip = append(p.Ip[:0], ip...)
-	p.Port = port
-	p.Data = append(p.Data[:0], udpData...)
+	p.ATYP = addr.Atyp
+	p.Host = addr.Domain
+	p.Ip = addr.IP
+	p.Port = addr.Port
+	p.Data = udpData
 
 	return nil
 }
@@ -700,7 +701,6 @@ func (p *Socks5UdpPack) To(data []byte) (int, error) {
 			switch len(ip) {
 			case net.IPv4len:
 				atyp = Socks5CmdAtypTypeIP4
-				ip = ip
 			case net.IPv6len:
 				atyp = Socks5CmdAtypTypeIP6
 			default:
@@ -754,7 +754,28 @@ func (p *Socks5UdpPack) To(data []byte) (int, error) {
 	return mustSize, nil
 }
 
+// 包的地址，ATYP 为 Socks5CmdAtypTypeAuto 时不能使用
+func (p *Socks5UdpPack) GetAddr() (*Addr, error) {
+	switch p.ATYP {
+	case Socks5CmdAtypTypeIP4, Socks5CmdAtypTypeIP6:
+		return NewIPAddr(p.Ip, int(p.Port))
+	case Socks5CmdAtypTypeDomain:
+		return NewDomainAddr(p.Host, int(p.Port))
+	default:
+		return nil, fmt.Errorf("unexpected atyp %v", p.ATYP)
+	}
+}
+
+// addr 可以是 *net.UDPAddr 或 *Addr，*Addr 为域名时使用域名地址
 func (p *Socks5UdpPack) SetAddr(addr net.Addr) error {
+	if a, ok := addr.(*Addr); ok {
+		p.ATYP = a.Atyp
+		p.Host = a.Domain
+		p.Ip = a.IP
+		p.Port = a.Port
+		return nil
+	}
+
 	udpAddr, _ := addr.(*net.UDPAddr)
 	if udpAddr == nil {
 		return fmt.Errorf("非预期的 udpAddr 格式, %v", addr)
@@ -779,7 +800,7 @@ func (p *Socks5UdpPack) SetAddrWIp(ip net.IP) error {
 	}
 
 	ipv6 := ip.To16()
-	if len(ipv6) != net.IPv6len {
+	if len(ipv6) == net.IPv6len {
 		p.Ip = ipv6
 		p.ATYP = Socks5CmdAtypTypeIP6
 		return nil
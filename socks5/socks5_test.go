@@ -256,6 +256,32 @@ func TestSocks5UdpPack_Ipv4(t *testing.T) {
 		t.Fatal("!=")
 	}
 }
+func TestSocks5UdpPack_ParseNoCopy(t *testing.T) {
+	data := []byte{0, 0, 0, 1, 127, 0, 0, 1, 0, 53, 1, 2, 3}
+
+	p1 := Socks5UdpPack{}
+	err := p1.Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2 := Socks5UdpPack{}
+	err = p2.ParseNoCopy(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 复用 data 后，Parse 的结果不受影响，ParseNoCopy 的 Data 随之改变
+	data[10] = 9
+
+	if bytes.Equal(p1.Data, []byte{1, 2, 3}) == false {
+		t.Fatalf("p1.Data = %v", p1.Data)
+	}
+	if bytes.Equal(p2.Data, []byte{9, 2, 3}) == false {
+		t.Fatalf("p2.Data = %v", p2.Data)
+	}
+}
+
 func TestSocks5UdpPack_Ipv6(t *testing.T) {
 	data := []byte{
 		1, 2, //RSV
@@ -641,3 +667,73 @@ func TestSocks5UdpPack_AutoDomain(t *testing.T) {
 		t.Fatal("!=")
 	}
 }
+
+func TestAddr(t *testing.T) {
+	for _, v := range []struct {
+		addr string
+		atyp Socks5AtypType
+		data []byte
+	}{
+		{"1.2.3.4:80", Socks5CmdAtypTypeIP4, []byte{0x01, 1, 2, 3, 4, 0, 80}},
+		{"[::1]:443", Socks5CmdAtypTypeIP6, []byte{0x04, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x01, 0xbb}},
+		{"abc.com:53", Socks5CmdAtypTypeDomain, []byte{0x03, 7, 'a', 'b', 'c', '.', 'c', 'o', 'm', 0, 53}},
+	} {
+		a, err := ParseAddr(v.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Atyp != v.atyp || a.String() != v.addr || a.Size() != len(v.data) {
+			t.Fatalf("a = %#v", a)
+		}
+
+		data, err := a.Append(nil)
+		if err != nil || bytes.Equal(data, v.data) == false {
+			t.Fatalf("data = %v, err = %v", data, err)
+		}
+
+		a2, n, err := ParseAddrBytes(append(data, 0xFF))
+		if err != nil || n != len(data) || reflect.DeepEqual(a, a2) == false {
+			t.Fatalf("a2 = %#v, n = %v, err = %v", a2, n, err)
+		}
+
+		a3, err := ReadAddr(bytes.NewReader(data))
+		if err != nil || reflect.DeepEqual(a, a3) == false {
+			t.Fatalf("a3 = %#v, err = %v", a3, err)
+		}
+
+		cmd := Socks5CmdPack{}
+		err = cmd.SetAddr(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmdAddr, err := cmd.GetAddr()
+		if err != nil || reflect.DeepEqual(a, cmdAddr) == false {
+			t.Fatalf("cmdAddr = %#v, err = %v", cmdAddr, err)
+		}
+
+		p := Socks5UdpPack{Data: []byte("data")}
+		err = p.SetAddr(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1024)
+		n, err = p.To(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p2 := Socks5UdpPack{}
+		err = p2.Parse(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		packAddr, err := p2.GetAddr()
+		if err != nil || reflect.DeepEqual(a, packAddr) == false || string(p2.Data) != "data" {
+			t.Fatalf("packAddr = %#v, err = %v", packAddr, err)
+		}
+	}
+
+	_, _, err := ParseAddrBytes([]byte{0x03, 10, 'a'})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
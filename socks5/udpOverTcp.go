@@ -0,0 +1,121 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gamexg/proxylib/mempool"
+)
+
+// udp over tcp
+// 通过私有命令 Socks5CmdTypeUdpOverTcp 建立，服务器回复成功后不再使用单独的 udp 端口，
+// 双方在 tcp 控制连接上收发 2 字节长度(大端) + Socks5UdpPack 格式的帧。
+// 用于 udp 被完全阻断的网络。
+
+// 帧最大长度
+const maxUdpOverTcpFrameSize = 0xFFFF
+
+// 在 tcp 连接上收发 udp over tcp 帧，实现 net.PacketConn
+// 读取到的帧来源地址总是 raddr，WriteTo 忽略地址参数。
+// 没有 Read、Write 方法，避免被当作已连接的 udp 连接。
+type udpOverTcpConn struct {
+	conn  net.Conn
+	raddr net.Addr
+
+	rm sync.Mutex
+	wm sync.Mutex
+}
+
+func newUdpOverTcpConn(conn net.Conn, raddr net.Addr) *udpOverTcpConn {
+	return &udpOverTcpConn{
+		conn:  conn,
+		raddr: raddr,
+	}
+}
+
+// 读取一帧，b 不足时截断
+func (c *udpOverTcpConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.rm.Lock()
+	defer c.rm.Unlock()
+
+	head := [2]byte{}
+	if _, err := io.ReadFull(c.conn, head[:]); err != nil {
+		return 0, nil, err
+	}
+
+	size := int(binary.BigEndian.Uint16(head[:]))
+
+	n := size
+	if n > len(b) {
+		n = len(b)
+	}
+
+	if _, err := io.ReadFull(c.conn, b[:n]); err != nil {
+		return 0, nil, err
+	}
+
+	if n < size {
+		if _, err := io.CopyN(ioutil.Discard, c.conn, int64(size-n)); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return n, c.raddr, nil
+}
+
+func (c *udpOverTcpConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if len(b) > maxUdpOverTcpFrameSize {
+		return 0, fmt.Errorf("frame is too large, %v", len(b))
+	}
+
+	buf := mempool.Get(2 + len(b))
+	defer mempool.Put(buf)
+
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+
+	c.wm.Lock()
+	defer c.wm.Unlock()
+
+	if _, err := c.conn.Write(buf[:2+len(b)]); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (c *udpOverTcpConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *udpOverTcpConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *udpOverTcpConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *udpOverTcpConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *udpOverTcpConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// 客户端一侧 udp over tcp 帧的来源地址
+type udpOverTcpAddr struct{}
+
+func (udpOverTcpAddr) Network() string {
+	return "udp-over-tcp"
+}
+
+func (udpOverTcpAddr) String() string {
+	return "udp-over-tcp"
+}
@@ -0,0 +1,446 @@
+// 被动解析 tls 握手
+// 不参与握手，只读取明文部分：ClientHello 中的 SNI、ALPN，
+// 以及网站回应中的 ServerHello 和 tls 1.2 及以下版本的证书链。
+package tlsinfo
+
+import (
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	recordTypeChangeCipherSpec = 20
+	recordTypeAlert            = 21
+	recordTypeHandshake        = 22
+
+	handshakeTypeClientHello     = 1
+	handshakeTypeServerHello     = 2
+	handshakeTypeCertificate     = 11
+	handshakeTypeServerHelloDone = 14
+
+	extensionServerName        = 0
+	extensionALPN              = 16
+	extensionSupportedVersions = 43
+
+	serverNameTypeHostName = 0
+
+	recordHeaderLen    = 5
+	handshakeHeaderLen = 4
+	maxRecordLen       = 16384 + 2048
+	maxHandshakeLen    = 256 * 1024
+)
+
+const VersionTLS13 = 0x0304
+
+// HelloRetryRequest 使用固定的 random
+const (
+	helloRetryRequestRandomPrefix  = "\xCF\x21\xAD\x74"
+	helloRetryRequestRandomPostfix = "\x07\x9E\x09\xE2\xC8\xA8\x33\x9C"
+)
+
+// 数据不是 tls 握手
+var ErrNotTls = errors.New("not tls handshake")
+
+type ClientHello struct {
+	// ClientHello 中的版本，tls 1.3 客户端这里是 tls 1.2
+	Version           uint16
+	ServerName        string
+	ALPN              []string
+	SupportedVersions []uint16
+	CipherSuites      []uint16
+}
+
+type ServerHandshake struct {
+	// 协商出的版本
+	Version     uint16
+	CipherSuite uint16
+	// 网站选择的 ALPN 协议
+	ALPN string
+
+	// 证书链，第一个是网站证书
+	// tls 1.3 的证书是加密的，会话恢复时网站不发送证书，这两种情况下为空
+	Certificates []*x509.Certificate
+
+	// 网站返回了 HelloRetryRequest，要求客户端重新发出 ClientHello
+	HelloRetryRequest bool
+	// 会话恢复(简化握手)
+	Resumed bool
+
+	// 网站返回的告警，为空表示没有收到告警
+	Alert *Alert
+}
+
+type Alert struct {
+	Level       uint8
+	Description uint8
+}
+
+func (a *Alert) Error() string {
+	return fmt.Sprintf("tls alert, level %v, description %v", a.Level, a.Description)
+}
+
+// tls 1.3 之前的证书是明文的
+func (s *ServerHandshake) TLS13() bool {
+	return s.Version == VersionTLS13
+}
+
+// 逐个读取 tls 记录，并记录读到的原始数据
+type recordReader struct {
+	r   io.Reader
+	raw []byte
+}
+
+func (rr *recordReader) readRecord() (uint8, []byte, error) {
+	header := make([]byte, recordHeaderLen)
+	n, err := io.ReadFull(rr.r, header)
+	rr.raw = append(rr.raw, header[:n]...)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	if header[0] < recordTypeChangeCipherSpec || header[0] > recordTypeHandshake+1 ||
+		header[1] != 3 || length > maxRecordLen {
+		return 0, nil, ErrNotTls
+	}
+
+	body := make([]byte, length)
+	n, err = io.ReadFull(rr.r, body)
+	rr.raw = append(rr.raw, body[:n]...)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return header[0], body, nil
+}
+
+// 从握手记录中拼出完整的握手消息
+// 一个记录可以包含多个消息，一个消息也可以跨多个记录
+type handshakeReader struct {
+	rr  *recordReader
+	buf []byte
+	// 最后一个读到的非握手记录
+	otherType uint8
+	other     []byte
+}
+
+// 读取下一个握手消息
+// 遇到非握手记录时返回 nil 消息，记录内容保存在 otherType、other
+func (hr *handshakeReader) next() (uint8, []byte, error) {
+	for {
+		if len(hr.buf) >= handshakeHeaderLen {
+			length := int(hr.buf[1])<<16 | int(hr.buf[2])<<8 | int(hr.buf[3])
+			if length > maxHandshakeLen {
+				return 0, nil, fmt.Errorf("handshake message too large, %v", length)
+			}
+
+			if len(hr.buf) >= handshakeHeaderLen+length {
+				t := hr.buf[0]
+				msg := hr.buf[handshakeHeaderLen : handshakeHeaderLen+length]
+				hr.buf = hr.buf[handshakeHeaderLen+length:]
+				return t, msg, nil
+			}
+		}
+
+		t, body, err := hr.rr.readRecord()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if t != recordTypeHandshake {
+			hr.otherType = t
+			hr.other = body
+			return 0, nil, nil
+		}
+
+		hr.buf = append(hr.buf, body...)
+	}
+}
+
+// 读取 ClientHello
+// 返回解析结果及读取的原始数据，原始数据需要原样发往网站。
+// 出错时同样返回已读取的原始数据，数据不是 tls 握手时返回 ErrNotTls
+func ReadClientHello(r io.Reader) (*ClientHello, []byte, error) {
+	rr := recordReader{r: r}
+	hr := handshakeReader{rr: &rr}
+
+	t, msg, err := hr.next()
+	if err != nil {
+		return nil, rr.raw, err
+	}
+	if msg == nil || t != handshakeTypeClientHello {
+		return nil, rr.raw, ErrNotTls
+	}
+
+	hello, err := parseClientHello(msg)
+	if err != nil {
+		return nil, rr.raw, fmt.Errorf("parseClientHello, %v", err)
+	}
+
+	return hello, rr.raw, nil
+}
+
+// 解析 ClientHello 握手消息，b 包含 4 字节的握手消息头
+// 用于没有 tls 记录层的场合，例如 quic 的 CRYPTO 帧。
+// 数据不完整时返回 io.ErrUnexpectedEOF
+func ParseClientHelloMessage(b []byte) (*ClientHello, error) {
+	if len(b) < handshakeHeaderLen {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if b[0] != handshakeTypeClientHello {
+		return nil, ErrNotTls
+	}
+
+	length := int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+	if length > maxHandshakeLen {
+		return nil, fmt.Errorf("handshake message too large, %v", length)
+	}
+	if len(b) < handshakeHeaderLen+length {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	hello, err := parseClientHello(b[handshakeHeaderLen : handshakeHeaderLen+length])
+	if err != nil {
+		return nil, fmt.Errorf("parseClientHello, %v", err)
+	}
+
+	return hello, nil
+}
+
+// 读取网站对 ClientHello 的回应
+// tls 1.2 读到 ServerHelloDone 为止，tls 1.3 及会话恢复读到 ServerHello 所在的记录为止，
+// 之后的数据是加密的。收到告警时停止。
+// 返回解析结果及读取的原始数据，原始数据需要原样发往客户端
+func ReadServerHandshake(r io.Reader) (*ServerHandshake, []byte, error) {
+	rr := recordReader{r: r}
+	hr := handshakeReader{rr: &rr}
+
+	s := &ServerHandshake{}
+	gotServerHello := false
+
+	for {
+		t, msg, err := hr.next()
+		if err != nil {
+			return nil, rr.raw, err
+		}
+
+		if msg == nil {
+			switch hr.otherType {
+			case recordTypeAlert:
+				if len(hr.other) < 2 {
+					return nil, rr.raw, fmt.Errorf("alert too short")
+				}
+				s.Alert = &Alert{Level: hr.other[0], Description: hr.other[1]}
+				return s, rr.raw, nil
+			case recordTypeChangeCipherSpec:
+				if gotServerHello == false {
+					return nil, rr.raw, fmt.Errorf("unexpected ChangeCipherSpec")
+				}
+				// tls 1.2 的会话恢复，网站不发送证书
+				s.Resumed = true
+				return s, rr.raw, nil
+			default:
+				return nil, rr.raw, fmt.Errorf("unexpected record type %v", hr.otherType)
+			}
+		}
+
+		switch t {
+		case handshakeTypeServerHello:
+			err := parseServerHello(msg, s)
+			if err != nil {
+				return nil, rr.raw, fmt.Errorf("parseServerHello, %v", err)
+			}
+			gotServerHello = true
+
+			if s.TLS13() || s.HelloRetryRequest {
+				return s, rr.raw, nil
+			}
+
+		case handshakeTypeCertificate:
+			certs, err := parseCertificate(msg)
+			if err != nil {
+				return nil, rr.raw, fmt.Errorf("parseCertificate, %v", err)
+			}
+			s.Certificates = certs
+
+		case handshakeTypeServerHelloDone:
+			return s, rr.raw, nil
+
+		default:
+			if gotServerHello == false {
+				return nil, rr.raw, fmt.Errorf("unexpected handshake type %v", t)
+			}
+		}
+	}
+}
+
+// 按 tls 的长度前缀格式读取数据
+type parser struct {
+	b   []byte
+	err error
+}
+
+func (p *parser) bytes(n int) []byte {
+	if p.err != nil {
+		return nil
+	}
+	if len(p.b) < n {
+		p.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	v := p.b[:n]
+	p.b = p.b[n:]
+	return v
+}
+
+func (p *parser) uint(n int) int {
+	v := 0
+	for _, b := range p.bytes(n) {
+		v = v<<8 | int(b)
+	}
+	return v
+}
+
+// 读取 n 字节长度前缀的数据
+func (p *parser) vector(n int) *parser {
+	return &parser{b: p.bytes(p.uint(n)), err: p.err}
+}
+
+func parseClientHello(msg []byte) (*ClientHello, error) {
+	p := &parser{b: msg}
+	hello := &ClientHello{}
+
+	hello.Version = uint16(p.uint(2))
+	p.bytes(32)
+	p.vector(1)
+
+	ciphers := p.vector(2)
+	for len(ciphers.b) >= 2 {
+		hello.CipherSuites = append(hello.CipherSuites, uint16(ciphers.uint(2)))
+	}
+
+	p.vector(1)
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	// 没有扩展
+	if len(p.b) == 0 {
+		return hello, nil
+	}
+
+	exts := p.vector(2)
+	for exts.err == nil && len(exts.b) > 0 {
+		extType := exts.uint(2)
+		ext := exts.vector(2)
+		if exts.err != nil {
+			break
+		}
+
+		switch extType {
+		case extensionServerName:
+			list := ext.vector(2)
+			for list.err == nil && len(list.b) > 0 {
+				nameType := list.uint(1)
+				name := list.vector(2)
+				if list.err == nil && nameType == serverNameTypeHostName {
+					hello.ServerName = string(name.b)
+				}
+			}
+		case extensionALPN:
+			list := ext.vector(2)
+			for list.err == nil && len(list.b) > 0 {
+				proto := list.vector(1)
+				if list.err == nil {
+					hello.ALPN = append(hello.ALPN, string(proto.b))
+				}
+			}
+		case extensionSupportedVersions:
+			list := ext.vector(1)
+			for list.err == nil && len(list.b) >= 2 {
+				hello.SupportedVersions = append(hello.SupportedVersions, uint16(list.uint(2)))
+			}
+		}
+	}
+
+	if exts.err != nil {
+		return nil, exts.err
+	}
+
+	return hello, nil
+}
+
+func parseServerHello(msg []byte, s *ServerHandshake) error {
+	p := &parser{b: msg}
+
+	s.Version = uint16(p.uint(2))
+	random := p.bytes(32)
+	p.vector(1)
+	s.CipherSuite = uint16(p.uint(2))
+	p.uint(1)
+	if p.err != nil {
+		return p.err
+	}
+
+	if string(random[:4]) == helloRetryRequestRandomPrefix &&
+		string(random[24:]) == helloRetryRequestRandomPostfix {
+		s.HelloRetryRequest = true
+	}
+
+	if len(p.b) == 0 {
+		return nil
+	}
+
+	exts := p.vector(2)
+	for exts.err == nil && len(exts.b) > 0 {
+		extType := exts.uint(2)
+		ext := exts.vector(2)
+		if exts.err != nil {
+			break
+		}
+
+		switch extType {
+		case extensionALPN:
+			list := ext.vector(2)
+			proto := list.vector(1)
+			if list.err == nil {
+				s.ALPN = string(proto.b)
+			}
+		case extensionSupportedVersions:
+			v := ext.uint(2)
+			if ext.err == nil {
+				s.Version = uint16(v)
+			}
+		}
+	}
+
+	return exts.err
+}
+
+func parseCertificate(msg []byte) ([]*x509.Certificate, error) {
+	p := &parser{b: msg}
+
+	list := p.vector(3)
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	certs := make([]*x509.Certificate, 0)
+	for len(list.b) > 0 {
+		der := list.vector(3)
+		if list.err != nil {
+			return nil, list.err
+		}
+
+		cert, err := x509.ParseCertificate(der.b)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
@@ -0,0 +1,195 @@
+package tlsinfo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/gamexg/proxylib/goio"
+)
+
+type RelayConfig struct {
+	// 读取 ClientHello 及网站回应的超时时间，0 表示不限制
+	Timeout time.Duration
+
+	// 检查网站的回应，返回错误时关闭到网站的连接并通过 Redial 重试
+	Verify func(hello *ClientHello, server *ServerHandshake) error
+
+	// 最多尝试次数，包含第一次，0 表示只尝试一次
+	MaxAttempts int
+	// 重新建立到网站的连接，attempt 从 1 开始，lastErr 是上一次失败的原因
+	// 为空则不重试
+	Redial func(ctx context.Context, attempt int, lastErr error) (net.Conn, error)
+}
+
+type dialAttemptKey struct{}
+
+type dialAttempt struct {
+	attempt int
+	lastErr error
+}
+
+// 记录重试次数，供建立连接的函数切换线路
+func WithDialAttempt(ctx context.Context, attempt int, lastErr error) context.Context {
+	return context.WithValue(ctx, dialAttemptKey{}, &dialAttempt{attempt: attempt, lastErr: lastErr})
+}
+
+// 取得重试次数及上一次失败的原因，第一次尝试时返回 0, nil
+func DialAttemptFromContext(ctx context.Context) (int, error) {
+	v, _ := ctx.Value(dialAttemptKey{}).(*dialAttempt)
+	if v == nil {
+		return 0, nil
+	}
+	return v.attempt, v.lastErr
+}
+
+type readResult struct {
+	b   []byte
+	err error
+}
+
+func readFirstByte(c net.Conn) chan readResult {
+	ch := make(chan readResult, 1)
+	go func() {
+		b := make([]byte, 1)
+		// Read 允许返回 0, nil，需要读到数据或出错才返回
+		n, err := 0, error(nil)
+		for n == 0 && err == nil {
+			n, err = c.Read(b)
+		}
+		ch <- readResult{b: b[:n], err: err}
+	}()
+	return ch
+}
+
+// 中断 readFirstByte，返回已读到的数据
+// 依赖 SetReadDeadline 中断阻塞的 Read，连接不支持时返回错误，不等待 readFirstByte 结束
+func stopFirstByte(c net.Conn, ch chan readResult) (readResult, error) {
+	err := c.SetReadDeadline(time.Now())
+	if err != nil {
+		return readResult{}, fmt.Errorf("SetReadDeadline, %v", err)
+	}
+	r := <-ch
+	_ = c.SetReadDeadline(time.Time{})
+	return r, nil
+}
+
+// 在客户端与网站之间转发 tls 握手的明文部分，并在转发应用数据前检查网站的回应
+// clientConn 是已经建立的隧道，siteConn 是到网站的连接。
+// 客户端先发出的不是 tls 握手、或者网站先发出数据时不做检查；
+// 首字节是 tls 握手但 ClientHello 无法解析时返回错误。
+// 成功时返回之后用于双向转发的连接，可能包装了已经读取的数据，返回的 siteConn 由调用方关闭；
+// 失败时到网站的连接都已经被关闭。
+// clientConn 及 siteConn 需要支持用 SetReadDeadline 中断阻塞中的 Read，
+// 否则返回错误，这时 clientConn 上可能还有未结束的 Read，需要调用方关闭 clientConn。
+func RelayHandshake(ctx context.Context, clientConn, siteConn net.Conn, conf *RelayConfig) (net.Conn, net.Conn, error) {
+	clientCh := readFirstByte(clientConn)
+	siteCh := readFirstByte(siteConn)
+
+	var first []byte
+	select {
+	case r := <-clientCh:
+		sr, err := stopFirstByte(siteConn, siteCh)
+		if err != nil {
+			_ = siteConn.Close()
+			return nil, nil, fmt.Errorf("siteConn.%v", err)
+		}
+		if r.err != nil {
+			_ = siteConn.Close()
+			return nil, nil, fmt.Errorf("clientConn.Read, %v", r.err)
+		}
+
+		if len(sr.b) != 0 || r.b[0] != recordTypeHandshake {
+			return goio.NewPrefixConn(clientConn, r.b), goio.NewPrefixConn(siteConn, sr.b), nil
+		}
+		first = r.b
+
+	case r := <-siteCh:
+		// 网站先发出数据，不是 tls
+		cr, err := stopFirstByte(clientConn, clientCh)
+		if err != nil {
+			_ = siteConn.Close()
+			return nil, nil, fmt.Errorf("clientConn.%v", err)
+		}
+		if r.err != nil {
+			_ = siteConn.Close()
+			return nil, nil, fmt.Errorf("siteConn.Read, %v", r.err)
+		}
+		return goio.NewPrefixConn(clientConn, cr.b), goio.NewPrefixConn(siteConn, r.b), nil
+
+	case <-ctx.Done():
+		_, _ = stopFirstByte(clientConn, clientCh)
+		_ = siteConn.Close()
+		return nil, nil, ctx.Err()
+	}
+
+	if conf.Timeout != 0 {
+		_ = clientConn.SetReadDeadline(time.Now().Add(conf.Timeout))
+	}
+	hello, helloRaw, err := ReadClientHello(io.MultiReader(bytes.NewReader(first), clientConn))
+	_ = clientConn.SetReadDeadline(time.Time{})
+	if err != nil {
+		// 无法检查网站回应，不能转发
+		_ = siteConn.Close()
+		return nil, nil, fmt.Errorf("ReadClientHello, %v", err)
+	}
+
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		if attempt != 0 {
+			siteConn, err = conf.Redial(ctx, attempt, lastErr)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Redial, %v, last error: %v", err, lastErr)
+			}
+		}
+
+		server, serverRaw, err := exchangeHello(siteConn, helloRaw, conf.Timeout)
+		if err == nil && conf.Verify != nil {
+			err = conf.Verify(hello, server)
+		}
+
+		if err == nil {
+			if conf.Timeout != 0 {
+				_ = clientConn.SetWriteDeadline(time.Now().Add(conf.Timeout))
+			}
+			_, err = goio.WriteAll(clientConn, serverRaw)
+			_ = clientConn.SetWriteDeadline(time.Time{})
+			if err != nil {
+				_ = siteConn.Close()
+				return nil, nil, fmt.Errorf("clientConn.Write, %v", err)
+			}
+
+			return clientConn, siteConn, nil
+		}
+
+		_ = siteConn.Close()
+		lastErr = err
+
+		if conf.Redial == nil || attempt+1 >= conf.MaxAttempts {
+			return nil, nil, fmt.Errorf("verify, %v", err)
+		}
+	}
+}
+
+// 向网站发出 ClientHello 并读取回应
+func exchangeHello(siteConn net.Conn, helloRaw []byte, timeout time.Duration) (*ServerHandshake, []byte, error) {
+	if timeout != 0 {
+		_ = siteConn.SetDeadline(time.Now().Add(timeout))
+		defer siteConn.SetDeadline(time.Time{})
+	}
+
+	_, err := goio.WriteAll(siteConn, helloRaw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("siteConn.Write, %v", err)
+	}
+
+	server, serverRaw, err := ReadServerHandshake(siteConn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ReadServerHandshake, %v", err)
+	}
+
+	return server, serverRaw, nil
+}
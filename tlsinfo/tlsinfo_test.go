@@ -0,0 +1,271 @@
+package tlsinfo
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gamexg/proxylib/goio"
+)
+
+func TestReadClientHello(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		tlsConn := tls.Client(client, &tls.Config{
+			ServerName: "www.example.com",
+			NextProtos: []string{"h2", "http/1.1"},
+		})
+		_ = tlsConn.Handshake()
+	}()
+
+	hello, raw, err := ReadClientHello(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hello.ServerName != "www.example.com" ||
+		len(hello.ALPN) != 2 || hello.ALPN[0] != "h2" ||
+		len(hello.SupportedVersions) == 0 ||
+		len(raw) < 100 {
+		t.Fatalf("hello = %#v, len(raw) = %v", hello, len(raw))
+	}
+}
+
+// 自签名证书，用于模拟证书错误的线路
+func newSelfSignedCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func newTls12Site(t *testing.T, cert *tls.Certificate) *httptest.Server {
+	site := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	}))
+	site.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	if cert != nil {
+		site.TLS.Certificates = []tls.Certificate{*cert}
+	}
+	site.StartTLS()
+	return site
+}
+
+func TestRelayHandshake(t *testing.T) {
+	// 第一条线路返回错误的证书，第二条线路正常
+	badCert := newSelfSignedCert(t)
+	badSite := newTls12Site(t, &badCert)
+	defer badSite.Close()
+	site := newTls12Site(t, nil)
+	defer site.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(site.Certificate())
+
+	dial := func(ctx context.Context) (net.Conn, error) {
+		attempt, _ := DialAttemptFromContext(ctx)
+		addr := badSite.Listener.Addr().String()
+		if attempt != 0 {
+			addr = site.Listener.Addr().String()
+		}
+
+		d := net.Dialer{}
+		return d.DialContext(ctx, "tcp", addr)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	verified := make(chan *ServerHandshake, 2)
+
+	go func() {
+		defer server.Close()
+
+		ctx := context.Background()
+		siteConn, err := dial(ctx)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		clientConn, siteConn, err := RelayHandshake(ctx, server, siteConn, &RelayConfig{
+			Timeout: 5 * time.Second,
+			Verify: func(hello *ClientHello, s *ServerHandshake) error {
+				verified <- s
+				return VerifyCertificates(hello.ServerName, s, pool)
+			},
+			MaxAttempts: 2,
+			Redial: func(ctx context.Context, attempt int, lastErr error) (net.Conn, error) {
+				return dial(WithDialAttempt(ctx, attempt, lastErr))
+			},
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer siteConn.Close()
+
+		_ = goio.Forward(ctx, clientConn, siteConn, "clientConn", "siteConn", 32*1024, time.Minute)
+	}()
+
+	tlsConn := tls.Client(client, &tls.Config{
+		ServerName: "example.com",
+		RootCAs:    pool,
+	})
+
+	req, _ := http.NewRequest("GET", "https://example.com/", nil)
+	err := req.Write(tlsConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != "hello" {
+		t.Fatalf("body = %q", body)
+	}
+
+	for i := 0; i < 2; i++ {
+		s := <-verified
+		if s.Version != tls.VersionTLS12 || len(s.Certificates) == 0 {
+			t.Fatalf("server = %#v", s)
+		}
+	}
+}
+
+func TestRelayHandshake_NotTls(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	siteClient, siteServer := net.Pipe()
+	defer siteServer.Close()
+
+	go func() {
+		_, _ = client.Write([]byte("GET / HTTP/1.1\r\n"))
+	}()
+
+	clientConn, siteConn, err := RelayHandshake(context.Background(), server, siteClient, &RelayConfig{
+		Verify: func(hello *ClientHello, s *ServerHandshake) error {
+			t.Error("unexpected verify")
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer siteConn.Close()
+
+	// 已读取的数据需要能够再次读到
+	b := make([]byte, 1)
+	_, err = clientConn.Read(b)
+	if err != nil || b[0] != 'G' {
+		t.Fatalf("b = %q, err = %v", b, err)
+	}
+}
+
+// 第一次 Read 返回 0, nil 的连接
+type emptyReadConn struct {
+	net.Conn
+	empty bool
+}
+
+func (c *emptyReadConn) Read(b []byte) (int, error) {
+	if !c.empty {
+		c.empty = true
+		return 0, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func TestRelayHandshake_EmptyRead(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	siteClient, siteServer := net.Pipe()
+	defer siteServer.Close()
+
+	go func() {
+		_, _ = client.Write([]byte("GET / HTTP/1.1\r\n"))
+	}()
+
+	clientConn, siteConn, err := RelayHandshake(context.Background(), &emptyReadConn{Conn: server}, siteClient, &RelayConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer siteConn.Close()
+
+	b := make([]byte, 1)
+	_, err = clientConn.Read(b)
+	if err != nil || b[0] != 'G' {
+		t.Fatalf("b = %q, err = %v", b, err)
+	}
+}
+
+func TestRelayHandshake_Error(t *testing.T) {
+	// 无法解析的 ClientHello 不能不经检查就转发
+	t.Run("bad-hello", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		siteClient, siteServer := net.Pipe()
+		defer siteServer.Close()
+
+		go func() {
+			_, _ = client.Write([]byte{0x16, 0x03, 0x01, 0x00, 0x04, 0x02, 0x00, 0x00, 0x00})
+		}()
+
+		_, _, err := RelayHandshake(context.Background(), server, siteClient, &RelayConfig{Timeout: 5 * time.Second})
+		if err == nil {
+			t.Fatal("err == nil")
+		}
+
+		_, err = siteServer.Read(make([]byte, 1))
+		if err == nil {
+			t.Fatal("siteConn is not closed")
+		}
+	})
+
+	// 读取网站失败时返回错误，而不是当作网站先发出数据
+	t.Run("site-read", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		siteClient, siteServer := net.Pipe()
+
+		_ = siteServer.Close()
+
+		_, _, err := RelayHandshake(context.Background(), server, siteClient, &RelayConfig{})
+		if err == nil {
+			t.Fatal("err == nil")
+		}
+	})
+}
@@ -0,0 +1,34 @@
+package tlsinfo
+
+import (
+	"crypto/x509"
+	"errors"
+)
+
+// 网站没有发送明文证书，例如 tls 1.3 或会话恢复
+var ErrNoCertificates = errors.New("no plaintext certificates")
+
+// 验证网站的证书链
+// roots 为空则使用系统根证书。
+// 收到告警时返回告警，没有明文证书时返回 ErrNoCertificates，由调用方决定是否放行
+func VerifyCertificates(serverName string, s *ServerHandshake, roots *x509.CertPool) error {
+	if s.Alert != nil {
+		return s.Alert
+	}
+
+	if len(s.Certificates) == 0 {
+		return ErrNoCertificates
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range s.Certificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := s.Certificates[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}